@@ -0,0 +1,83 @@
+package tobubus
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+)
+
+// ErrCallCanceled is returned by PendingCall.Result after Cancel.
+var ErrCallCanceled = errors.New("Call is canceled")
+
+// PendingCall is the method call started by CallAsync.
+//
+// Cancel stops waiting the reply, but it doesn't interrupt the method on the other side.
+// The late reply is dropped.
+type PendingCall struct {
+	done     chan struct{}
+	canceled chan struct{}
+	once     sync.Once
+	cancel   sync.Once
+	result   []interface{}
+	err      error
+}
+
+func newPendingCall() *PendingCall {
+	return &PendingCall{
+		done:     make(chan struct{}),
+		canceled: make(chan struct{}),
+	}
+}
+
+// Done returns the channel that is closed when the result is available.
+func (c *PendingCall) Done() <-chan struct{} {
+	return c.done
+}
+
+// Result waits the call and returns its results.
+func (c *PendingCall) Result() ([]interface{}, error) {
+	<-c.done
+	return c.result, c.err
+}
+
+// Cancel stops waiting the reply. Result returns ErrCallCanceled if the call hasn't finished yet.
+func (c *PendingCall) Cancel() {
+	c.cancel.Do(func() {
+		close(c.canceled)
+	})
+	c.finish(nil, ErrCallCanceled)
+}
+
+// finish sets the result. Only the first result is kept.
+func (c *PendingCall) finish(result []interface{}, err error) {
+	c.once.Do(func() {
+		c.result = result
+		c.err = err
+		close(c.done)
+	})
+}
+
+// WaitAll waits all calls and returns the first error in the order of calls.
+func WaitAll(calls ...*PendingCall) error {
+	var result error
+	for _, call := range calls {
+		_, err := call.Result()
+		if err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+// WaitAny waits until one of calls finishes and returns its index. It returns -1 if calls is empty.
+func WaitAny(calls ...*PendingCall) int {
+	if len(calls) == 0 {
+		return -1
+	}
+	cases := make([]reflect.SelectCase, len(calls))
+	for i, call := range calls {
+		cases[i] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(call.done)}
+	}
+	index, _, _ := reflect.Select(cases)
+	return index
+}
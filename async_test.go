@@ -0,0 +1,128 @@
+package tobubus
+
+import (
+	"fmt"
+	"testing"
+)
+
+type asyncStruct struct {
+	release chan struct{}
+}
+
+func (a *asyncStruct) Echo(message string) string {
+	return message
+}
+
+func (a *asyncStruct) Block() string {
+	<-a.release
+	return "released"
+}
+
+func connectForAsyncTest(name string, t *testing.T) (*Host, *Plugin, *asyncStruct) {
+	transport := NewInProcessTransport()
+	host := NewHostWithTransport(name, transport)
+	obj := &asyncStruct{release: make(chan struct{})}
+	host.Publish("/host", obj)
+	err := host.Listen()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	plugin, err := NewPluginWithTransport(name, "github.com/shibukawa/tobubus/async", transport)
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	plugin.Publish("/plugin", &asyncStruct{release: make(chan struct{})})
+	err = plugin.Connect()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	return host, plugin, obj
+}
+
+func TestCallAsync(t *testing.T) {
+	host, plugin, _ := connectForAsyncTest("tobubus.async", t)
+	defer host.Close()
+	defer plugin.Close()
+
+	var calls []*PendingCall
+	for i := 0; i < 10; i++ {
+		calls = append(calls, plugin.CallAsync("/host", "Echo", fmt.Sprintf("message %d", i)))
+	}
+	err := WaitAll(calls...)
+	if err != nil {
+		t.Errorf("err should be nil, but %v", err)
+	}
+	for i, call := range calls {
+		select {
+		case <-call.Done():
+		default:
+			t.Errorf("call %d should be done", i)
+		}
+		result, err := call.Result()
+		if err != nil || len(result) != 1 || result[0] != fmt.Sprintf("message %d", i) {
+			t.Errorf("result %d should be 'message %d', but %v %v", i, i, result, err)
+		}
+	}
+	result, err := host.CallAsync("/plugin", "Echo", "from host").Result()
+	if err != nil || len(result) != 1 || result[0] != "from host" {
+		t.Errorf("result should be 'from host', but %v %v", result, err)
+	}
+	err = WaitAll(plugin.CallAsync("/host", "Echo", "ok"), plugin.CallAsync("/missing", "Echo", "ng"))
+	if err == nil {
+		t.Error("err should not be nil")
+	}
+	if plugin.sessions.count() != 0 {
+		t.Errorf("sessions should be released, but %d", plugin.sessions.count())
+	}
+}
+
+func TestCallAsyncCancel(t *testing.T) {
+	host, plugin, obj := connectForAsyncTest("tobubus.async.cancel", t)
+	defer host.Close()
+	defer plugin.Close()
+
+	call := plugin.CallAsync("/host", "Block")
+	call.Cancel()
+	<-call.Done()
+	result, err := call.Result()
+	if err != ErrCallCanceled || result != nil {
+		t.Errorf("err should be ErrCallCanceled, but %v %v", result, err)
+	}
+	call.Cancel() // twice
+
+	// the late reply is dropped and the session is released
+	close(obj.release)
+	if !waitUntil(func() bool { return plugin.sessions.count() == 0 }) {
+		t.Errorf("sessions should be released, but %d", plugin.sessions.count())
+	}
+	result, err = plugin.Call("/host", "Echo", "after cancel")
+	if err != nil || len(result) != 1 || result[0] != "after cancel" {
+		t.Errorf("result should be 'after cancel', but %v %v", result, err)
+	}
+
+	// Cancel after the reply doesn't change the result
+	call = plugin.CallAsync("/host", "Echo", "finished")
+	<-call.Done()
+	call.Cancel()
+	result, err = call.Result()
+	if err != nil || len(result) != 1 || result[0] != "finished" {
+		t.Errorf("result should be 'finished', but %v %v", result, err)
+	}
+}
+
+func TestWaitAny(t *testing.T) {
+	host, plugin, obj := connectForAsyncTest("tobubus.async.any", t)
+	defer host.Close()
+	defer plugin.Close()
+	defer close(obj.release)
+
+	blocked := plugin.CallAsync("/host", "Block")
+	defer blocked.Cancel()
+	index := WaitAny(blocked, plugin.CallAsync("/host", "Echo", "fast"))
+	if index != 1 {
+		t.Errorf("index should be 1, but %d", index)
+	}
+	if index := WaitAny(); index != -1 {
+		t.Errorf("index should be -1, but %d", index)
+	}
+}
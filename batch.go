@@ -0,0 +1,263 @@
+package tobubus
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// BatchCall is an entry of CallBatch.
+type BatchCall struct {
+	Path   string
+	Method string
+	Params []interface{}
+}
+
+// BatchOptions changes how the receiver dispatches the entries of CallBatch.
+//
+// Entries are called concurrently by default. If Ordered is true, they are called one by one in order.
+// StopOnError implies Ordered: the entries after the first error are not called and their Err is ErrBatchSkipped.
+type BatchOptions struct {
+	Ordered     bool
+	StopOnError bool
+}
+
+// BatchResult is the result of an entry of CallBatch. Err is the same error that Call returns for the entry.
+type BatchResult struct {
+	Result  []interface{}
+	Err     error
+	Trailer map[string]string
+}
+
+// ErrBatchSkipped is the error of the entries that are not called because of StopOnError.
+var ErrBatchSkipped = errors.New("Call is skipped by the previous error in batch")
+
+// batchCall is the body of CallBatch.
+type batchCall struct {
+	Calls       []methodCall      `codec:"calls"`
+	Ordered     bool              `codec:"ordered,omitempty"`
+	StopOnError bool              `codec:"stopOnError,omitempty"`
+	Metadata    map[string]string `codec:"metadata,omitempty"` // shared by all entries
+}
+
+// batchEntryResult is the result of an entry in ReturnBatch.
+type batchEntryResult struct {
+	Type     MessageType       `codec:"type"` // reply type that CallMethod would return. 0 if the entry is skipped.
+	Params   []interface{}     `codec:"params"`
+	Error    string            `codec:"error,omitempty"` // body of ResultNG and ResultProtocolError
+	Metadata map[string]string `codec:"metadata,omitempty"`
+}
+
+// batchReply is the body of ReturnBatch.
+type batchReply struct {
+	Results []batchEntryResult `codec:"results"`
+}
+
+// resultType returns the result type for metrics and tracing.
+func (r *batchEntryResult) resultType() MessageType {
+	if r.Type == ReturnMethod {
+		return ResultOK
+	}
+	return r.Type
+}
+
+// batchResult converts the entry to BatchResult. Errors are the same as Call.
+func (r *batchEntryResult) batchResult(path, methodName string) BatchResult {
+	switch r.Type {
+	case 0:
+		return BatchResult{Err: ErrBatchSkipped}
+	case ReturnMethod:
+		return BatchResult{Result: r.Params, Trailer: r.Metadata}
+	}
+	return BatchResult{Err: resultError(&message{Type: r.Type, body: []byte(r.Error)}, path, methodName)}
+}
+
+func archiveBatchCallMessage(c Codec, sessionID uint32, calls []BatchCall, options BatchOptions, metadata map[string]string, exportParams func([]interface{}) ([]interface{}, error)) ([]byte, error) {
+	if len(metadata) == 0 {
+		metadata = nil
+	}
+	batch := batchCall{
+		Calls:       make([]methodCall, len(calls)),
+		Ordered:     options.Ordered,
+		StopOnError: options.StopOnError,
+		Metadata:    metadata,
+	}
+	for i, call := range calls {
+		params, streamArgs := replaceStreamArguments(call.Params)
+		if len(streamArgs) > 0 {
+			return nil, errors.New("Streams can't be passed to batch calls.")
+		}
+		params, err := exportParams(params)
+		if err != nil {
+			return nil, err
+		}
+		batch.Calls[i] = methodCall{Path: call.Path, Method: call.Method, Params: params}
+	}
+	data, err := c.Encode(batch)
+	if err != nil {
+		return nil, err
+	}
+	return archiveMessage(CallBatch, sessionID, data), nil
+}
+
+func parseBatchCallMessage(c Codec, data []byte) (*batchCall, error) {
+	result := &batchCall{}
+	err := c.Decode(data, result)
+	if err != nil {
+		return nil, fmt.Errorf("can't decode batch call: %v", err)
+	}
+	for i := range result.Calls {
+		// entries share the metadata of batch
+		result.Calls[i].Metadata = result.Metadata
+	}
+	return result, nil
+}
+
+// archiveBatchReplyMessage creates ReturnBatch. If it is larger than maxFrameSize, ResultNG is returned instead.
+func archiveBatchReplyMessage(c Codec, sessionID uint32, maxFrameSize uint32, results []batchEntryResult) []byte {
+	for i := range results {
+		if len(results[i].Metadata) == 0 {
+			results[i].Metadata = nil
+		}
+	}
+	data, err := c.Encode(batchReply{Results: results})
+	if err != nil {
+		return archiveMessage(ResultNG, sessionID, []byte(err.Error()))
+	}
+	if bodySize := uint32(len(data)); bodySize > maxFrameSize {
+		return archiveMessage(ResultNG, sessionID, []byte((&FrameSizeError{Size: bodySize, Limit: maxFrameSize}).Error()))
+	}
+	return archiveMessage(ReturnBatch, sessionID, data)
+}
+
+// runBatch calls the entries with run. It is shared by Host and Plugin. Skipped entries are left as zero value.
+//
+// Unordered entries run in other goroutines while they can take slots. The others run in the caller's goroutine.
+func runBatch(batch *batchCall, slots chan struct{}, run func(entry *methodCall) *batchEntryResult) []batchEntryResult {
+	results := make([]batchEntryResult, len(batch.Calls))
+	if batch.Ordered || batch.StopOnError {
+		for i := range batch.Calls {
+			results[i] = *run(&batch.Calls[i])
+			if batch.StopOnError && results[i].Type != ReturnMethod {
+				break
+			}
+		}
+		return results
+	}
+	var wait sync.WaitGroup
+	for i := range batch.Calls {
+		select {
+		case slots <- struct{}{}:
+			wait.Add(1)
+			go func(i int) {
+				defer func() {
+					<-slots
+					wait.Done()
+				}()
+				results[i] = *run(&batch.Calls[i])
+			}(i)
+		default:
+			results[i] = *run(&batch.Calls[i])
+		}
+	}
+	wait.Wait()
+	return results
+}
+
+// callBatchEntry calls the method of obj via invoker like CallMethod, but returns the result instead of replying.
+// It is shared by Host and Plugin. obj is nil if the object is not found.
+func callBatchEntry(obj *Proxy, invoker Invoker, info *CallInfo, params []interface{}, logger *slog.Logger) (result *batchEntryResult) {
+	logger.Debug("method called")
+	if obj == nil {
+		logger.Debug("object not found")
+		return &batchEntryResult{Type: ResultObjectNotFound}
+	}
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Error("method panicked", slog.Any("error", err))
+			result = &batchEntryResult{Type: ResultMethodError}
+		}
+	}()
+	if !obj.hasMethod(info.Method) {
+		logger.Debug("method not found")
+		return &batchEntryResult{Type: ResultMethodNotFound}
+	}
+	values, err := invoker(info, params)
+	if err != nil {
+		logger.Debug("method call rejected", slog.Any("error", err))
+		return &batchEntryResult{Type: ResultNG, Error: err.Error()}
+	}
+	if len(values) > 0 && streamKindOf(values[0]) != "" {
+		return &batchEntryResult{Type: ResultNG, Error: "Streams can't be returned from batch calls."}
+	}
+	return &batchEntryResult{Type: ReturnMethod, Params: values, Metadata: info.Trailer}
+}
+
+// callBatchRemote sends CallBatch and waits ReturnBatch. It is shared by Host and Plugin.
+func callBatchRemote(socket net.Conn, sessions *sessionManager, c Codec, maxFrameSize uint32, calls []BatchCall, options BatchOptions, metadata map[string]string, exportParams func([]interface{}) ([]interface{}, error), metrics *metrics) ([]BatchResult, error) {
+	sessionID := sessions.getUniqueSessionID()
+	data, err := archiveBatchCallMessage(c, sessionID, calls, options, metadata, exportParams)
+	if err != nil {
+		sessions.closeSession(sessionID)
+		return nil, err
+	}
+	if bodySize := uint32(len(data) - 12); bodySize > maxFrameSize {
+		sessions.closeSession(sessionID)
+		return nil, &FrameSizeError{Size: bodySize, Limit: maxFrameSize}
+	}
+	start := time.Now()
+	_, err = socket.Write(data)
+	if err != nil {
+		sessions.closeSession(sessionID)
+		return nil, err
+	}
+	message := sessions.receiveAndClose(sessionID)
+	if message.Type != ReturnBatch {
+		if message.Type == ResultNG {
+			return nil, fmt.Errorf("Batch call error: %s", string(message.body))
+		}
+		return nil, resultError(message, "", "CallBatch")
+	}
+	reply := &batchReply{}
+	err = c.Decode(message.body, reply)
+	if err != nil {
+		return nil, fmt.Errorf("can't decode batch result: %v", err)
+	}
+	if len(reply.Results) != len(calls) {
+		return nil, fmt.Errorf("Batch call error: %d results for %d calls", len(reply.Results), len(calls))
+	}
+	results := make([]BatchResult, len(calls))
+	for i, call := range calls {
+		results[i] = reply.Results[i].batchResult(call.Path, call.Method)
+		if reply.Results[i].Type != 0 {
+			metrics.recordCall(CallSent, call.Path, call.Method, reply.Results[i].resultType(), start)
+		}
+	}
+	return results, nil
+}
+
+// callBatchLocal calls the entries on local objects via invoker like Call. objectOf returns the object of path or nil.
+func callBatchLocal(calls []BatchCall, options BatchOptions, info *CallInfo, objectOf func(path string) *Proxy, invoker Invoker, logger *slog.Logger) []BatchResult {
+	batch := &batchCall{
+		Calls:       make([]methodCall, len(calls)),
+		Ordered:     options.Ordered,
+		StopOnError: options.StopOnError,
+	}
+	for i, call := range calls {
+		batch.Calls[i] = methodCall{Path: call.Path, Method: call.Method, Params: call.Params}
+	}
+	entries := runBatch(batch, make(chan struct{}, defaultBatchConcurrency), func(entry *methodCall) *batchEntryResult {
+		entryInfo := *info
+		entryInfo.Path, entryInfo.Method = entry.Path, entry.Method
+		entryInfo.Trailer = make(map[string]string)
+		return callBatchEntry(objectOf(entry.Path), invoker, &entryInfo, entry.Params, logger.With(slog.String("path", entry.Path), slog.String("method", entry.Method)))
+	})
+	results := make([]BatchResult, len(calls))
+	for i, call := range calls {
+		results[i] = entries[i].batchResult(call.Path, call.Method)
+	}
+	return results
+}
@@ -0,0 +1,187 @@
+package tobubus
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type batchStruct struct {
+	lock  sync.Mutex
+	calls []string
+}
+
+func (b *batchStruct) Append(message string) string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.calls = append(b.calls, message)
+	return strings.Join(b.calls, ",")
+}
+
+func (b *batchStruct) count() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return len(b.calls)
+}
+
+func (b *batchStruct) Panic() {
+	panic("batch")
+}
+
+func (b *batchStruct) Trailer(info *CallInfo) {
+	info.Trailer["key"] = "value"
+}
+
+func TestCallBatch(t *testing.T) {
+	transport := NewInProcessTransport()
+	host := NewHostWithTransport("tobubus.batch", transport)
+	hostObj := &batchStruct{}
+	host.Publish("/host", hostObj)
+	err := host.Listen()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	defer host.Close()
+	plugin, err := NewPluginWithTransport("tobubus.batch", "github.com/shibukawa/tobubus/batch", transport)
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	pluginObj := &batchStruct{}
+	plugin.Publish("/plugin", pluginObj)
+	err = plugin.Connect()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	defer plugin.Close()
+
+	calls := []BatchCall{
+		{Path: "/host", Method: "Append", Params: []interface{}{"a"}},
+		{Path: "/host", Method: "Append", Params: []interface{}{"b"}},
+		{Path: "/host", Method: "Missing"},
+		{Path: "/missing", Method: "Append", Params: []interface{}{"c"}},
+		{Path: "/host", Method: "Panic"},
+		{Path: "/host", Method: "Trailer"},
+		{Path: "/host", Method: "Append", Params: []interface{}{"d"}},
+	}
+	results, err := plugin.CallBatch(calls, BatchOptions{Ordered: true})
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	if len(results) != len(calls) {
+		t.Fatalf("results should have %d entries, but %d", len(calls), len(results))
+	}
+	if results[0].Result[0] != "a" || results[1].Result[0] != "a,b" || results[6].Result[0] != "a,b,d" {
+		t.Errorf("entries should be called in order, but %v %v %v", results[0].Result, results[1].Result, results[6].Result)
+	}
+	// errors are the same as Call
+	for _, i := range []int{2, 3, 4} {
+		_, err := plugin.Call(calls[i].Path, calls[i].Method, calls[i].Params...)
+		if results[i].Err == nil || err == nil || results[i].Err.Error() != err.Error() {
+			t.Errorf("error %d should be '%v', but '%v'", i, err, results[i].Err)
+		}
+	}
+	if results[5].Err != nil || results[5].Trailer["key"] != "value" {
+		t.Errorf("trailer should be returned, but %v %v", results[5].Trailer, results[5].Err)
+	}
+
+	results, err = plugin.CallBatch([]BatchCall{
+		{Path: "/host", Method: "Append", Params: []interface{}{"e"}},
+		{Path: "/host", Method: "Missing"},
+		{Path: "/host", Method: "Append", Params: []interface{}{"f"}},
+	}, BatchOptions{StopOnError: true})
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	if results[0].Err != nil || results[1].Err == nil || !strings.Contains(results[1].Err.Error(), "Missing") || results[2].Err != ErrBatchSkipped {
+		t.Errorf("entries after the error should be skipped, but %v %v %v", results[0].Err, results[1].Err, results[2].Err)
+	}
+	if count := hostObj.count(); count != 4 {
+		t.Errorf("skipped entry should not be called, but %d calls", count)
+	}
+
+	// concurrent dispatch from host to plugin
+	calls = nil
+	for i := 0; i < 10; i++ {
+		calls = append(calls, BatchCall{Path: "/plugin", Method: "Append", Params: []interface{}{"x"}})
+	}
+	results, err = host.CallBatch(calls, BatchOptions{})
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	for i, result := range results {
+		if result.Err != nil {
+			t.Errorf("result %d should be nil, but %v", i, result.Err)
+		}
+	}
+	if count := pluginObj.count(); count != 10 {
+		t.Errorf("all entries should be called, but %d calls", count)
+	}
+
+	// local objects
+	results, err = host.CallBatch([]BatchCall{{Path: "/host", Method: "Append", Params: []interface{}{"g"}}, {Path: "/host", Method: "Missing"}}, BatchOptions{})
+	if err != nil || results[0].Err != nil || results[0].Result[0] != "a,b,d,e,g" || results[1].Err == nil {
+		t.Errorf("local objects should be called, but %v %v", results, err)
+	}
+	_, err = host.CallBatch([]BatchCall{{Path: "/host", Method: "Append"}, {Path: "/plugin", Method: "Append"}}, BatchOptions{})
+	if err == nil {
+		t.Error("err should not be nil")
+	}
+	_, err = plugin.CallBatch([]BatchCall{{Path: "/host", Method: "Append", Params: []interface{}{make(chan string)}}}, BatchOptions{})
+	if err == nil {
+		t.Error("streams should not be passed")
+	}
+}
+
+func TestCallBatchLocalInterceptor(t *testing.T) {
+	host := NewHostWithTransport("tobubus.batch.interceptor", NewInProcessTransport())
+	host.Publish("/host", &batchStruct{})
+	var lock sync.Mutex
+	var intercepted []string
+	host.UseClientInterceptor(func(info *CallInfo, params []interface{}, next Invoker) ([]interface{}, error) {
+		lock.Lock()
+		intercepted = append(intercepted, info.Method)
+		lock.Unlock()
+		return next(info, params)
+	})
+	results, err := host.CallBatch([]BatchCall{
+		{Path: "/host", Method: "Append", Params: []interface{}{"a"}},
+		{Path: "/host", Method: "Trailer"},
+	}, BatchOptions{Ordered: true})
+	if err != nil || results[0].Err != nil || results[1].Trailer["key"] != "value" {
+		t.Fatalf("local objects should be called, but %v %v", results, err)
+	}
+	if strings.Join(intercepted, ",") != "Append,Trailer" {
+		t.Errorf("client interceptors should be called for the entries like Call, but %v", intercepted)
+	}
+}
+
+func TestRunBatchLimit(t *testing.T) {
+	batch := &batchCall{Calls: make([]methodCall, 10)}
+	var lock sync.Mutex
+	running, maxRunning := 0, 0
+	// the worker that runs the batch holds one slot
+	slots := make(chan struct{}, 2)
+	slots <- struct{}{}
+	results := runBatch(batch, slots, func(entry *methodCall) *batchEntryResult {
+		lock.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		lock.Unlock()
+		time.Sleep(time.Millisecond)
+		lock.Lock()
+		running--
+		lock.Unlock()
+		return &batchEntryResult{Type: ReturnMethod}
+	})
+	if maxRunning > 2 {
+		t.Errorf("up to 2 entries should run at the same time with the caller, but %d", maxRunning)
+	}
+	for i, result := range results {
+		if result.Type != ReturnMethod {
+			t.Errorf("entry %d should be called, but %v", i, result.Type)
+		}
+	}
+}
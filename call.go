@@ -0,0 +1,184 @@
+package tobubus
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+)
+
+// callRemote sends CallMethod and waits the reply. It is shared by Host and Plugin.
+//
+// If the method returns a stream, the reply is ReturnStream and the stream is returned.
+// The session is kept until the stream ends.
+//
+// If canceled is closed before the reply, it returns ErrCallCanceled. The reply is dropped when it arrives.
+func callRemote(socket net.Conn, sessions *sessionManager, streams *streamTable, c Codec, maxFrameSize uint32, path, methodName string, metadata map[string]string, params []interface{}, canceled <-chan struct{}) (*message, *Stream, error) {
+	sessionID := sessions.getUniqueSessionID()
+	params, streamArgs := replaceStreamArguments(params)
+	data, err := archiveMethodCallMessageWithMetadata(c, CallMethod, sessionID, path, methodName, metadata, params)
+	if err != nil {
+		sessions.closeSession(sessionID)
+		return nil, nil, err
+	}
+	if bodySize := uint32(len(data) - 12); bodySize > maxFrameSize {
+		sessions.closeSession(sessionID)
+		return nil, nil, &FrameSizeError{Size: bodySize, Limit: maxFrameSize}
+	}
+	key := streamKey{socket: socket, session: sessionID, index: 0}
+	result := streams.addReceiver(key, "", c)
+	_, err = socket.Write(data)
+	if err != nil {
+		streams.removeReceiver(key)
+		sessions.closeSession(sessionID)
+		return nil, nil, err
+	}
+	stopArgs := streams.sendArguments(socket, sessionID, c, streamArgs, maxFrameSize)
+	message, ok := sessions.receiveOrCancel(sessionID, socket, canceled)
+	if !ok {
+		streams.removeReceiver(key)
+		stopArgs()
+		return nil, nil, ErrCallCanceled
+	}
+	if message.Type == ReturnStream {
+		header, err := parseMethodCallMessage(c, message.body)
+		if err == nil && len(header.Params) > 0 {
+			result.kind, _ = header.Params[0].(string)
+		}
+		streams.setOnClose(result, func() {
+			stopArgs()
+			sessions.closeSession(sessionID)
+		})
+		if result.kind != streamValues && result.kind != streamBytes {
+			result.Close()
+			return nil, nil, fmt.Errorf("Method '%s' at '%s' returns unknown stream.", methodName, path)
+		}
+		return message, result, nil
+	}
+	streams.removeReceiver(key)
+	stopArgs()
+	sessions.closeSession(sessionID)
+	return message, nil, resultError(message, path, methodName)
+}
+
+// notifyRemote sends NotifyMethod. It returns after sending the frame because the remote side doesn't reply.
+// Streams can't be sent because they need the session.
+func notifyRemote(socket net.Conn, c Codec, maxFrameSize uint32, path, methodName string, metadata map[string]string, params []interface{}) error {
+	params, streamArgs := replaceStreamArguments(params)
+	if len(streamArgs) > 0 {
+		return errors.New("Streams can't be passed to notifications.")
+	}
+	data, err := archiveMethodCallMessageWithMetadata(c, NotifyMethod, 0, path, methodName, metadata, params)
+	if err != nil {
+		return err
+	}
+	if bodySize := uint32(len(data) - 12); bodySize > maxFrameSize {
+		return &FrameSizeError{Size: bodySize, Limit: maxFrameSize}
+	}
+	_, err = socket.Write(data)
+	return err
+}
+
+// notifyLocal calls the method of local object in another goroutine. Errors are logged because nobody receives them.
+func notifyLocal(logging *logging, obj *Proxy, info *CallInfo, params []interface{}) {
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				logging.get().Error("method panicked", slog.String("path", info.Path), slog.String("method", info.Method), slog.Any("error", err))
+			}
+		}()
+		_, err := obj.CallWithInfo(info, info.Method, params...)
+		if err != nil {
+			logging.get().Warn("notification failed", slog.String("path", info.Path), slog.String("method", info.Method), slog.Any("error", err))
+		}
+	}()
+}
+
+// callLocalStream calls the method of local object that returns a stream.
+func callLocalStream(obj *Proxy, path, methodName string, params []interface{}) (*Stream, error) {
+	result, err := obj.CallWithInfo(&CallInfo{Path: path, Method: methodName}, methodName, params...)
+	if err != nil {
+		return nil, err
+	}
+	if len(result) == 0 || streamKindOf(result[0]) == "" {
+		return nil, fmt.Errorf("Method '%s' at '%s' doesn't return stream.", methodName, path)
+	}
+	return newLocalStream(result[0]), nil
+}
+
+// sendResult writes the reply of CallMethod. If the first result is a stream, it is sent as a stream.
+// trailer is sent with the result. It isn't sent with streams.
+func sendResult(socket net.Conn, streams *streamTable, c Codec, maxFrameSize uint32, sessionID uint32, trailer map[string]string, result []interface{}) {
+	if len(result) > 0 {
+		if kind := streamKindOf(result[0]); kind != "" {
+			header, err := archiveMethodCallMessage(c, ReturnStream, sessionID, "", "", []interface{}{kind})
+			if err != nil {
+				socket.Write(archiveMessage(ResultNG, sessionID, nil))
+				return
+			}
+			key := streamKey{socket: socket, session: sessionID, index: 0}
+			sender := streams.addSender(key)
+			socket.Write(header)
+			streams.send(key, sender, c, result[0], maxFrameSize)
+			return
+		}
+	}
+	resultMessage, err := archiveMethodCallMessageWithMetadata(c, ReturnMethod, sessionID, "", "", trailer, result)
+	if err != nil {
+		socket.Write(archiveMessage(ResultNG, sessionID, nil))
+	} else {
+		socket.Write(resultMessage)
+	}
+}
+
+// closeStreams closes the argument streams that are not passed to the method.
+func closeStreams(streams []*Stream) {
+	for _, s := range streams {
+		s.Close()
+	}
+}
+
+// callResultError returns the error of the call that is answered with result. It is nil if the call succeeded.
+func callResultError(result MessageType, info *CallInfo) error {
+	if result == ResultOK {
+		return nil
+	}
+	return resultError(&message{Type: result}, info.Path, info.Method)
+}
+
+// replier sends the replies of CallMethod. NotifyMethod has no reply, so its errors are logged instead.
+type replier struct {
+	socket       net.Conn
+	logging      *logging
+	notification bool
+	attrs        []interface{}
+}
+
+func newReplier(socket net.Conn, logging *logging, msgType MessageType, method *methodCall, attrs ...interface{}) *replier {
+	return &replier{
+		socket:       socket,
+		logging:      logging,
+		notification: msgType == NotifyMethod,
+		attrs:        append(attrs, slog.String("path", method.Path), slog.String("method", method.Method)),
+	}
+}
+
+func (r *replier) write(data []byte) {
+	if !r.notification {
+		r.logging.write(r.socket, data)
+		return
+	}
+	attrs := append([]interface{}{slog.String("result", MessageType(binary.LittleEndian.Uint32(data)).String())}, r.attrs...)
+	if len(data) > 12 {
+		attrs = append(attrs, slog.String("error", string(data[12:])))
+	}
+	r.logging.get().Warn("notification failed", attrs...)
+}
+
+// sendResult sends the result of CallMethod. Results of NotifyMethod are dropped.
+func (r *replier) sendResult(streams *streamTable, c Codec, maxFrameSize uint32, sessionID uint32, trailer map[string]string, result []interface{}) {
+	if !r.notification {
+		sendResult(r.socket, streams, c, maxFrameSize, sessionID, trailer, result)
+	}
+}
@@ -0,0 +1,79 @@
+package tobubus
+
+import (
+	"context"
+	"reflect"
+)
+
+// CallInfo describes the caller of the published method.
+//
+// Methods that take CallInfo, *CallInfo or context.Context as the first argument receive it
+// in addition to the arguments sent by the caller. context.Context carries *CallInfo
+// (see CallInfoFromContext).
+type CallInfo struct {
+	PluginID     string       // ID of the caller plugin. It is empty if the caller is host.
+	Credentials  *Credentials // peer credentials of the caller plugin if available
+	SessionID    uint32
+	Path         string
+	Method       string
+	Trace        SpanContext // span of this call. It is sent to the other side by calls made with the context of the method.
+	Notification bool        // the call is sent by Notify. Its results are dropped and errors are only logged by the callee.
+
+	Metadata map[string]string // metadata sent with the call. Client interceptors can add entries.
+	Trailer  map[string]string // metadata sent with the result. Published methods can set entries.
+
+	canceled <-chan struct{} // closed by PendingCall.Cancel
+}
+
+type callInfoKey struct{}
+
+// NewCallInfoContext returns the context that carries info.
+func NewCallInfoContext(ctx context.Context, info *CallInfo) context.Context {
+	return context.WithValue(ctx, callInfoKey{}, info)
+}
+
+// CallInfoFromContext returns CallInfo passed to the published method.
+func CallInfoFromContext(ctx context.Context) (*CallInfo, bool) {
+	info, ok := ctx.Value(callInfoKey{}).(*CallInfo)
+	return info, ok
+}
+
+type callInfoArg int
+
+const (
+	noCallInfo callInfoArg = iota
+	callInfoValue
+	callInfoPointer
+	callInfoContext
+)
+
+var (
+	callInfoType = reflect.TypeOf(CallInfo{})
+	contextType  = reflect.TypeOf((*context.Context)(nil)).Elem()
+)
+
+// callInfoArgOf returns how the method receives CallInfo.
+func callInfoArgOf(method reflect.Type) callInfoArg {
+	if method.NumIn() == 0 {
+		return noCallInfo
+	}
+	switch method.In(0) {
+	case callInfoType:
+		return callInfoValue
+	case reflect.PtrTo(callInfoType):
+		return callInfoPointer
+	case contextType:
+		return callInfoContext
+	}
+	return noCallInfo
+}
+
+func (a callInfoArg) value(info *CallInfo) reflect.Value {
+	switch a {
+	case callInfoValue:
+		return reflect.ValueOf(*info)
+	case callInfoPointer:
+		return reflect.ValueOf(info)
+	}
+	return reflect.ValueOf(NewCallInfoContext(context.Background(), info))
+}
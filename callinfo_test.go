@@ -0,0 +1,73 @@
+package tobubus
+
+import (
+	"context"
+	"os"
+	"testing"
+)
+
+type callInfoService struct{}
+
+func (s *callInfoService) Caller(info *CallInfo, suffix string) string {
+	return info.PluginID + suffix
+}
+
+func (s *callInfoService) Method(info CallInfo) string {
+	return info.Path + "#" + info.Method
+}
+
+func (s *callInfoService) Credentials(ctx context.Context) int64 {
+	info, ok := CallInfoFromContext(ctx)
+	if !ok || info.Credentials == nil {
+		return -1
+	}
+	return int64(info.Credentials.PID)
+}
+
+func TestProxyCallWithInfo(t *testing.T) {
+	proxy, err := NewProxy(&callInfoService{})
+	if err != nil {
+		t.Fatalf("err should be nil but: %v", err)
+	}
+	results, err := proxy.CallWithInfo(&CallInfo{PluginID: "plugin", Path: "/service", Method: "Caller"}, "Caller", "!")
+	if err != nil || results[0] != "plugin!" {
+		t.Errorf("Caller should return 'plugin!', but %v (%v)", results, err)
+	}
+	results, err = proxy.Call("Method")
+	if err != nil || results[0] != "#Method" {
+		t.Errorf("Method should return '#Method', but %v (%v)", results, err)
+	}
+}
+
+func TestCallInfoFromPlugin(t *testing.T) {
+	host := NewHost("tobubus.callinfo")
+	host.Publish("/service", &callInfoService{})
+	err := host.Listen()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	defer host.Close()
+	plugin, err := NewPlugin("tobubus.callinfo", "github.com/shibukawa/tobubus/callinfo")
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	err = plugin.Connect()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	defer plugin.Close()
+	result, err := plugin.Call("/service", "Caller", "!")
+	if err != nil || result[0] != "github.com/shibukawa/tobubus/callinfo!" {
+		t.Errorf("Caller should return the plugin ID, but %v (%v)", result, err)
+	}
+	result, err = plugin.Call("/service", "Method")
+	if err != nil || result[0] != "/service#Method" {
+		t.Errorf("Method should return '/service#Method', but %v (%v)", result, err)
+	}
+	result, err = plugin.Call("/service", "Credentials")
+	if cred := host.GetCredentials("github.com/shibukawa/tobubus/callinfo"); cred != nil {
+		if err != nil || result[0] != int64(os.Getpid()) {
+			t.Errorf("Credentials should return the PID of this process, but %v (%v)", result, err)
+		}
+	}
+}
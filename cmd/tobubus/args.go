@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseArgument converts the command line argument into the param of method call.
+//
+// Arguments are typed values like "int:10" or JSON values. Other words are strings.
+func parseArgument(arg string) (interface{}, error) {
+	if i := strings.Index(arg, ":"); i != -1 {
+		value := arg[i+1:]
+		switch arg[:i] {
+		case "string":
+			return value, nil
+		case "int":
+			return strconv.ParseInt(value, 0, 64)
+		case "uint":
+			return strconv.ParseUint(value, 0, 64)
+		case "float":
+			return strconv.ParseFloat(value, 64)
+		case "bool":
+			return strconv.ParseBool(value)
+		case "bytes":
+			return base64.StdEncoding.DecodeString(value)
+		case "json":
+			return parseJSON(value)
+		}
+	}
+	value, err := parseJSON(arg)
+	if err != nil {
+		return arg, nil
+	}
+	return value, nil
+}
+
+// parseJSON parses JSON value. Integers are int64 like the values decoded by codecs of tobubus.
+func parseJSON(text string) (interface{}, error) {
+	decoder := json.NewDecoder(strings.NewReader(text))
+	decoder.UseNumber()
+	var value interface{}
+	err := decoder.Decode(&value)
+	if err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("extra data after JSON value: '%s'", text)
+	}
+	return convertNumbers(value), nil
+}
+
+func convertNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case []interface{}:
+		for i, item := range v {
+			v[i] = convertNumbers(item)
+		}
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = convertNumbers(item)
+		}
+	}
+	return value
+}
+
+// normalize converts the result of method call to the value encoding/json can marshal.
+// Codecs decode maps as map[interface{}]interface{} and its keys are formatted as strings.
+func normalize(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			result[fmt.Sprint(key)] = normalize(item)
+		}
+		return result
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			result[key] = normalize(item)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			result[i] = normalize(item)
+		}
+		return result
+	case error:
+		return v.Error()
+	}
+	return value
+}
+
+// formatValue returns the indented JSON of the value.
+func formatValue(value interface{}) string {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(normalize(value))
+	if err != nil {
+		return fmt.Sprintf("%#v", value)
+	}
+	return strings.TrimSuffix(buffer.String(), "\n")
+}
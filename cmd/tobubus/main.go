@@ -0,0 +1,376 @@
+// Command tobubus connects to the host as a short-lived plugin to inspect and call the bus.
+//
+//	tobubus [options] list
+//	tobubus [options] confirm <path>
+//	tobubus [options] call <path> <method> [args...]
+//	tobubus [options] ping
+//	tobubus [options] monitor [-plugin pattern] [-path pattern] [-n count]
+//
+// Arguments of call are typed values (string:text, int:10, uint:10, float:1.5, bool:true,
+// bytes:<base64>, json:<JSON>) or JSON values (10, "text", [1, 2]). Other words are sent as strings.
+//
+// monitor works only if the host enables it by Host.SetRemoteMonitor or Policy.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/shibukawa/tobubus"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+)
+
+const usage = `Usage: tobubus [options] <command> [arguments]
+
+Commands:
+  list                          list paths of objects published by host
+  confirm <path>                check that the object exists
+  call <path> <method> [args]   call the method and print the results
+  ping                          measure round trip time to host
+  monitor [options]             print frames host exchanges with plugins until interrupted
+
+Arguments of call are typed values (string:text, int:10, uint:10, float:1.5,
+bool:true, bytes:<base64>, json:<JSON>) or JSON values (10, "text", [1, 2]).
+Other words are sent as strings.
+
+Options:
+`
+
+type command struct {
+	stdout    io.Writer
+	stderr    io.Writer
+	jsonMode  bool
+	address   string
+	transport tobubus.Transport
+	id        string
+	token     string
+	timeout   time.Duration
+	count     int
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run executes the command and returns the exit code.
+func run(args []string, stdout, stderr io.Writer) int {
+	c := &command{stdout: stdout, stderr: stderr}
+	flags := flag.NewFlagSet("tobubus", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprint(stderr, usage)
+		flags.PrintDefaults()
+	}
+	flags.StringVar(&c.address, "address", "tobubus", "pipe name of local transport, host:port of tcp or URL of ws")
+	transportName := flags.String("transport", "local", "transport to connect: local, tcp or ws")
+	flags.StringVar(&c.id, "id", fmt.Sprintf("tobubus-cli/%d", os.Getpid()), "plugin ID")
+	flags.StringVar(&c.token, "token", "", "token sent to host (for ws)")
+	flags.BoolVar(&c.jsonMode, "json", false, "print results as JSON for scripts")
+	flags.DurationVar(&c.timeout, "timeout", 5*time.Second, "timeout of each request")
+	flags.IntVar(&c.count, "count", 3, "number of pings")
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+	switch *transportName {
+	case "local":
+		c.transport = tobubus.LocalTransport
+	case "tcp":
+		c.transport = tobubus.TCPTransport
+	case "ws":
+		c.transport = tobubus.NewWebSocketTransport()
+	default:
+		fmt.Fprintf(stderr, "unknown transport: '%s'\n", *transportName)
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+	args = flags.Args()
+	switch args[0] {
+	case "list":
+		if len(args) != 1 {
+			break
+		}
+		return c.list()
+	case "confirm":
+		if len(args) != 2 {
+			break
+		}
+		return c.confirm(args[1])
+	case "call":
+		if len(args) < 3 {
+			break
+		}
+		return c.call(args[1], args[2], args[3:])
+	case "ping":
+		if len(args) != 1 {
+			break
+		}
+		return c.ping()
+	case "monitor":
+		return c.monitor(args[1:])
+	default:
+		fmt.Fprintf(stderr, "unknown command: '%s'\n", args[0])
+		return 2
+	}
+	flags.Usage()
+	return 2
+}
+
+// connect connects to the host. Info logs of plugin are suppressed to keep the output clean.
+func (c *command) connect() (*tobubus.Plugin, error) {
+	var plugin *tobubus.Plugin
+	err := c.withTimeout(func() error {
+		var err error
+		plugin, err = tobubus.NewPluginWithTransport(c.address, c.id, c.transport)
+		if err != nil {
+			return err
+		}
+		plugin.SetLogger(slog.New(slog.NewTextHandler(c.stderr, &slog.HandlerOptions{Level: slog.LevelWarn})))
+		plugin.SetToken(c.token)
+		return plugin.Connect()
+	})
+	return plugin, err
+}
+
+// withTimeout runs f. It returns error if f doesn't finish in timeout (e.g. host is hung up).
+func (c *command) withTimeout(f func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- f()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(c.timeout):
+		return fmt.Errorf("timeout after %v", c.timeout)
+	}
+}
+
+func (c *command) list() int {
+	plugin, err := c.connect()
+	if err != nil {
+		return c.fail(err)
+	}
+	defer plugin.Close()
+	var paths []string
+	err = c.withTimeout(func() (err error) {
+		paths, err = plugin.ListPaths()
+		return
+	})
+	if err != nil {
+		return c.fail(err)
+	}
+	if c.jsonMode {
+		if paths == nil {
+			paths = []string{}
+		}
+		return c.printJSON(map[string]interface{}{"paths": paths})
+	}
+	for _, path := range paths {
+		fmt.Fprintln(c.stdout, path)
+	}
+	return 0
+}
+
+func (c *command) confirm(path string) int {
+	plugin, err := c.connect()
+	if err != nil {
+		return c.fail(err)
+	}
+	defer plugin.Close()
+	var found bool
+	err = c.withTimeout(func() error {
+		found = plugin.ConfirmPath(path)
+		return nil
+	})
+	if err != nil {
+		return c.fail(err)
+	}
+	if c.jsonMode {
+		c.printJSON(map[string]interface{}{"path": path, "found": found})
+	} else if found {
+		fmt.Fprintf(c.stdout, "%s: found\n", path)
+	} else {
+		fmt.Fprintf(c.stdout, "%s: not found\n", path)
+	}
+	if !found {
+		return 1
+	}
+	return 0
+}
+
+func (c *command) call(path, methodName string, args []string) int {
+	params := make([]interface{}, len(args))
+	for i, arg := range args {
+		param, err := parseArgument(arg)
+		if err != nil {
+			fmt.Fprintf(c.stderr, "invalid argument '%s': %v\n", arg, err)
+			return 2
+		}
+		params[i] = param
+	}
+	plugin, err := c.connect()
+	if err != nil {
+		return c.fail(err)
+	}
+	defer plugin.Close()
+	var results []interface{}
+	err = c.withTimeout(func() (err error) {
+		results, err = plugin.Call(path, methodName, params...)
+		return
+	})
+	if err != nil {
+		return c.fail(err)
+	}
+	if c.jsonMode {
+		return c.printJSON(map[string]interface{}{"results": normalize(results)})
+	}
+	for _, result := range results {
+		fmt.Fprintln(c.stdout, formatValue(result))
+	}
+	return 0
+}
+
+func (c *command) ping() int {
+	if c.count < 1 {
+		return c.fail(errors.New("count should be positive"))
+	}
+	plugin, err := c.connect()
+	if err != nil {
+		return c.fail(err)
+	}
+	defer plugin.Close()
+	var times []float64
+	for i := 0; i < c.count; i++ {
+		start := time.Now()
+		err = c.withTimeout(func() error {
+			plugin.ConfirmPath("/")
+			return nil
+		})
+		if err != nil {
+			return c.fail(err)
+		}
+		rtt := time.Since(start)
+		times = append(times, float64(rtt)/float64(time.Millisecond))
+		if !c.jsonMode {
+			fmt.Fprintf(c.stdout, "reply from %s: seq=%d time=%v\n", c.address, i, rtt)
+		}
+	}
+	if c.jsonMode {
+		return c.printJSON(map[string]interface{}{"address": c.address, "rtt_ms": times})
+	}
+	return 0
+}
+
+type patterns []string
+
+func (p *patterns) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *patterns) Set(value string) error {
+	*p = append(*p, value)
+	return nil
+}
+
+func (c *command) monitor(args []string) int {
+	var filter tobubus.MonitorFilter
+	flags := flag.NewFlagSet("monitor", flag.ContinueOnError)
+	flags.SetOutput(c.stderr)
+	flags.Var((*patterns)(&filter.PluginIDs), "plugin", "pattern of plugin IDs to monitor (repeatable)")
+	flags.Var((*patterns)(&filter.Paths), "path", "pattern of paths to monitor (repeatable)")
+	limit := flags.Int("n", 0, "exit after receiving n frames (0 is unlimited)")
+	err := flags.Parse(args)
+	if err != nil || flags.NArg() != 0 {
+		return 2
+	}
+	plugin, err := c.connect()
+	if err != nil {
+		return c.fail(err)
+	}
+	defer plugin.Close()
+	done := make(chan struct{})
+	count := 0
+	err = c.withTimeout(func() error {
+		return plugin.Monitor(filter, func(event *tobubus.MonitorEvent) {
+			if *limit > 0 && count >= *limit {
+				return
+			}
+			if c.jsonMode {
+				c.printJSON(eventJSON(event))
+			} else {
+				fmt.Fprintln(c.stdout, event)
+			}
+			count++
+			if count == *limit {
+				close(done)
+			}
+		})
+	})
+	if err != nil {
+		return c.fail(err)
+	}
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	select {
+	case <-done:
+	case <-interrupt:
+	}
+	return 0
+}
+
+// eventJSON converts the event to the value for JSON output. Empty fields are omitted.
+func eventJSON(event *tobubus.MonitorEvent) map[string]interface{} {
+	result := map[string]interface{}{
+		"time":      event.Time.Format(time.RFC3339Nano),
+		"direction": event.Direction,
+		"type":      event.Type.String(),
+		"session":   event.SessionID,
+	}
+	for key, value := range map[string]string{"plugin": event.PluginID, "path": event.Path, "method": event.Method, "error": event.Error} {
+		if value != "" {
+			result[key] = value
+		}
+	}
+	if event.Params != nil {
+		result["params"] = normalize(event.Params)
+	}
+	if event.Results != nil {
+		result["results"] = normalize(event.Results)
+	}
+	if len(event.Metadata) > 0 {
+		result["metadata"] = event.Metadata
+	}
+	return result
+}
+
+// fail prints the error and returns the exit code. The error is printed as JSON in JSON mode.
+func (c *command) fail(err error) int {
+	if c.jsonMode {
+		c.printJSON(map[string]interface{}{"error": err.Error()})
+	} else {
+		fmt.Fprintf(c.stderr, "tobubus: %v\n", err)
+	}
+	return 1
+}
+
+func (c *command) printJSON(value interface{}) int {
+	encoder := json.NewEncoder(c.stdout)
+	encoder.SetEscapeHTML(false)
+	err := encoder.Encode(value)
+	if err != nil {
+		fmt.Fprintf(c.stderr, "tobubus: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/shibukawa/tobubus"
+	"strings"
+	"testing"
+	"time"
+)
+
+type calculator struct{}
+
+func (c *calculator) Add(a, b int64) int64 {
+	return a + b
+}
+
+func (c *calculator) Describe(name string, tags []interface{}) map[string]interface{} {
+	return map[string]interface{}{"name": name, "tags": tags}
+}
+
+func startHost(t *testing.T) *tobubus.Host {
+	host := tobubus.NewHostWithTransport("127.0.0.1:0", tobubus.TCPTransport)
+	host.Publish("/calculator", &calculator{})
+	host.Publish("/editor", &calculator{})
+	host.SetRemoteMonitor(true)
+	err := host.Listen()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	return host
+}
+
+func runForTest(host *tobubus.Host, args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	args = append([]string{"-transport", "tcp", "-address", host.Addr().String()}, args...)
+	code := run(args, &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestParseArgument(t *testing.T) {
+	for _, c := range []struct {
+		arg      string
+		expected interface{}
+	}{
+		{"10", int64(10)},
+		{"1.5", 1.5},
+		{"true", true},
+		{`"10"`, "10"},
+		{"text", "text"},
+		{"string:10", "10"},
+		{"int:0x10", int64(16)},
+		{"uint:10", uint64(10)},
+		{"float:2", 2.0},
+		{"bool:false", false},
+		{"http://example.com", "http://example.com"},
+	} {
+		value, err := parseArgument(c.arg)
+		if err != nil || value != c.expected {
+			t.Errorf("'%s' should be %#v, but %#v (%v)", c.arg, c.expected, value, err)
+		}
+	}
+	value, err := parseArgument("bytes:aGVsbG8=")
+	if err != nil || string(value.([]byte)) != "hello" {
+		t.Errorf("bytes should be decoded, but %v (%v)", value, err)
+	}
+	value, err = parseArgument(`[1, "a", {"b": 2.5}]`)
+	if err != nil || formatValue(value) != "[\n  1,\n  \"a\",\n  {\n    \"b\": 2.5\n  }\n]" {
+		t.Errorf("JSON should be parsed, but %s (%v)", formatValue(value), err)
+	}
+	if _, err := parseArgument("int:ten"); err == nil {
+		t.Error("err should not be nil")
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	value := normalize(map[interface{}]interface{}{"a": []interface{}{map[interface{}]interface{}{int64(1): "b"}}})
+	data, err := json.Marshal(value)
+	if err != nil || string(data) != `{"a":[{"1":"b"}]}` {
+		t.Errorf("value should be marshaled, but %s (%v)", data, err)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	host := startHost(t)
+	defer host.Close()
+
+	code, stdout, stderr := runForTest(host, "list")
+	if code != 0 || stdout != "/calculator\n/editor\n" {
+		t.Errorf("list should print paths, but %d %s %s", code, stdout, stderr)
+	}
+	code, stdout, _ = runForTest(host, "-json", "list")
+	if code != 0 || stdout != `{"paths":["/calculator","/editor"]}`+"\n" {
+		t.Errorf("list should print JSON, but %d %s", code, stdout)
+	}
+	code, stdout, _ = runForTest(host, "confirm", "/calculator")
+	if code != 0 || stdout != "/calculator: found\n" {
+		t.Errorf("confirm should find the object, but %d %s", code, stdout)
+	}
+	code, stdout, _ = runForTest(host, "-json", "confirm", "/unknown")
+	if code != 1 || stdout != `{"found":false,"path":"/unknown"}`+"\n" {
+		t.Errorf("confirm should not find the object, but %d %s", code, stdout)
+	}
+	code, stdout, stderr = runForTest(host, "call", "/calculator", "Add", "1", "int:2")
+	if code != 0 || stdout != "3\n" {
+		t.Errorf("call should print the result, but %d %s %s", code, stdout, stderr)
+	}
+	code, stdout, _ = runForTest(host, "-json", "call", "/calculator", "Describe", "tobubus", `["bus", 1]`)
+	if code != 0 || stdout != `{"results":[{"name":"tobubus","tags":["bus",1]}]}`+"\n" {
+		t.Errorf("call should print JSON, but %d %s", code, stdout)
+	}
+	code, stdout, _ = runForTest(host, "-json", "call", "/calculator", "Unknown")
+	if code != 1 || !strings.Contains(stdout, `"error":`) {
+		t.Errorf("call should print the error, but %d %s", code, stdout)
+	}
+	code, stdout, _ = runForTest(host, "-count", "2", "ping")
+	if code != 0 || strings.Count(stdout, "reply from") != 2 {
+		t.Errorf("ping should print 2 replies, but %d %s", code, stdout)
+	}
+	code, _, _ = runForTest(host, "call", "/calculator")
+	if code != 2 {
+		t.Errorf("wrong arguments should be usage error, but %d", code)
+	}
+}
+
+func TestMonitor(t *testing.T) {
+	host := startHost(t)
+	defer host.Close()
+	done := make(chan string)
+	go func() {
+		_, stdout, _ := runForTest(host, "-id", "github.com/shibukawa/tobubus/monitor", "-json", "monitor", "-path", "/calculator", "-n", "2")
+		done <- stdout
+	}()
+	var stdout string
+	deadline := time.Now().Add(5 * time.Second)
+	for stdout == "" {
+		if time.Now().After(deadline) {
+			t.Fatal("monitor should receive frames")
+		}
+		runForTest(host, "call", "/calculator", "Add", "1", "2")
+		select {
+		case stdout = <-done:
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	lines := strings.Split(strings.TrimSpace(stdout), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("monitor should print 2 frames, but %s", stdout)
+	}
+	var call, reply map[string]interface{}
+	json.Unmarshal([]byte(lines[0]), &call)
+	json.Unmarshal([]byte(lines[1]), &reply)
+	if call["type"] != "CallMethod" || call["method"] != "Add" || call["direction"] != "received" {
+		t.Errorf("first frame should be the call, but %s", lines[0])
+	}
+	if reply["type"] != "ReturnMethod" || reply["path"] != "/calculator" || reply["results"].([]interface{})[0] != 3.0 {
+		t.Errorf("second frame should be the reply, but %s", lines[1])
+	}
+}
@@ -0,0 +1,103 @@
+package tobubus
+
+import (
+	"fmt"
+	"github.com/ugorji/go/codec"
+	"sync"
+)
+
+// Codec serializes the body of method call messages (path, method name and params).
+//
+// Plugin selects codec by its name during ConnectClient handshake, and the host uses the same
+// codec for all messages to and from the plugin. Codec should be safe for concurrent use.
+type Codec interface {
+	// Name returns the identifier of the codec that is sent in handshake.
+	Name() string
+	Encode(v interface{}) ([]byte, error)
+	Decode(data []byte, v interface{}) error
+}
+
+type handleCodec struct {
+	name   string
+	handle codec.Handle
+}
+
+func (c *handleCodec) Name() string {
+	return c.name
+}
+
+func (c *handleCodec) Encode(v interface{}) ([]byte, error) {
+	var data []byte
+	enc := codec.NewEncoderBytes(&data, c.handle)
+	err := enc.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (c *handleCodec) Decode(data []byte, v interface{}) error {
+	dec := codec.NewDecoderBytes(data, c.handle)
+	return dec.Decode(v)
+}
+
+func newCborCodec() Codec {
+	var ch codec.CborHandle
+	ch.SignedInteger = true
+	return &handleCodec{name: "cbor", handle: &ch}
+}
+
+func newMsgpackCodec() Codec {
+	var mh codec.MsgpackHandle
+	mh.SignedInteger = true
+	mh.RawToString = true
+	mh.WriteExt = true
+	return &handleCodec{name: "msgpack", handle: &mh}
+}
+
+func newJSONCodec() Codec {
+	var jh codec.JsonHandle
+	jh.SignedInteger = true
+	return &handleCodec{name: "json", handle: &jh}
+}
+
+var (
+	// CborCodec is the default codec. It is used when plugin doesn't specify codec.
+	CborCodec = newCborCodec()
+	// MsgpackCodec uses MessagePack.
+	MsgpackCodec = newMsgpackCodec()
+	// JSONCodec uses JSON. It is handy for scripting languages and debugging tools.
+	JSONCodec = newJSONCodec()
+)
+
+var codecRegistry = struct {
+	lock   sync.RWMutex
+	codecs map[string]Codec
+}{
+	codecs: map[string]Codec{
+		CborCodec.Name():    CborCodec,
+		MsgpackCodec.Name(): MsgpackCodec,
+		JSONCodec.Name():    JSONCodec,
+	},
+}
+
+// RegisterCodec makes codec available for handshake. Plugins can select it by its name.
+func RegisterCodec(c Codec) error {
+	if c == nil {
+		return fmt.Errorf("can't register nil codec")
+	}
+	codecRegistry.lock.Lock()
+	defer codecRegistry.lock.Unlock()
+	if _, ok := codecRegistry.codecs[c.Name()]; ok {
+		return fmt.Errorf("codec '%s' is already registered", c.Name())
+	}
+	codecRegistry.codecs[c.Name()] = c
+	return nil
+}
+
+func lookupCodec(name string) (Codec, bool) {
+	codecRegistry.lock.RLock()
+	defer codecRegistry.lock.RUnlock()
+	c, ok := codecRegistry.codecs[name]
+	return c, ok
+}
@@ -0,0 +1,129 @@
+package tobubus
+
+import (
+	"errors"
+	"github.com/shibukawa/mockconn"
+	"testing"
+	"time"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, c := range []Codec{CborCodec, MsgpackCodec, JSONCodec} {
+		data, err := archiveMethodCallMessage(c, CallMethod, 0, "/image", "open", []interface{}{"test.png", int64(-10)})
+		if err != nil {
+			t.Errorf("%s: err should be nil, but %v", c.Name(), err)
+			continue
+		}
+		method, err := parseMethodCallMessage(c, data[12:])
+		if err != nil {
+			t.Errorf("%s: err should be nil, but %v", c.Name(), err)
+		} else if method.Path != "/image" || method.Method != "open" || len(method.Params) != 2 {
+			t.Errorf("%s: parse error: %v", c.Name(), method)
+		} else if method.Params[0] != "test.png" || method.Params[1] != int64(-10) {
+			t.Errorf("%s: params error: %#v", c.Name(), method.Params)
+		}
+	}
+}
+
+func TestRegisterCodec(t *testing.T) {
+	err := RegisterCodec(JSONCodec)
+	if err == nil {
+		t.Error("err should not be nil for duplicated codec")
+	}
+	c, ok := lookupCodec("msgpack")
+	if !ok || c != MsgpackCodec {
+		t.Errorf("msgpack codec should be found, but %v", c)
+	}
+}
+
+func TestConnectClientBody(t *testing.T) {
+	id, name, token := parseConnectClientBody(archiveConnectClientBody("github.com/shibukawa/tobubus/1", CborCodec, ""))
+	if id != "github.com/shibukawa/tobubus/1" || name != "" || token != "" {
+		t.Errorf("parse error: '%s' '%s' '%s'", id, name, token)
+	}
+	id, name, token = parseConnectClientBody(archiveConnectClientBody("github.com/shibukawa/tobubus/1", JSONCodec, ""))
+	if id != "github.com/shibukawa/tobubus/1" || name != "json" || token != "" {
+		t.Errorf("parse error: '%s' '%s' '%s'", id, name, token)
+	}
+	id, name, token = parseConnectClientBody(archiveConnectClientBody("github.com/shibukawa/tobubus/1", CborCodec, "secret"))
+	if id != "github.com/shibukawa/tobubus/1" || name != "" || token != "secret" {
+		t.Errorf("parse error: '%s' '%s' '%s'", id, name, token)
+	}
+}
+
+func TestPluginConnectWithCodec(t *testing.T) {
+	plugin, socket := newPluginForTest("pipe.test", "github.com/shibukawa/tobubus/1", t)
+	plugin.SetCodec(JSONCodec)
+	sessionID := plugin.sessions.getUniqueSessionID() + 1
+	socket.SetExpectedActions(
+		mockconn.Write(archiveMessage(ConnectClient, sessionID, []byte("github.com/shibukawa/tobubus/1\x00json"))),
+		mockconn.Read(archiveMessage(ResultOK, sessionID, []byte("json"))),
+	)
+	go func() {
+		time.Sleep(time.Millisecond)
+		plugin.receiveMessage()
+	}()
+	err := plugin.connect()
+	if err != nil {
+		t.Errorf("err should be nil, but %v", err)
+	}
+	socket.Verify()
+}
+
+func TestPluginConnectWithCodecToOldHost(t *testing.T) {
+	plugin, socket := newPluginForTest("pipe.test", "github.com/shibukawa/tobubus/1", t)
+	plugin.SetCodec(JSONCodec)
+	sessionID := plugin.sessions.getUniqueSessionID() + 1
+	socket.SetExpectedActions(
+		mockconn.Write(archiveMessage(ConnectClient, sessionID, []byte("github.com/shibukawa/tobubus/1\x00json"))),
+		mockconn.Read(archiveMessage(ResultOK, sessionID, nil)),
+		mockconn.Close(),
+	)
+	go func() {
+		time.Sleep(time.Millisecond)
+		plugin.receiveMessage()
+	}()
+	err := plugin.connect()
+	if err == nil {
+		t.Error("err should not be nil")
+	}
+	socket.Verify()
+}
+
+func TestHostCallWithPluginCodec(t *testing.T) {
+	host := newHostForTest("pipe.test")
+	obj := newChannelStruct("ok")
+	host.Publish("/image/reader", obj)
+	socket := mockconn.New(t)
+	pluginSessionID := uint32(1)
+	receive, _ := archiveMethodCallMessage(JSONCodec, CallMethod, pluginSessionID+1, "/image/reader", "TestMethod", []interface{}{"image.png"})
+	send, _ := archiveMethodCallMessage(JSONCodec, ReturnMethod, pluginSessionID+1, "", "", []interface{}{"ok"})
+	socket.SetExpectedActions(
+		mockconn.Read(archiveMessage(ConnectClient, pluginSessionID, []byte("github.com/shibukawa/tobubus/1\x00json"))),
+		mockconn.Write(archiveMessage(ResultOK, pluginSessionID, []byte("json"))),
+		mockconn.Read(receive),
+		mockconn.Write(send),
+	)
+	host.receiveMessage(socket)
+	host.receiveMessage(socket)
+	if arg := obj.receive(); arg != "image.png" {
+		t.Errorf("obj.TestMethod should be called with 'image.png', but '%s'", arg)
+	}
+	time.Sleep(time.Millisecond)
+	socket.Verify()
+}
+
+func TestHostRejectUnknownCodec(t *testing.T) {
+	host := newHostForTest("pipe.test")
+	socket := mockconn.New(t)
+	pluginSessionID := uint32(1)
+	socket.SetExpectedActions(
+		mockconn.Read(archiveMessage(ConnectClient, pluginSessionID, []byte("github.com/shibukawa/tobubus/1\x00yaml"))),
+		mockconn.Write(archiveProtocolErrorMessage(pluginSessionID, errors.New("unsupported codec: 'yaml'"))),
+	)
+	host.receiveMessage(socket)
+	if host.GetSocket("github.com/shibukawa/tobubus/1") != nil {
+		t.Error("plugin should not be registered")
+	}
+	socket.Verify()
+}
@@ -0,0 +1,99 @@
+package conformance
+
+import (
+	"github.com/shibukawa/tobubus"
+	"strings"
+	"testing"
+)
+
+type fixture struct{}
+
+func (f *fixture) Echo(message string) string {
+	return message
+}
+
+func TestSpec(t *testing.T) {
+	spec, err := LoadSpec()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	if spec.Header.Size != 12 || spec.MaxFrameSize != tobubus.DefaultMaxFrameSize {
+		t.Errorf("header and frame size should match the implementation, but %d %d", spec.Header.Size, spec.MaxFrameSize)
+	}
+	for _, m := range spec.Messages {
+		if name := tobubus.MessageType(m.Code).String(); name != m.Name {
+			t.Errorf("message 0x%x should be %s, but %s", m.Code, name, m.Name)
+		}
+		if _, ok := spec.Body(m.Body); !ok {
+			t.Errorf("body '%s' of %s is not defined", m.Body, m.Name)
+		}
+		for _, reply := range m.Replies {
+			if r, ok := spec.Message(reply); !ok || r.Kind != "reply" {
+				t.Errorf("reply '%s' of %s is not defined", reply, m.Name)
+			}
+		}
+	}
+	for code := tobubus.MessageType(0); code < 0x100; code++ {
+		if !strings.HasPrefix(code.String(), "MessageType(") {
+			if _, ok := spec.messageOf(code); !ok {
+				t.Errorf("%s is not in protocol.json", code)
+			}
+		}
+	}
+}
+
+func TestHost(t *testing.T) {
+	transport := tobubus.NewInProcessTransport()
+	host := tobubus.NewHostWithTransport("conformance", transport)
+	host.Publish(FixturePath, &fixture{})
+	err := host.Listen()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	defer host.Close()
+	report := CheckHost(transport, "conformance")
+	if len(report.Failed()) != 0 || len(report.Results) != len(HostCases()) {
+		t.Errorf("host should pass all cases, but\n%s", report)
+	}
+}
+
+func TestHostDeviation(t *testing.T) {
+	transport := tobubus.NewInProcessTransport()
+	host := tobubus.NewHostWithTransport("conformance.nofixture", transport)
+	err := host.Listen()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	defer host.Close()
+	report := CheckHost(transport, "conformance.nofixture")
+	failed := report.Failed()
+	if len(failed) == 0 || failed[0].Name != "call method" || !strings.Contains(failed[0].Err.Error(), "ReturnMethod #100 is expected, but ResultObjectNotFound #100") {
+		t.Errorf("missing fixture should be reported, but\n%s", report)
+	}
+}
+
+func TestPlugin(t *testing.T) {
+	transport := tobubus.NewInProcessTransport()
+	listener, err := transport.Listen("conformance.plugin")
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	defer listener.Close()
+	done := make(chan *Report, 1)
+	go func() {
+		done <- CheckPlugin(listener)
+	}()
+	plugin, err := tobubus.NewPluginWithTransport("conformance.plugin", "github.com/shibukawa/tobubus/conformance", transport)
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	plugin.Publish(FixturePath, &fixture{})
+	err = plugin.Connect()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	report := <-done
+	if len(report.Failed()) != 0 || len(report.Results) != len(PluginCases()) {
+		t.Errorf("plugin should pass all cases, but\n%s", report)
+	}
+}
@@ -0,0 +1,546 @@
+package conformance
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/shibukawa/tobubus"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// FrameTimeout is the time to wait for each frame from the implementation under test.
+const FrameTimeout = 5 * time.Second
+
+// Fixture objects that implementations under test should publish.
+const (
+	// FixturePath is the path of the object. It has the method Echo that returns its string argument.
+	// Hosts publish it before CheckHost, and plugins publish it before connecting to CheckPlugin.
+	FixturePath = "/conformance"
+	// FixtureMethod is the method of the fixture object.
+	FixtureMethod = "Echo"
+)
+
+// Frame is a frame of the protocol.
+type Frame struct {
+	Type    tobubus.MessageType
+	Session uint32
+	Body    []byte
+	Reply   bool // the harness sends it with the session ID of the last frame it received
+}
+
+func (f *Frame) String() string {
+	return fmt.Sprintf("%s #%d", f.Type, f.Session)
+}
+
+// Expect is the frame that the implementation under test should send.
+type Expect struct {
+	Types      []tobubus.MessageType // one of them
+	Session    uint32
+	AnySession bool                    // for requests of the implementation
+	Check      func(body []byte) error // checks the body if it is not nil
+}
+
+func (e *Expect) String() string {
+	names := make([]string, len(e.Types))
+	for i, t := range e.Types {
+		names[i] = t.String()
+	}
+	if e.AnySession {
+		return strings.Join(names, " or ")
+	}
+	return fmt.Sprintf("%s #%d", strings.Join(names, " or "), e.Session)
+}
+
+func (e *Expect) match(frame *Frame) error {
+	typeMatched := false
+	for _, t := range e.Types {
+		if t == frame.Type {
+			typeMatched = true
+		}
+	}
+	if !typeMatched || (!e.AnySession && frame.Session != e.Session) {
+		return fmt.Errorf("%s is expected, but %s (%q)", e, frame, frame.Body)
+	}
+	if e.Check != nil {
+		if err := e.Check(frame.Body); err != nil {
+			return fmt.Errorf("body of %s: %v", frame, err)
+		}
+	}
+	return nil
+}
+
+// Step sends a frame or waits for a frame.
+type Step struct {
+	Send   *Frame
+	Expect *Expect
+}
+
+// Case is a scripted exchange.
+type Case struct {
+	Name  string
+	Steps []Step
+}
+
+// Result is the result of a case. Err is nil if the implementation passed it.
+type Result struct {
+	Name string
+	Err  error
+}
+
+// Report is the results of cases.
+type Report struct {
+	Results []Result
+}
+
+// Failed returns the results of failed cases.
+func (r *Report) Failed() []Result {
+	var failed []Result
+	for _, result := range r.Results {
+		if result.Err != nil {
+			failed = append(failed, result)
+		}
+	}
+	return failed
+}
+
+func (r *Report) String() string {
+	var b strings.Builder
+	for _, result := range r.Results {
+		if result.Err != nil {
+			fmt.Fprintf(&b, "FAIL %s: %v\n", result.Name, result.Err)
+		} else {
+			fmt.Fprintf(&b, "PASS %s\n", result.Name)
+		}
+	}
+	fmt.Fprintf(&b, "%d/%d passed\n", len(r.Results)-len(r.Failed()), len(r.Results))
+	return b.String()
+}
+
+// CheckHost runs HostCases against the host at address. Each case connects as a new plugin.
+// The host should publish the fixture object at FixturePath and accept plugins connected by the harness.
+func CheckHost(transport tobubus.Transport, address string) *Report {
+	report := &Report{}
+	for _, c := range HostCases() {
+		socket, err := transport.Dial(address)
+		if err == nil {
+			err = RunCase(socket, c)
+			socket.Close()
+		}
+		report.Results = append(report.Results, Result{Name: c.Name, Err: err})
+	}
+	return report
+}
+
+// CheckPlugin accepts the connection of the plugin as host and runs PluginCases on it in order.
+// The plugin should publish only the fixture object at FixturePath before connecting.
+// Cases after the failure of the handshake are not run.
+func CheckPlugin(listener net.Listener) *Report {
+	report := &Report{}
+	socket, err := listener.Accept()
+	if err != nil {
+		report.Results = append(report.Results, Result{Name: "accept", Err: err})
+		return report
+	}
+	defer socket.Close()
+	for i, c := range PluginCases() {
+		err := RunCase(socket, c)
+		report.Results = append(report.Results, Result{Name: c.Name, Err: err})
+		if i == 0 && err != nil {
+			break
+		}
+	}
+	return report
+}
+
+// RunCase runs the steps of c via socket. It returns the first deviation from the case or from protocol.json
+// (e.g. a reply type that is not listed in the replies of the request).
+func RunCase(socket net.Conn, c *Case) error {
+	spec, err := LoadSpec()
+	if err != nil {
+		return err
+	}
+	requests := make(map[uint32]tobubus.MessageType) // session -> request sent by the harness
+	var last *Frame
+	for i, step := range c.Steps {
+		if step.Send != nil {
+			frame := *step.Send
+			if frame.Reply && last != nil {
+				frame.Session = last.Session
+			}
+			if m, ok := spec.messageOf(frame.Type); ok && m.Kind == "request" {
+				requests[frame.Session] = frame.Type
+			}
+			_, err := socket.Write(archiveFrame(&frame))
+			if err != nil {
+				return fmt.Errorf("step %d: can't send %s: %v", i+1, &frame, err)
+			}
+		}
+		if step.Expect != nil {
+			frame, err := readFrame(socket, FrameTimeout)
+			if err != nil {
+				return fmt.Errorf("step %d: %s is expected, but %v", i+1, step.Expect, err)
+			}
+			err = step.Expect.match(frame)
+			if err != nil {
+				return fmt.Errorf("step %d: %v", i+1, err)
+			}
+			if request, ok := requests[frame.Session]; ok {
+				delete(requests, frame.Session)
+				if err := spec.checkReply(request, frame.Type); err != nil {
+					return fmt.Errorf("step %d: %v", i+1, err)
+				}
+			}
+			last = frame
+		}
+	}
+	return nil
+}
+
+func (s *Spec) messageOf(t tobubus.MessageType) (*MessageSpec, bool) {
+	for i := range s.Messages {
+		if s.Messages[i].Code == uint32(t) {
+			return &s.Messages[i], true
+		}
+	}
+	return nil, false
+}
+
+func (s *Spec) checkReply(request, reply tobubus.MessageType) error {
+	m, _ := s.messageOf(request)
+	for _, name := range m.Replies {
+		if name == reply.String() {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not a reply of %s in protocol.json", reply, request)
+}
+
+func archiveFrame(frame *Frame) []byte {
+	data := make([]byte, 12+len(frame.Body))
+	binary.LittleEndian.PutUint32(data, uint32(frame.Type))
+	binary.LittleEndian.PutUint32(data[4:], frame.Session)
+	binary.LittleEndian.PutUint32(data[8:], uint32(len(frame.Body)))
+	copy(data[12:], frame.Body)
+	return data
+}
+
+// readFrame reads a frame. The socket is closed if the frame doesn't arrive in timeout
+// because some transports don't support deadlines.
+func readFrame(socket net.Conn, timeout time.Duration) (*Frame, error) {
+	type result struct {
+		frame *Frame
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		header := make([]byte, 12)
+		_, err := io.ReadFull(socket, header)
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		size := binary.LittleEndian.Uint32(header[8:])
+		if size > tobubus.DefaultMaxFrameSize {
+			done <- result{err: &tobubus.FrameSizeError{Size: size, Limit: tobubus.DefaultMaxFrameSize}}
+			return
+		}
+		frame := &Frame{
+			Type:    tobubus.MessageType(binary.LittleEndian.Uint32(header)),
+			Session: binary.LittleEndian.Uint32(header[4:]),
+			Body:    make([]byte, size),
+		}
+		_, err = io.ReadFull(socket, frame.Body)
+		done <- result{frame: frame, err: err}
+	}()
+	select {
+	case r := <-done:
+		return r.frame, r.err
+	case <-time.After(timeout):
+		socket.Close()
+		return nil, fmt.Errorf("timeout after %v", timeout)
+	}
+}
+
+// methodCall is the body of CallMethod and its replies.
+type methodCall struct {
+	Path     string            `codec:"path,omitempty"`
+	Method   string            `codec:"method,omitempty"`
+	Params   []interface{}     `codec:"params"`
+	Metadata map[string]string `codec:"metadata,omitempty"`
+}
+
+// CallBody returns the body of CallMethod encoded by the default codec.
+func CallBody(path, method string, params ...interface{}) []byte {
+	data, err := tobubus.CborCodec.Encode(methodCall{Path: path, Method: method, Params: params})
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// batchCall is the body of CallBatch.
+type batchCall struct {
+	Calls       []methodCall `codec:"calls"`
+	Ordered     bool         `codec:"ordered,omitempty"`
+	StopOnError bool         `codec:"stopOnError,omitempty"`
+}
+
+// batchReply is the body of ReturnBatch.
+type batchReply struct {
+	Results []struct {
+		Type   uint32        `codec:"type"`
+		Params []interface{} `codec:"params"`
+	} `codec:"results"`
+}
+
+// BatchBody returns the body of CallBatch that calls FixtureMethod with each message in order.
+// Empty message calls the missing method.
+func BatchBody(stopOnError bool, messages ...string) []byte {
+	batch := batchCall{Ordered: true, StopOnError: stopOnError}
+	for _, message := range messages {
+		if message == "" {
+			batch.Calls = append(batch.Calls, methodCall{Path: FixturePath, Method: "Missing"})
+		} else {
+			batch.Calls = append(batch.Calls, methodCall{Path: FixturePath, Method: FixtureMethod, Params: []interface{}{message}})
+		}
+	}
+	data, err := tobubus.CborCodec.Encode(batch)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// BatchResults returns the check of ReturnBatch that has the result types of entries.
+func BatchResults(expected ...tobubus.MessageType) func(body []byte) error {
+	return func(body []byte) error {
+		result := &batchReply{}
+		err := tobubus.CborCodec.Decode(body, result)
+		if err != nil {
+			return err
+		}
+		if len(result.Results) != len(expected) {
+			return fmt.Errorf("%d results are expected, but %d", len(expected), len(result.Results))
+		}
+		for i, r := range result.Results {
+			if tobubus.MessageType(r.Type) != expected[i] {
+				return fmt.Errorf("result %d should be %s, but %s", i, expected[i], tobubus.MessageType(r.Type))
+			}
+		}
+		return nil
+	}
+}
+
+// Results returns the check of ReturnMethod that has the results.
+func Results(expected ...interface{}) func(body []byte) error {
+	return func(body []byte) error {
+		result := &methodCall{}
+		err := tobubus.CborCodec.Decode(body, result)
+		if err != nil {
+			return err
+		}
+		if !reflect.DeepEqual(result.Params, expected) {
+			return fmt.Errorf("results should be %v, but %v", expected, result.Params)
+		}
+		return nil
+	}
+}
+
+// BodyEquals returns the check of the body that is the text.
+func BodyEquals(text string) func(body []byte) error {
+	return func(body []byte) error {
+		if string(body) != text {
+			return fmt.Errorf("%q is expected, but %q", text, body)
+		}
+		return nil
+	}
+}
+
+// NULSeparatedContains returns the check of the NUL-separated body (e.g. ListPaths) that has the entry.
+func NULSeparatedContains(entry string) func(body []byte) error {
+	return func(body []byte) error {
+		for _, e := range strings.Split(string(body), "\x00") {
+			if e == entry {
+				return nil
+			}
+		}
+		return fmt.Errorf("%q should have %q", body, entry)
+	}
+}
+
+func notify(body []byte) Step {
+	return Step{Send: &Frame{Type: tobubus.NotifyMethod, Body: body}}
+}
+
+func reply(t tobubus.MessageType, body []byte) Step {
+	return Step{Send: &Frame{Type: t, Body: body, Reply: true}}
+}
+
+func request(t tobubus.MessageType, session uint32, body []byte, expected ...tobubus.MessageType) Step {
+	return Step{
+		Send:   &Frame{Type: t, Session: session, Body: body},
+		Expect: &Expect{Types: expected, Session: session},
+	}
+}
+
+func expect(check func(body []byte) error, expected ...tobubus.MessageType) Step {
+	return Step{Expect: &Expect{Types: expected, AnySession: true, Check: check}}
+}
+
+func withCheck(step Step, check func(body []byte) error) Step {
+	step.Expect.Check = check
+	return step
+}
+
+// HostCases returns the cases that the host should pass. Each case starts with a new connection.
+func HostCases() []*Case {
+	connect := func(name string) Step {
+		return request(tobubus.ConnectClient, 1, []byte("conformance/"+name), tobubus.ResultOK)
+	}
+	closeClient := request(tobubus.CloseClient, 2, nil, tobubus.ResultOK)
+	broken := []byte{0xff, 0xff, 0xff}
+	return []*Case{
+		{Name: "connect and close", Steps: []Step{
+			connect("connect"),
+			closeClient,
+		}},
+		{Name: "unsupported codec", Steps: []Step{
+			request(tobubus.ConnectClient, 1, []byte("conformance/codec\x00unknown"), tobubus.ResultProtocolError),
+		}},
+		{Name: "close without connect", Steps: []Step{
+			request(tobubus.CloseClient, 1, nil, tobubus.ResultNG),
+		}},
+		{Name: "requests without connect", Steps: []Step{
+			// notifications are dropped
+			notify(CallBody(FixturePath, FixtureMethod, "hello")),
+			request(tobubus.CallMethod, 100, CallBody(FixturePath, FixtureMethod, "hello"), tobubus.ResultAccessDenied),
+			request(tobubus.CallBatch, 101, BatchBody(false, "hello"), tobubus.ResultAccessDenied),
+			request(tobubus.Publish, 102, []byte(FixturePath+"/publish"), tobubus.ResultAccessDenied),
+			request(tobubus.Acquire, 103, []byte(FixturePath), tobubus.ResultAccessDenied),
+			request(tobubus.ConfirmPath, 104, []byte(FixturePath), tobubus.ResultAccessDenied),
+			request(tobubus.ListPaths, 105, nil, tobubus.ResultAccessDenied),
+			request(tobubus.Monitor, 106, nil, tobubus.ResultAccessDenied),
+		}},
+		{Name: "call method", Steps: []Step{
+			connect("call"),
+			withCheck(request(tobubus.CallMethod, 100, CallBody(FixturePath, FixtureMethod, "hello"), tobubus.ReturnMethod), Results("hello")),
+			closeClient,
+		}},
+		{Name: "call missing object", Steps: []Step{
+			connect("object"),
+			request(tobubus.CallMethod, 100, CallBody(FixturePath+"/missing", FixtureMethod, "hello"), tobubus.ResultObjectNotFound),
+			closeClient,
+		}},
+		{Name: "call missing method", Steps: []Step{
+			connect("method"),
+			request(tobubus.CallMethod, 100, CallBody(FixturePath, "Missing"), tobubus.ResultMethodNotFound),
+			closeClient,
+		}},
+		{Name: "broken method call", Steps: []Step{
+			connect("broken"),
+			request(tobubus.CallMethod, 100, broken, tobubus.ResultProtocolError),
+			closeClient,
+		}},
+		{Name: "call batch", Steps: []Step{
+			connect("batch"),
+			withCheck(request(tobubus.CallBatch, 100, BatchBody(false, "hello", "", "world"), tobubus.ReturnBatch),
+				BatchResults(tobubus.ReturnMethod, tobubus.ResultMethodNotFound, tobubus.ReturnMethod)),
+			// skipped entries are 0
+			withCheck(request(tobubus.CallBatch, 101, BatchBody(true, "hello", "", "world"), tobubus.ReturnBatch),
+				BatchResults(tobubus.ReturnMethod, tobubus.ResultMethodNotFound, 0)),
+			request(tobubus.CallBatch, 102, broken, tobubus.ResultProtocolError),
+			closeClient,
+		}},
+		{Name: "notify", Steps: []Step{
+			connect("notify"),
+			// notifications are not answered even if they fail
+			notify(CallBody(FixturePath, FixtureMethod, "hello")),
+			notify(CallBody(FixturePath+"/missing", FixtureMethod, "hello")),
+			notify([]byte{0xff, 0xff, 0xff}),
+			request(tobubus.ConfirmPath, 100, []byte(FixturePath), tobubus.ResultOK),
+			closeClient,
+		}},
+		{Name: "confirm path", Steps: []Step{
+			connect("confirm"),
+			request(tobubus.ConfirmPath, 100, []byte(FixturePath), tobubus.ResultOK),
+			request(tobubus.ConfirmPath, 101, []byte(FixturePath+"/missing"), tobubus.ResultObjectNotFound),
+			closeClient,
+		}},
+		{Name: "list paths", Steps: []Step{
+			connect("list"),
+			withCheck(request(tobubus.ListPaths, 100, nil, tobubus.ResultOK), NULSeparatedContains(FixturePath)),
+			closeClient,
+		}},
+		{Name: "publish", Steps: []Step{
+			connect("publish"),
+			request(tobubus.Publish, 100, []byte(FixturePath+"/publish"), tobubus.ResultOK),
+			closeClient,
+		}},
+		{Name: "acquire missing object", Steps: []Step{
+			connect("acquire"),
+			request(tobubus.Acquire, 100, []byte(FixturePath+"/missing"), tobubus.ResultObjectNotFound),
+			closeClient,
+		}},
+		{Name: "unknown message type", Steps: []Step{
+			connect("unknown"),
+			// unused codes next to the replies are not replies
+			request(0x0, 100, nil, tobubus.ResultProtocolError),
+			request(0x8, 101, nil, tobubus.ResultProtocolError),
+			request(0x7f, 102, nil, tobubus.ResultProtocolError),
+			closeClient,
+		}},
+	}
+}
+
+// PluginCases returns the cases that the plugin should pass. They run in order on one connection.
+func PluginCases() []*Case {
+	return []*Case{
+		{Name: "handshake", Steps: []Step{
+			expect(nil, tobubus.ConnectClient),
+			reply(tobubus.ResultOK, nil),
+			expect(BodyEquals(FixturePath), tobubus.Publish),
+			reply(tobubus.ResultOK, nil),
+		}},
+		{Name: "call method", Steps: []Step{
+			withCheck(request(tobubus.CallMethod, 100, CallBody(FixturePath, FixtureMethod, "hello"), tobubus.ReturnMethod), Results("hello")),
+		}},
+		{Name: "call missing object", Steps: []Step{
+			request(tobubus.CallMethod, 101, CallBody(FixturePath+"/missing", FixtureMethod, "hello"), tobubus.ResultObjectNotFound),
+		}},
+		{Name: "call missing method", Steps: []Step{
+			request(tobubus.CallMethod, 102, CallBody(FixturePath, "Missing"), tobubus.ResultMethodNotFound),
+		}},
+		{Name: "broken method call", Steps: []Step{
+			request(tobubus.CallMethod, 103, []byte{0xff, 0xff, 0xff}, tobubus.ResultProtocolError),
+		}},
+		{Name: "notify", Steps: []Step{
+			notify(CallBody(FixturePath, FixtureMethod, "hello")),
+			notify(CallBody(FixturePath, "Missing")),
+			withCheck(request(tobubus.CallMethod, 110, CallBody(FixturePath, FixtureMethod, "world"), tobubus.ReturnMethod), Results("world")),
+		}},
+		{Name: "acquire missing object", Steps: []Step{
+			request(tobubus.Acquire, 104, []byte(FixturePath+"/missing"), tobubus.ResultObjectNotFound),
+		}},
+		{Name: "requests only for host", Steps: []Step{
+			request(tobubus.ConnectClient, 105, []byte("conformance/host"), tobubus.ResultNG),
+			request(tobubus.ConfirmPath, 106, []byte(FixturePath), tobubus.ResultNG),
+			request(tobubus.ListPaths, 107, nil, tobubus.ResultNG),
+		}},
+		{Name: "unknown message type", Steps: []Step{
+			request(0x0, 111, nil, tobubus.ResultProtocolError),
+			request(0x8, 112, nil, tobubus.ResultProtocolError),
+			request(0x7f, 108, nil, tobubus.ResultProtocolError),
+		}},
+		{Name: "unpublish by host", Steps: []Step{
+			// the path is taken over by another plugin
+			request(tobubus.Unpublish, 113, []byte(FixturePath), tobubus.ResultOK),
+			request(tobubus.CallMethod, 114, CallBody(FixturePath, FixtureMethod, "hello"), tobubus.ResultObjectNotFound),
+		}},
+		{Name: "close by host", Steps: []Step{
+			request(tobubus.CloseClient, 109, nil, tobubus.ResultOK),
+		}},
+	}
+}
@@ -0,0 +1,111 @@
+// Package conformance defines the wire protocol of tobubus and checks implementations against it.
+//
+// protocol.json is the machine-readable description of the protocol (header layout, message types,
+// body schemas and expected replies). CheckHost and CheckPlugin run scripted exchanges over a socket
+// and report deviations, so implementations in other languages can be tested with the Go harness.
+//
+//	report := conformance.CheckHost(tobubus.TCPTransport, "127.0.0.1:8000")
+//	fmt.Print(report)
+package conformance
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+)
+
+//go:embed protocol.json
+var protocolJSON []byte
+
+// Spec is the description of the protocol in protocol.json.
+type Spec struct {
+	Name           string        `json:"name"`
+	Version        int           `json:"version"`
+	ByteOrder      string        `json:"byteOrder"`
+	Header         HeaderSpec    `json:"header"`
+	MaxFrameSize   uint32        `json:"maxFrameSize"`
+	DefaultCodec   string        `json:"defaultCodec"`
+	Codecs         []string      `json:"codecs"`
+	Bodies         []BodySpec    `json:"bodies"`
+	Messages       []MessageSpec `json:"messages"`
+	UnknownMessage string        `json:"unknownMessage"` // reply to unknown message types
+
+	UnconnectedRequest string `json:"unconnectedRequest"` // reply of host to requests before ConnectClient except CloseClient
+}
+
+// HeaderSpec is the layout of the frame header.
+type HeaderSpec struct {
+	Size   int         `json:"size"`
+	Fields []FieldSpec `json:"fields"`
+}
+
+// FieldSpec is a field of the header or bodies. Offset and Size are used only for the header.
+type FieldSpec struct {
+	Name        string `json:"name"`
+	Offset      int    `json:"offset,omitempty"`
+	Size        int    `json:"size,omitempty"`
+	Type        string `json:"type,omitempty"`
+	Optional    bool   `json:"optional,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// BodySpec is the schema of bodies.
+//
+// Encoding is "empty", "utf8", "nul-separated" (fields joined by NUL), "codec" (map encoded by the codec
+// selected in handshake) or "binary" (little endian fields).
+type BodySpec struct {
+	Name        string      `json:"name"`
+	Encoding    string      `json:"encoding"`
+	Optional    bool        `json:"optional,omitempty"`
+	Fields      []FieldSpec `json:"fields,omitempty"`
+	Description string      `json:"description,omitempty"`
+}
+
+// MessageSpec is a message type.
+//
+// Kind is "request" (answered by one of Replies), "reply", "notification" (no reply) or "stream".
+// From is "host", "plugin" or "both".
+type MessageSpec struct {
+	Code        uint32   `json:"code"`
+	Name        string   `json:"name"`
+	Kind        string   `json:"kind"`
+	From        string   `json:"from"`
+	Body        string   `json:"body"`
+	Replies     []string `json:"replies,omitempty"`
+	Description string   `json:"description,omitempty"`
+}
+
+// ProtocolJSON returns the content of protocol.json.
+func ProtocolJSON() []byte {
+	return append([]byte(nil), protocolJSON...)
+}
+
+// LoadSpec parses protocol.json.
+func LoadSpec() (*Spec, error) {
+	spec := &Spec{}
+	err := json.Unmarshal(protocolJSON, spec)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse protocol.json: %v", err)
+	}
+	return spec, nil
+}
+
+// Message returns the message type of name.
+func (s *Spec) Message(name string) (*MessageSpec, bool) {
+	for i := range s.Messages {
+		if s.Messages[i].Name == name {
+			return &s.Messages[i], true
+		}
+	}
+	return nil, false
+}
+
+// Body returns the body schema of name.
+func (s *Spec) Body(name string) (*BodySpec, bool) {
+	for i := range s.Bodies {
+		if s.Bodies[i].Name == name {
+			return &s.Bodies[i], true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,34 @@
+package tobubus
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Credentials is the identity of the process on the other side of the socket.
+// It is read via SO_PEERCRED on Linux.
+type Credentials struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+// Authenticator decides whether the plugin is allowed to connect.
+// cred is nil if the peer credentials are not available (e.g. other platforms than Linux).
+// Returning error rejects ConnectClient.
+type Authenticator func(pluginID string, cred *Credentials) error
+
+var errCredentialsNotSupported = errors.New("peer credentials are not supported")
+
+// SameUserAuthenticator rejects the plugins that are run by other users.
+// It is the default Authenticator of Host.
+func SameUserAuthenticator(pluginID string, cred *Credentials) error {
+	if cred == nil {
+		return nil
+	}
+	if cred.UID != uint32(os.Getuid()) {
+		return fmt.Errorf("plugin '%s' is run by other user (uid: %d)", pluginID, cred.UID)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+//go:build linux
+// +build linux
+
+package tobubus
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestPeerCredentials(t *testing.T) {
+	var received *Credentials
+	host := NewHost("tobubus.credentials")
+	host.SetAuthenticator(func(pluginID string, cred *Credentials) error {
+		received = cred
+		return SameUserAuthenticator(pluginID, cred)
+	})
+	err := host.Listen()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	defer host.Close()
+	plugin, err := NewPlugin("tobubus.credentials", "github.com/shibukawa/tobubus/credentials")
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	err = plugin.Connect()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	defer plugin.Close()
+	if received == nil {
+		t.Fatal("authenticator should receive credentials")
+	}
+	if received.PID != int32(os.Getpid()) || received.UID != uint32(os.Getuid()) || received.GID != uint32(os.Getgid()) {
+		t.Errorf("credentials should be the ones of this process, but %v", received)
+	}
+	if cred := host.GetCredentials("github.com/shibukawa/tobubus/credentials"); cred != received {
+		t.Errorf("GetCredentials should return %v, but %v", received, cred)
+	}
+}
+
+func TestRejectByAuthenticator(t *testing.T) {
+	host := NewHost("tobubus.credentials.reject")
+	host.SetAuthenticator(func(pluginID string, cred *Credentials) error {
+		return errors.New("rejected")
+	})
+	err := host.Listen()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	defer host.Close()
+	plugin, err := NewPlugin("tobubus.credentials.reject", "github.com/shibukawa/tobubus/credentials")
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	err = plugin.Connect()
+	if err == nil {
+		t.Error("err should not be nil")
+	}
+}
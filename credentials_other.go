@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package tobubus
+
+import (
+	"net"
+)
+
+func peerCredentials(conn net.Conn) (*Credentials, error) {
+	return nil, errCredentialsNotSupported
+}
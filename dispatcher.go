@@ -0,0 +1,152 @@
+package tobubus
+
+import (
+	"errors"
+	"sync"
+)
+
+// errDispatcherBusy is sent with ResultNG to the calls that are rejected because the queue of the dispatcher is full.
+var errDispatcherBusy = errors.New("Too many calls are waiting for dispatch.")
+
+// defaultBatchConcurrency is the number of entries of a batch that run at the same time if the dispatcher has no workers.
+const defaultBatchConcurrency = 16
+
+// Executor runs the method calls of the published object (e.g. the main thread queue of GUI toolkit).
+// Execute may run task in another goroutine. The caller waits until task returns.
+type Executor interface {
+	Execute(task func())
+}
+
+// ExecutorFunc is the function that implements Executor.
+type ExecutorFunc func(task func())
+
+func (f ExecutorFunc) Execute(task func()) {
+	f(task)
+}
+
+// PublishOption configures how the published object receives calls from the other side.
+// Local calls (e.g. Host.Call to the object published by the host) don't use it.
+type PublishOption func(proxy *Proxy)
+
+// Concurrent makes the object receive calls at the same time. It is the default.
+func Concurrent() PublishOption {
+	return func(proxy *Proxy) {
+		proxy.executor = nil
+	}
+}
+
+// Serialized makes the object receive calls one by one. It is for objects that aren't thread-safe.
+//
+// A method that makes a nested call to the other side deadlocks if the other side calls back the same object
+// before the method returns, because the callback waits for the method.
+func Serialized() PublishOption {
+	return func(proxy *Proxy) {
+		proxy.executor = &serialExecutor{}
+	}
+}
+
+// WithExecutor makes the object receive calls on executor.
+//
+// Like Serialized, a nested call back into the other side deadlocks if its callback needs executor
+// while all of the goroutines of executor are busy.
+func WithExecutor(executor Executor) PublishOption {
+	return func(proxy *Proxy) {
+		proxy.executor = executor
+	}
+}
+
+func newProxyWithOptions(instance interface{}, options []PublishOption) (*Proxy, error) {
+	proxy, err := NewProxy(instance)
+	if err != nil {
+		return nil, err
+	}
+	for _, option := range options {
+		option(proxy)
+	}
+	return proxy, nil
+}
+
+// serialExecutor runs tasks one by one in the goroutines of callers.
+type serialExecutor struct {
+	lock sync.Mutex
+}
+
+func (e *serialExecutor) Execute(task func()) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	task()
+}
+
+// dispatcher runs the method calls from the other side. By default, each call runs in its own goroutine.
+// If it is configured, workers run calls from the bounded queue.
+type dispatcher struct {
+	lock     sync.Mutex
+	tasks    chan func()
+	pending  *int // running and queued tasks of the current workers
+	capacity int
+	slots    chan struct{} // goroutines that run tasks or entries of batches
+}
+
+// configure starts workers. The workers of the previous configuration finish their queued tasks and exit.
+func (d *dispatcher) configure(workers, queueSize int) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.tasks != nil {
+		close(d.tasks)
+		d.tasks = nil
+	}
+	if workers <= 0 {
+		return
+	}
+	if queueSize < 0 {
+		queueSize = 0
+	}
+	d.capacity = workers + queueSize
+	d.tasks = make(chan func(), d.capacity)
+	d.pending = new(int)
+	d.slots = make(chan struct{}, workers)
+	for i := 0; i < workers; i++ {
+		go d.work(d.tasks, d.pending, d.slots)
+	}
+}
+
+func (d *dispatcher) work(tasks chan func(), pending *int, slots chan struct{}) {
+	for task := range tasks {
+		// entries of batches may use the slot of the idle worker
+		slots <- struct{}{}
+		task()
+		<-slots
+		d.lock.Lock()
+		*pending--
+		d.lock.Unlock()
+	}
+}
+
+// batchSlots returns the slots for entries of a batch. The workers share them with the entries,
+// so the tasks and entries that run at the same time don't exceed the number of workers.
+// Without workers, each batch runs up to defaultBatchConcurrency entries at the same time.
+func (d *dispatcher) batchSlots() chan struct{} {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.tasks == nil {
+		return make(chan struct{}, defaultBatchConcurrency)
+	}
+	return d.slots
+}
+
+// dispatch runs task. It returns false if all workers are busy and the queue is full.
+func (d *dispatcher) dispatch(task func()) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.tasks == nil {
+		go task()
+		return true
+	}
+	if *d.pending >= d.capacity {
+		return false
+	}
+	*d.pending++
+	// the channel has the room for all pending tasks
+	d.tasks <- task
+	return true
+}
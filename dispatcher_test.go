@@ -0,0 +1,145 @@
+package tobubus
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type concurrencyStruct struct {
+	lock    sync.Mutex
+	running int
+	max     int
+	started chan struct{}
+	release chan struct{}
+}
+
+func (c *concurrencyStruct) Work() {
+	c.lock.Lock()
+	c.running++
+	if c.running > c.max {
+		c.max = c.running
+	}
+	c.lock.Unlock()
+	time.Sleep(5 * time.Millisecond)
+	c.lock.Lock()
+	c.running--
+	c.lock.Unlock()
+}
+
+func (c *concurrencyStruct) Block() {
+	c.started <- struct{}{}
+	<-c.release
+}
+
+func connectForDispatcherTest(name string, obj *concurrencyStruct, options []PublishOption, t *testing.T) (*Host, *Plugin) {
+	transport := NewInProcessTransport()
+	host := NewHostWithTransport(name, transport)
+	host.Publish("/host", obj, options...)
+	err := host.Listen()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	plugin, err := NewPluginWithTransport(name, "github.com/shibukawa/tobubus/dispatcher", transport)
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	err = plugin.Connect()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	return host, plugin
+}
+
+func TestSerializedObject(t *testing.T) {
+	obj := &concurrencyStruct{}
+	host, plugin := connectForDispatcherTest("tobubus.serialized", obj, []PublishOption{Serialized()}, t)
+	defer host.Close()
+	defer plugin.Close()
+
+	var calls []*PendingCall
+	for i := 0; i < 10; i++ {
+		calls = append(calls, plugin.CallAsync("/host", "Work"))
+	}
+	err := WaitAll(calls...)
+	if err != nil {
+		t.Errorf("err should be nil, but %v", err)
+	}
+	if obj.max != 1 {
+		t.Errorf("calls should be serialized, but %d calls ran at the same time", obj.max)
+	}
+}
+
+func TestExecutor(t *testing.T) {
+	tasks := make(chan func())
+	executor := ExecutorFunc(func(task func()) {
+		tasks <- task
+	})
+	obj := &concurrencyStruct{}
+	host, plugin := connectForDispatcherTest("tobubus.executor", obj, []PublishOption{WithExecutor(executor)}, t)
+	defer host.Close()
+	defer plugin.Close()
+
+	call := plugin.CallAsync("/host", "Work")
+	// the test goroutine works as the main thread
+	select {
+	case task := <-tasks:
+		task()
+	case <-time.After(5 * time.Second):
+		t.Fatal("call should be passed to the executor")
+	}
+	_, err := call.Result()
+	if err != nil || obj.max != 1 {
+		t.Errorf("method should be called on the executor, but %v %d", err, obj.max)
+	}
+	// local calls don't use the executor
+	_, err = host.Call("/host", "Work")
+	if err != nil {
+		t.Errorf("err should be nil, but %v", err)
+	}
+}
+
+func TestDispatcherLimit(t *testing.T) {
+	obj := &concurrencyStruct{started: make(chan struct{}, 1), release: make(chan struct{})}
+	host, plugin := connectForDispatcherTest("tobubus.dispatcher", obj, nil, t)
+	defer host.Close()
+	defer plugin.Close()
+	host.SetDispatcher(1, 0)
+
+	blocked := plugin.CallAsync("/host", "Block")
+	<-obj.started
+	_, err := plugin.Call("/host", "Work")
+	if err == nil || !strings.Contains(err.Error(), "Too many calls") {
+		t.Errorf("call over the limit should be rejected, but %v", err)
+	}
+	results, err := plugin.CallBatch([]BatchCall{{Path: "/host", Method: "Work"}}, BatchOptions{})
+	if err == nil || results != nil {
+		t.Errorf("batch over the limit should be rejected, but %v", err)
+	}
+	close(obj.release)
+	_, err = blocked.Result()
+	if err != nil {
+		t.Errorf("err should be nil, but %v", err)
+	}
+	if !waitUntil(func() bool {
+		_, err := plugin.Call("/host", "Work")
+		return err == nil
+	}) {
+		t.Error("call should be accepted after the worker is released")
+	}
+
+	// queued calls wait for the worker
+	host.SetDispatcher(1, 10)
+	var calls []*PendingCall
+	for i := 0; i < 5; i++ {
+		calls = append(calls, plugin.CallAsync("/host", "Work"))
+	}
+	err = WaitAll(calls...)
+	if err != nil {
+		t.Errorf("err should be nil, but %v", err)
+	}
+	if obj.max != 1 {
+		t.Errorf("one worker should run calls, but %d calls ran at the same time", obj.max)
+	}
+}
@@ -1,37 +1,222 @@
 package tobubus
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"github.com/k0kubun/pp"
-	"github.com/shibukawa/localsocket"
-	"log"
+	"log/slog"
 	"net"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
 type Host struct {
-	pipeName string
-	server   *localsocket.LocalServer
-	sessions *sessionManager
-	lock     sync.RWMutex
+	pipeName  string
+	transport Transport
+	listener  net.Listener
+	sessions  *sessionManager
+	streams   *streamTable
+	leases    *leaseTable
+	lock      sync.RWMutex
+
+	maxFrameSize  uint32
+	references    referenceCounter
+	authenticator Authenticator
+	policy        *Policy
+	remoteMonitor bool
+	logging       logging
+	metrics       metrics
+	tracer        Tracer
+	monitors      monitorSet
+	recording     recording
+	dispatcher    dispatcher
+
+	clientInterceptors []Interceptor
+	serverInterceptors []Interceptor
 
 	pluginReservedSpaces map[string]net.Conn // path -> socket
 	localObjectMap       map[string]*Proxy   // path -> proxy
 	sockets              map[string]net.Conn // plugin id -> socket
+	codecs               map[net.Conn]Codec  // socket -> codec selected in handshake
+	credentials          map[net.Conn]*Credentials
 }
 
+// NewHost creates Host instance that uses LocalTransport.
+//
+// First argument is pipe name.
+// ${TMP}/<pipename> for unix domain socket.
+// \\.\pipe\<pipename> for Windows named pipe.
 func NewHost(pipeName string) *Host {
+	return NewHostWithTransport(pipeName, LocalTransport)
+}
+
+// NewHostWithTransport creates Host instance that listens on the address via transport.
+func NewHostWithTransport(address string, transport Transport) *Host {
 	host := &Host{
-		pipeName:             pipeName,
+		pipeName:             address,
+		transport:            transport,
 		sessions:             newSessionManager(recycleStrategy),
+		streams:              newStreamTable(),
+		leases:               newLeaseTable(),
 		pluginReservedSpaces: make(map[string]net.Conn),
 		localObjectMap:       make(map[string]*Proxy),
 		sockets:              make(map[string]net.Conn),
+		codecs:               make(map[net.Conn]Codec),
+		credentials:          make(map[net.Conn]*Credentials),
+		maxFrameSize:         DefaultMaxFrameSize,
+		authenticator:        SameUserAuthenticator,
 	}
+	host.monitors.logging = &host.logging
 	return host
 }
 
+// SetAuthenticator sets the callback that accepts or rejects ConnectClient from plugins.
+// The default is SameUserAuthenticator. nil accepts all plugins.
+func (h *Host) SetAuthenticator(authenticator Authenticator) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.authenticator = authenticator
+}
+
+// SetLogger sets the logger of connection, protocol and dispatch events. nil uses slog.Default().
+//
+// Levels are configured by the handler of logger. Successful calls are logged at debug level.
+func (h *Host) SetLogger(logger *slog.Logger) {
+	h.logging.setLogger(logger)
+}
+
+// SetParamRedactor sets the function that replaces params before they are logged.
+func (h *Host) SetParamRedactor(redactor ParamRedactor) {
+	h.logging.setRedactor(redactor)
+}
+
+// SetTracer sets the tracer that starts spans around calls. nil disables tracing (default),
+// but the trace context received from plugins is still passed to the nested calls.
+func (h *Host) SetTracer(tracer Tracer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.tracer = tracer
+}
+
+// SetPolicy sets the access control policy of plugins. nil allows everything (default).
+func (h *Host) SetPolicy(policy *Policy) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.policy = policy
+}
+
+// SetRemoteMonitor allows plugins to monitor frames of the host (see Plugin.Monitor). It is disabled by default.
+// If the host has Policy, PolicyRule.Monitor decides instead. Params and results in the frames are replaced by ParamRedactor.
+func (h *Host) SetRemoteMonitor(enabled bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.remoteMonitor = enabled
+}
+
+// SetDispatcher limits the method calls from plugins that run at the same time. workers goroutines call methods
+// and up to queueSize calls wait for them. Calls over the limit are answered with ResultNG.
+// workers 0 (default) runs each call in its own goroutine. Unordered entries of CallBatch share the workers' limit.
+//
+// A method that makes a nested call to the other side keeps its worker until the reply. If the other side calls back
+// while all workers are busy, the callback waits in the queue and the calls deadlock.
+func (h *Host) SetDispatcher(workers, queueSize int) {
+	h.dispatcher.configure(workers, queueSize)
+}
+
+// UseClientInterceptor adds interceptors around Call.
+func (h *Host) UseClientInterceptor(interceptors ...Interceptor) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.clientInterceptors = append(h.clientInterceptors, interceptors...)
+}
+
+// UseServerInterceptor adds interceptors around the method calls from plugins.
+func (h *Host) UseServerInterceptor(interceptors ...Interceptor) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.serverInterceptors = append(h.serverInterceptors, interceptors...)
+}
+
+// canPublish checks the policy. It should be called with lock.
+func (h *Host) canPublish(socket net.Conn, path string) bool {
+	if h.policy == nil {
+		return true
+	}
+	pluginID := h.pluginIDOf(socket)
+	if h.policy.CanPublish(pluginID, path) {
+		return true
+	}
+	h.logging.get().Warn("access denied", slog.String("plugin", pluginID), slog.String("action", "publish"), slog.String("path", path))
+	return false
+}
+
+func (h *Host) canCall(socket net.Conn, path, methodName string) bool {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	if h.policy == nil {
+		return true
+	}
+	// objects passed by reference are always available for their holders
+	if h.leases.held(path, socket) {
+		return true
+	}
+	pluginID := h.pluginIDOf(socket)
+	if h.policy.CanCall(pluginID, path, methodName) {
+		return true
+	}
+	h.logging.get().Warn("access denied", slog.String("plugin", pluginID), slog.String("action", "call"), slog.String("path", path), slog.String("method", methodName))
+	return false
+}
+
+// canFind checks the policy for ConfirmPath and ListPaths. It should be called with lock.
+func (h *Host) canFind(socket net.Conn, path string) bool {
+	if h.policy == nil || h.leases.held(path, socket) {
+		return true
+	}
+	return h.policy.CanFind(h.pluginIDOf(socket), path)
+}
+
+// Stats returns the snapshot of metrics of calls, connections and traffic.
+func (h *Host) Stats() Stats {
+	h.lock.RLock()
+	connected := len(h.sockets)
+	h.lock.RUnlock()
+	stats := h.metrics.stats(h.sessions)
+	stats.ConnectedPlugins = connected
+	return stats
+}
+
+// GetCredentials returns the peer credentials of the plugin. It returns nil if they are not available.
+func (h *Host) GetCredentials(pluginID string) *Credentials {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.credentials[h.sockets[pluginID]]
+}
+
+// SetMaxFrameSize sets the maximum body size of frames the host receives from and sends to plugins.
+// Larger frames from plugins are skipped and answered with ResultProtocolError.
+func (h *Host) SetMaxFrameSize(size uint32) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.maxFrameSize = size
+}
+
+// getCodec returns the codec selected by the plugin connected via socket. It should be called with lock.
+func (h *Host) getCodec(socket net.Conn) Codec {
+	if c, ok := h.codecs[socket]; ok {
+		return c
+	}
+	return CborCodec
+}
+
+func (h *Host) getMaxFrameSize() uint32 {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.maxFrameSize
+}
+
 func (h *Host) GetSocket(pluginID string) net.Conn {
 	h.lock.RLock()
 	defer h.lock.RUnlock()
@@ -41,6 +226,11 @@ func (h *Host) GetSocket(pluginID string) net.Conn {
 func (h *Host) GetPluginID(pluginSocket net.Conn) string {
 	h.lock.RLock()
 	defer h.lock.RUnlock()
+	return h.pluginIDOf(pluginSocket)
+}
+
+// pluginIDOf returns the ID of plugin connected via pluginSocket. It should be called with lock.
+func (h *Host) pluginIDOf(pluginSocket net.Conn) string {
 	for id, socket := range h.sockets {
 		if socket == pluginSocket {
 			return id
@@ -51,32 +241,84 @@ func (h *Host) GetPluginID(pluginSocket net.Conn) string {
 
 func (h *Host) Listen() error {
 	h.Close()
-	h.server = localsocket.NewLocalServer(h.pipeName)
-	h.server.SetOnConnectionCallback(func(socket net.Conn) {
-		go h.listenAndServeTo(socket)
-	})
-
-	return h.server.Listen()
+	listener, err := h.transport.Listen(h.pipeName)
+	if err != nil {
+		return err
+	}
+	h.lock.Lock()
+	h.listener = listener
+	h.lock.Unlock()
+	go h.serve(listener)
+	return nil
 }
 
 func (h *Host) ListenAndServe() error {
-	return h.server.ListenAndServe()
+	h.Close()
+	listener, err := h.transport.Listen(h.pipeName)
+	if err != nil {
+		return err
+	}
+	h.lock.Lock()
+	h.listener = listener
+	h.lock.Unlock()
+	return h.serve(listener)
+}
+
+// Addr returns the address the host is listening on (e.g. to know the port of TCP transport that listens on ":0").
+func (h *Host) Addr() net.Addr {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	if h.listener == nil {
+		return nil
+	}
+	return h.listener.Addr()
+}
+
+func (h *Host) serve(listener net.Listener) error {
+	for {
+		socket, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go h.listenAndServeTo(socket)
+	}
 }
 
 func (h *Host) listenAndServeTo(socket net.Conn) (err error) {
+	cred, credErr := peerCredentials(socket)
+	socket = h.metrics.conn(socket, func(socket net.Conn, data []byte) {
+		h.recording.sent(socket, data)
+		h.monitors.observeFrame(socket, data)
+	})
+	if credErr == nil {
+		h.lock.Lock()
+		h.credentials[socket] = cred
+		h.lock.Unlock()
+	}
+	h.logging.get().Debug("connection accepted", slog.String("remote", remoteAddr(socket)))
 	for {
 		err = h.receiveMessage(socket)
 		if err != nil {
 			break
 		}
 	}
+	h.logging.get().Debug("connection closed", slog.String("remote", remoteAddr(socket)), slog.Any("error", err))
+	h.streams.closeSocket(socket)
+	h.sessions.closeSocket(socket)
+	h.monitors.closeSocket(socket)
+	h.recording.closeSocket(socket)
+	h.releaseLeases(socket)
+	h.lock.Lock()
+	delete(h.credentials, socket)
+	h.lock.Unlock()
 	return
 }
 
 func (h *Host) Close() error {
 	h.lock.Lock()
 	defer h.lock.Unlock()
-	if h.server == nil {
+	// plugins started by StartPlugin or ServeConn are connected without listener
+	if h.listener == nil && len(h.sockets) == 0 {
 		return errors.New("Server is not running")
 	}
 	for _, socket := range h.sockets {
@@ -84,8 +326,11 @@ func (h *Host) Close() error {
 	}
 	h.pluginReservedSpaces = make(map[string]net.Conn)
 	h.sockets = make(map[string]net.Conn)
-	h.server.Close()
-	h.server = nil
+	h.codecs = make(map[net.Conn]Codec)
+	if h.listener != nil {
+		h.listener.Close()
+		h.listener = nil
+	}
 	return nil
 }
 
@@ -99,11 +344,13 @@ func (h *Host) Unregister(pluginID string) error {
 	if !ok {
 		return fmt.Errorf("plugin id '%s' is not registered", pluginID)
 	}
+	h.releaseLeases(socket)
 	return h.sendCloseClientMessage(socket, pluginID)
 }
 
 func (h *Host) unregister(socket net.Conn, pluginID string) {
 	delete(h.sockets, pluginID)
+	delete(h.codecs, socket)
 	var removedKeys []string
 	for path, existingSocket := range h.pluginReservedSpaces {
 		if socket == existingSocket {
@@ -126,8 +373,10 @@ func (h *Host) sendCloseClientMessage(socket net.Conn, pluginID string) error {
 	return nil
 }
 
-func (h *Host) Publish(path string, service interface{}) error {
-	proxy, err := NewProxy(service)
+// Publish publishes the object at path. options choose how the object receives calls from plugins
+// (Concurrent, Serialized or WithExecutor).
+func (h *Host) Publish(path string, service interface{}, options ...PublishOption) error {
+	proxy, err := newProxyWithOptions(service, options)
 	if err != nil {
 		return err
 	}
@@ -137,44 +386,396 @@ func (h *Host) Publish(path string, service interface{}) error {
 	return nil
 }
 
+// PublishLeased publishes the object in leased mode.
+//
+// Plugins get the handle of the object via Plugin.Acquire (or as a reference) and release it via RemoteObject.Close.
+// The object is unpublished when all handles are released or their plugins are disconnected.
+func (h *Host) PublishLeased(path string, service interface{}, options ...PublishOption) error {
+	err := h.Publish(path, service, options...)
+	if err != nil {
+		return err
+	}
+	h.leases.add(path)
+	return nil
+}
+
 func (h *Host) Unpublish(path string) error {
 	h.lock.Lock()
 	defer h.lock.Unlock()
 	_, ok := h.localObjectMap[path]
 	if ok {
 		delete(h.localObjectMap, path)
+		h.leases.remove(path)
 		return nil
 	}
 	return fmt.Errorf("Unpublish error: no object is registered at '%s'", path)
 }
 
 func (h *Host) Call(path, methodName string, params ...interface{}) ([]interface{}, error) {
+	return h.CallContext(context.Background(), path, methodName, params...)
+}
+
+// CallContext calls the method like Call. The call continues the trace in ctx (see SpanContextFromContext)
+// and sends the metadata in ctx (see ContextWithMetadata).
+//
+// Published methods that take context.Context should pass it to CallContext to trace their nested calls.
+func (h *Host) CallContext(ctx context.Context, path, methodName string, params ...interface{}) ([]interface{}, error) {
+	return h.call(ctx, nil, path, methodName, params)
+}
+
+// CallAsync calls the method in another goroutine and returns immediately.
+//
+//	calls := []*tobubus.PendingCall{
+//	    host.CallAsync("/a", "Method"),
+//	    host.CallAsync("/b", "Method"),
+//	}
+//	err := tobubus.WaitAll(calls...)
+func (h *Host) CallAsync(path, methodName string, params ...interface{}) *PendingCall {
+	return h.CallAsyncContext(context.Background(), path, methodName, params...)
+}
+
+// CallAsyncContext calls the method like CallAsync with the trace and the metadata in ctx.
+func (h *Host) CallAsyncContext(ctx context.Context, path, methodName string, params ...interface{}) *PendingCall {
+	pending := newPendingCall()
+	go func() {
+		result, err := h.call(ctx, pending.canceled, path, methodName, params)
+		pending.finish(result, err)
+	}()
+	return pending
+}
+
+// call is the body of CallContext and CallAsyncContext. Remote calls stop waiting the reply when canceled is closed.
+func (h *Host) call(ctx context.Context, canceled <-chan struct{}, path, methodName string, params []interface{}) ([]interface{}, error) {
+	h.lock.RLock()
+	interceptors := h.clientInterceptors
+	tracer := h.tracer
+	h.lock.RUnlock()
+	info := newCallInfo(ctx, "", path, methodName)
+	info.canceled = canceled
+	span := startSpan(tracer, SpanContextFromContext(ctx), SpanClient, info)
+	result, err := chainInterceptors(interceptors, h.invoke)(info, params)
+	endSpan(span, err)
+	if trailer := trailerFromContext(ctx); trailer != nil {
+		mergeMetadata(trailer, info.Trailer)
+	}
+	return result, err
+}
+
+// invoke calls the method of local object or plugin's object. It is the last of client interceptors.
+func (h *Host) invoke(info *CallInfo, params []interface{}) ([]interface{}, error) {
+	path, methodName := info.Path, info.Method
 	h.lock.RLock()
 	obj, ok := h.localObjectMap[path]
 	if ok {
 		h.lock.RUnlock()
-		return obj.Call(methodName, params...)
+		return obj.CallWithInfo(info, methodName, params...)
 	}
 	socket, ok := h.pluginReservedSpaces[path]
+	maxFrameSize := h.maxFrameSize
+	c := h.getCodec(socket)
 	h.lock.RUnlock()
 	if ok {
-		sessionID := h.sessions.getUniqueSessionID()
-		data, err := archiveMethodCallMessage(CallMethod, sessionID, path, methodName, params)
+		params, err := exportReferences(params, h.publishReference(socket))
+		if err != nil {
+			return nil, err
+		}
+		start := time.Now()
+		message, stream, err := callRemote(socket, h.sessions, h.streams, c, maxFrameSize, path, methodName, callMetadata(info), params, info.canceled)
+		if message != nil {
+			h.metrics.recordCall(CallSent, path, methodName, replyResult(message), start)
+		}
 		if err != nil {
 			return nil, err
 		}
-		_, err = socket.Write(data)
+		if stream != nil {
+			value, err := stream.collect()
+			if err != nil {
+				return nil, err
+			}
+			return []interface{}{value}, nil
+		}
+		result, err := parseMethodCallMessage(c, message.body)
 		if err != nil {
 			return nil, err
 		}
-		message := h.sessions.receiveAndClose(sessionID)
-		result := parseMethodCallMessage(message.body)
+		if info.Trailer != nil {
+			mergeMetadata(info.Trailer, result.Metadata)
+		}
+		importReferences(result.Params, h.resolveReference(socket))
 		return result.Params, nil
 	}
 	return nil, fmt.Errorf("There is no object in path '%s'.", path)
 }
 
+// Notify calls the method without waiting for the result. The plugin doesn't reply, so errors of the method
+// (e.g. missing method) are only logged by the plugin. Notify returns the error of sending the notification.
+//
+// Methods of local objects are called in another goroutine. Streams can't be passed to notifications.
+func (h *Host) Notify(path, methodName string, params ...interface{}) error {
+	return h.NotifyContext(context.Background(), path, methodName, params...)
+}
+
+// NotifyContext sends the notification like Notify with the trace and the metadata in ctx.
+func (h *Host) NotifyContext(ctx context.Context, path, methodName string, params ...interface{}) error {
+	h.lock.RLock()
+	interceptors := h.clientInterceptors
+	tracer := h.tracer
+	h.lock.RUnlock()
+	info := newCallInfo(ctx, "", path, methodName)
+	info.Notification = true
+	span := startSpan(tracer, SpanContextFromContext(ctx), SpanClient, info)
+	_, err := chainInterceptors(interceptors, h.notify)(info, params)
+	endSpan(span, err)
+	return err
+}
+
+// notify sends the notification to local object or plugin's object. It is the last of client interceptors.
+func (h *Host) notify(info *CallInfo, params []interface{}) ([]interface{}, error) {
+	path, methodName := info.Path, info.Method
+	h.lock.RLock()
+	obj, ok := h.localObjectMap[path]
+	if ok {
+		h.lock.RUnlock()
+		notifyLocal(&h.logging, obj, info, params)
+		return nil, nil
+	}
+	socket, ok := h.pluginReservedSpaces[path]
+	maxFrameSize := h.maxFrameSize
+	c := h.getCodec(socket)
+	h.lock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("There is no object in path '%s'.", path)
+	}
+	params, err := exportReferences(params, h.publishReference(socket))
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	err = notifyRemote(socket, c, maxFrameSize, path, methodName, callMetadata(info), params)
+	if err != nil {
+		return nil, err
+	}
+	h.metrics.recordCall(CallSent, path, methodName, ResultOK, start)
+	return nil, nil
+}
+
+// CallBatch calls the methods in one frame and returns their results in the order of calls.
+// All entries should be on the same plugin or local objects.
+//
+// Errors of entries are returned in BatchResult. The error is returned only if the batch itself fails.
+// Client interceptors are called for the entries on local objects like Call. Streams can't be passed or returned.
+func (h *Host) CallBatch(calls []BatchCall, options BatchOptions) ([]BatchResult, error) {
+	return h.CallBatchContext(context.Background(), calls, options)
+}
+
+// CallBatchContext calls the methods like CallBatch with the trace and the metadata in ctx.
+func (h *Host) CallBatchContext(ctx context.Context, calls []BatchCall, options BatchOptions) ([]BatchResult, error) {
+	h.lock.RLock()
+	var socket net.Conn
+	hasLocal := false
+	for _, call := range calls {
+		if _, ok := h.localObjectMap[call.Path]; ok {
+			hasLocal = true
+		} else if pluginSocket, ok := h.pluginReservedSpaces[call.Path]; ok {
+			if socket != nil && socket != pluginSocket {
+				h.lock.RUnlock()
+				return nil, errors.New("Batch calls should be sent to one plugin.")
+			}
+			socket = pluginSocket
+		}
+	}
+	maxFrameSize := h.maxFrameSize
+	c := h.getCodec(socket)
+	tracer := h.tracer
+	interceptors := h.clientInterceptors
+	h.lock.RUnlock()
+	if socket != nil && hasLocal {
+		return nil, errors.New("Batch calls should be sent to one plugin.")
+	}
+	info := newCallInfo(ctx, "", "", "CallBatch")
+	span := startSpan(tracer, SpanContextFromContext(ctx), SpanClient, info)
+	if socket == nil {
+		results := callBatchLocal(calls, options, info, func(path string) *Proxy {
+			h.lock.RLock()
+			defer h.lock.RUnlock()
+			return h.localObjectMap[path]
+		}, chainInterceptors(interceptors, h.invoke), h.logging.get())
+		endSpan(span, nil)
+		return results, nil
+	}
+	publish := h.publishReference(socket)
+	results, err := callBatchRemote(socket, h.sessions, c, maxFrameSize, calls, options, callMetadata(info), func(params []interface{}) ([]interface{}, error) {
+		return exportReferences(params, publish)
+	}, &h.metrics)
+	endSpan(span, err)
+	return results, err
+}
+
+// callBatchEntry calls an entry of CallBatch sent by the plugin.
+func (h *Host) callBatchEntry(socket net.Conn, sessionID uint32, entry *methodCall) *batchEntryResult {
+	start := time.Now()
+	if !h.canCall(socket, entry.Path, entry.Method) {
+		h.metrics.recordCall(CallReceived, entry.Path, entry.Method, ResultAccessDenied, start)
+		return &batchEntryResult{Type: ResultAccessDenied}
+	}
+	importReferences(entry.Params, h.resolveReference(socket))
+	h.lock.RLock()
+	obj := h.localObjectMap[entry.Path]
+	info := &CallInfo{
+		PluginID:    h.pluginIDOf(socket),
+		Credentials: h.credentials[socket],
+		SessionID:   sessionID,
+		Path:        entry.Path,
+		Method:      entry.Method,
+		Metadata:    entry.Metadata,
+		Trailer:     make(map[string]string),
+	}
+	interceptors := h.serverInterceptors
+	tracer := h.tracer
+	h.lock.RUnlock()
+	span := startSpan(tracer, traceFromMetadata(entry.Metadata), SpanServer, info)
+	logger := h.logging.get().With(slog.String("plugin", info.PluginID), slog.String("path", info.Path), slog.String("method", info.Method), slog.Uint64("session", uint64(sessionID)))
+	result := callBatchEntry(obj, chainInterceptors(interceptors, obj.dispatch), info, entry.Params, logger)
+	if result.Type == ReturnMethod {
+		var err error
+		if result.Params, err = exportReferences(result.Params, h.publishReference(socket)); err != nil {
+			logger.Error("can't pass result by reference", slog.Any("error", err))
+			result = &batchEntryResult{Type: ResultNG}
+		}
+	}
+	h.metrics.recordCall(CallReceived, info.Path, info.Method, result.resultType(), start)
+	endSpan(span, callResultError(result.resultType(), info))
+	return result
+}
+
+// CallStream calls the method that returns a stream (receivable channel or io.Reader).
+//
+// The stream is sent in chunks and the returned Stream receives them. Stream should be closed
+// if it is not read until the end.
+func (h *Host) CallStream(path, methodName string, params ...interface{}) (*Stream, error) {
+	h.lock.RLock()
+	obj, ok := h.localObjectMap[path]
+	if ok {
+		h.lock.RUnlock()
+		return callLocalStream(obj, path, methodName, params)
+	}
+	socket, ok := h.pluginReservedSpaces[path]
+	maxFrameSize := h.maxFrameSize
+	c := h.getCodec(socket)
+	h.lock.RUnlock()
+	if ok {
+		params, err := exportReferences(params, h.publishReference(socket))
+		if err != nil {
+			return nil, err
+		}
+		start := time.Now()
+		message, stream, err := callRemote(socket, h.sessions, h.streams, c, maxFrameSize, path, methodName, nil, params, nil)
+		if message != nil {
+			h.metrics.recordCall(CallSent, path, methodName, replyResult(message), start)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if stream == nil {
+			return nil, fmt.Errorf("Method '%s' at '%s' doesn't return stream.", methodName, path)
+		}
+		return stream, nil
+	}
+	return nil, fmt.Errorf("There is no object in path '%s'.", path)
+}
+
+// Acquire returns the handle of the object. If the object is published by plugin in leased mode,
+// the plugin keeps the object until the handle is closed.
+func (h *Host) Acquire(path string) (*RemoteObject, error) {
+	h.lock.RLock()
+	_, ok := h.localObjectMap[path]
+	socket, remote := h.pluginReservedSpaces[path]
+	h.lock.RUnlock()
+	if ok {
+		return newRemoteObject(path, h, nil), nil
+	}
+	if !remote {
+		return nil, fmt.Errorf("There is no object in path '%s'.", path)
+	}
+	sessionID := h.sessions.getUniqueSessionID()
+	socket.Write(archiveMessage(Acquire, sessionID, []byte(path)))
+	message := h.sessions.receiveAndClose(sessionID)
+	if message.Type != ResultOK {
+		return nil, fmt.Errorf("Can't acquire object at '%s'", path)
+	}
+	return newRemoteObject(path, h, releaseFunc(socket, path)), nil
+}
+
+// publishReference returns the function that publishes the object passed by reference to socket.
+// The object is published at a temporary path in leased mode and socket becomes its holder.
+func (h *Host) publishReference(socket net.Conn) func(obj interface{}) (string, error) {
+	return func(obj interface{}) (string, error) {
+		path := h.references.nextPath("host")
+		err := h.PublishLeased(path, obj)
+		if err != nil {
+			return "", err
+		}
+		h.leases.send(path, socket)
+		return path, nil
+	}
+}
+
+// resolveReference returns the function that converts the reference received from socket into object.
+// The objects published by the host are resolved into themselves only if socket holds them.
+// Unknown paths are registered only if they are under the reference paths of the plugin and the policy allows it.
+// It returns nil for the references that can't be resolved and they are left as placeholders.
+func (h *Host) resolveReference(socket net.Conn) func(path string, leased bool) interface{} {
+	return func(path string, leased bool) interface{} {
+		h.lock.Lock()
+		defer h.lock.Unlock()
+		if obj, ok := h.localObjectMap[path]; ok {
+			if h.leases.held(path, socket) {
+				return obj.instance
+			}
+			h.logging.get().Warn("reference is not held", slog.String("plugin", h.pluginIDOf(socket)), slog.String("path", path))
+			return nil
+		}
+		pluginID := h.pluginIDOf(socket)
+		own := pluginID != "" && strings.HasPrefix(path, referencePathPrefix+pluginID+"/")
+		owner, ok := h.pluginReservedSpaces[path]
+		if ok && own && owner != socket {
+			h.logging.get().Warn("reference conflicts with other plugin", slog.String("plugin", pluginID), slog.String("path", path))
+			return nil
+		}
+		if !ok {
+			if !own {
+				h.logging.get().Warn("reference is out of the plugin's space", slog.String("plugin", pluginID), slog.String("path", path))
+				return nil
+			}
+			if !h.canPublish(socket, path) {
+				return nil
+			}
+			h.pluginReservedSpaces[path] = socket
+			owner = socket
+		}
+		if leased && owner == socket {
+			return newRemoteObject(path, h, releaseFunc(socket, path))
+		}
+		return newRemoteObject(path, h, nil)
+	}
+}
+
+// releaseLeases releases all leased objects held by the plugin.
+func (h *Host) releaseLeases(socket net.Conn) {
+	dropped := h.leases.releaseHolder(socket)
+	if len(dropped) == 0 {
+		return
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for _, path := range dropped {
+		delete(h.localObjectMap, path)
+	}
+}
+
 func (h *Host) ConfirmPath(path string) bool {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
 	_, ok := h.localObjectMap[path]
 	if ok {
 		return true
@@ -183,71 +784,296 @@ func (h *Host) ConfirmPath(path string) bool {
 	return ok
 }
 
+// SetRecorder starts recording frames of all connections to recorder. nil stops recording.
+// Recordings are not redacted (see Recorder).
+func (h *Host) SetRecorder(recorder *Recorder) {
+	h.recording.set(recorder)
+}
+
+// Monitor calls callback with the frames the host receives from and sends to plugins that match filter.
+// It returns the function to stop monitoring.
+//
+// callback is called from the goroutines of connections, sometimes while the host is locked. It should return quickly
+// and shouldn't call methods of the host or modify the event.
+func (h *Host) Monitor(filter MonitorFilter, callback func(event *MonitorEvent)) (stop func()) {
+	return h.monitors.add(&monitor{filter: filter, callback: callback})
+}
+
+// ListPaths returns the sorted paths of objects published by the host and plugins.
+// Objects passed by reference are not included.
+func (h *Host) ListPaths() []string {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	var paths []string
+	for path := range h.localObjectMap {
+		paths = append(paths, path)
+	}
+	for path := range h.pluginReservedSpaces {
+		paths = append(paths, path)
+	}
+	return sortPaths(paths)
+}
+
+// sortPaths sorts paths and removes the paths of objects passed by reference.
+func sortPaths(paths []string) []string {
+	result := make([]string, 0, len(paths))
+	for _, path := range paths {
+		if !strings.HasPrefix(path, referencePathPrefix) {
+			result = append(result, path)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
 func (h *Host) receiveMessage(socket net.Conn) error {
-	msg, err := parseMessage(socket)
+	msg, err := parseMessage(socket, h.getMaxFrameSize())
+	if msg != nil {
+		h.metrics.receivedFrame()
+		h.recording.received(socket, msg)
+		h.monitors.observe(socket, FrameReceived, msg)
+	}
 	if err != nil {
-		return err
+		if _, ok := err.(*FrameSizeError); !ok {
+			return err
+		}
+		h.logging.get().Warn("frame too large", messageAttrs(msg, slog.String("remote", remoteAddr(socket)), slog.Any("error", err))...)
+		if isReply(msg.Type) {
+			// let the waiting caller know that the reply was dropped
+			h.sessions.deliver(&message{Type: ResultProtocolError, ID: msg.ID, body: []byte(err.Error())})
+		} else {
+			h.logging.write(socket, archiveProtocolErrorMessage(msg.ID, err))
+		}
+		return nil
+	}
+	if isReply(msg.Type) {
+		h.sessions.deliver(msg)
+		return nil
+	}
+	if isStreamMessage(msg.Type) {
+		h.streams.dispatch(socket, msg)
+		return nil
+	}
+	// only connected (and verified) plugins can send requests other than ConnectClient.
+	// CloseClient from others is answered with ResultNG below.
+	if msg.Type != ConnectClient && msg.Type != CloseClient && h.GetPluginID(socket) == "" {
+		h.logging.get().Warn("request before connect", messageAttrs(msg, slog.String("remote", remoteAddr(socket)))...)
+		if msg.Type != NotifyMethod && msg.Type != Release {
+			h.logging.write(socket, archiveMessage(ResultAccessDenied, msg.ID, nil))
+		}
+		return nil
 	}
 	switch msg.Type {
-	case ResultOK, ResultNG, ReturnMethod:
-		channel := h.sessions.getChannelOfSessionID(msg.ID)
-		channel <- msg
 	case ConnectClient:
-		pluginID := string(msg.body)
+		pluginID, codecName, token := parseConnectClientBody(msg.body)
+		c := CborCodec
+		if codecName != "" {
+			var ok bool
+			c, ok = lookupCodec(codecName)
+			if !ok {
+				h.logging.get().Warn("unsupported codec", slog.String("plugin", pluginID), slog.String("codec", codecName))
+				h.logging.write(socket, archiveProtocolErrorMessage(msg.ID, fmt.Errorf("unsupported codec: '%s'", codecName)))
+				break
+			}
+		}
+		h.lock.RLock()
+		authenticator := h.authenticator
+		cred := h.credentials[socket]
+		h.lock.RUnlock()
+		if authenticator != nil {
+			err = authenticator(pluginID, cred)
+		}
+		if verifier, ok := h.transport.(PluginIDVerifier); ok && err == nil {
+			err = verifier.VerifyPluginID(unwrapConn(socket), pluginID)
+		}
+		if verifier, ok := unwrapConn(socket).(tokenVerifier); ok && err == nil {
+			err = verifier.verifyToken(pluginID, token)
+		}
+		if err != nil {
+			h.logging.get().Warn("plugin rejected", slog.String("plugin", pluginID), slog.String("remote", remoteAddr(socket)), slog.Any("error", err))
+			h.logging.write(socket, archiveMessage(ResultNG, msg.ID, []byte(err.Error())))
+			socket.Close()
+			break
+		}
 		h.lock.Lock()
 		existingSocket, ok := h.sockets[pluginID]
 		if ok {
 			h.unregister(existingSocket, pluginID)
 			h.sendCloseClientMessage(existingSocket, pluginID)
 		}
-		socket.Write(archiveMessage(ResultOK, msg.ID, nil))
+		if codecName != "" {
+			// acknowledge the codec to let plugin know that host understands it
+			h.logging.write(socket, archiveMessage(ResultOK, msg.ID, []byte(codecName)))
+		} else {
+			h.logging.write(socket, archiveMessage(ResultOK, msg.ID, nil))
+		}
 		h.sockets[pluginID] = socket
+		h.codecs[socket] = c
 		h.lock.Unlock()
+		h.monitors.setPlugin(socket, pluginID, c)
+		h.logging.get().Info("plugin connected", slog.String("plugin", pluginID), slog.String("codec", c.Name()), slog.String("remote", remoteAddr(socket)))
 	case Publish:
 		path := string(msg.body)
 		h.lock.Lock()
+		if !h.canPublish(socket, path) {
+			h.lock.Unlock()
+			h.logging.write(socket, archiveMessage(ResultAccessDenied, msg.ID, nil))
+			break
+		}
 		existingSocket, ok := h.pluginReservedSpaces[path]
 		if ok {
 			sessionID := h.sessions.getUniqueSessionID()
-			existingSocket.Write(archiveMessage(Unpublish, sessionID, msg.body))
+			h.logging.write(existingSocket, archiveMessage(Unpublish, sessionID, msg.body))
 			h.sessions.receiveAndClose(sessionID)
 		}
 		h.pluginReservedSpaces[path] = socket
-		socket.Write(archiveMessage(ResultOK, msg.ID, nil))
+		h.logging.write(socket, archiveMessage(ResultOK, msg.ID, nil))
 
 		h.lock.Unlock()
-	case CallMethod:
-		go func() {
-			method := parseMethodCallMessage(msg.body)
+	case Acquire:
+		path := string(msg.body)
+		h.lock.RLock()
+		_, ok := h.localObjectMap[path]
+		// becoming a holder bypasses the policy, so only the plugins that can already call the object acquire it.
+		// references can be acquired only by the plugins they were sent to because their paths are predictable.
+		allowed := h.canFind(socket, path)
+		if strings.HasPrefix(path, referencePathPrefix) {
+			allowed = h.leases.sentTo(path, socket)
+		}
+		pluginID := h.pluginIDOf(socket)
+		h.lock.RUnlock()
+		if !allowed {
+			h.logging.get().Warn("access denied", slog.String("plugin", pluginID), slog.String("action", "acquire"), slog.String("path", path))
+			h.logging.write(socket, archiveMessage(ResultAccessDenied, msg.ID, nil))
+		} else if ok {
+			h.leases.acquire(path, socket)
+			h.logging.write(socket, archiveMessage(ResultOK, msg.ID, nil))
+		} else {
+			h.logging.write(socket, archiveMessage(ResultObjectNotFound, msg.ID, nil))
+		}
+	case Release:
+		path := string(msg.body)
+		if h.leases.release(path, socket) {
+			h.lock.Lock()
+			delete(h.localObjectMap, path)
+			h.lock.Unlock()
+		}
+	case CallMethod, NotifyMethod:
+		h.lock.RLock()
+		c := h.getCodec(socket)
+		maxFrameSize := h.maxFrameSize
+		h.lock.RUnlock()
+		method, err := parseMethodCallMessage(c, msg.body)
+		if err != nil {
+			h.logging.get().Warn("broken method call", messageAttrs(msg, slog.String("plugin", h.GetPluginID(socket)), slog.Any("error", err))...)
+			if msg.Type == CallMethod {
+				h.logging.write(socket, archiveProtocolErrorMessage(msg.ID, err))
+			}
+			break
+		}
+		replier := newReplier(socket, &h.logging, msg.Type, method, slog.String("plugin", h.GetPluginID(socket)))
+		if !h.canCall(socket, method.Path, method.Method) {
+			h.metrics.recordCall(CallReceived, method.Path, method.Method, ResultAccessDenied, time.Now())
+			closeStreams(h.streams.receiveArguments(socket, msg.ID, c, method.Params))
+			replier.write(archiveMessage(ResultAccessDenied, msg.ID, nil))
+			break
+		}
+		importReferences(method.Params, h.resolveReference(socket))
+		// argument streams should be ready before reading their chunks
+		argStreams := h.streams.receiveArguments(socket, msg.ID, c, method.Params)
+		dispatched := h.dispatcher.dispatch(func() {
+			h.lock.RLock()
 			obj, ok := h.localObjectMap[method.Path]
+			info := &CallInfo{
+				PluginID:     h.pluginIDOf(socket),
+				Credentials:  h.credentials[socket],
+				SessionID:    msg.ID,
+				Path:         method.Path,
+				Method:       method.Method,
+				Metadata:     method.Metadata,
+				Notification: msg.Type == NotifyMethod,
+				Trailer:      make(map[string]string),
+			}
+			interceptors := h.serverInterceptors
+			tracer := h.tracer
+			h.lock.RUnlock()
+			start := time.Now()
+			resultType := MessageType(ResultOK)
+			span := startSpan(tracer, traceFromMetadata(method.Metadata), SpanServer, info)
+			defer func() {
+				h.metrics.recordCall(CallReceived, info.Path, info.Method, resultType, start)
+				endSpan(span, callResultError(resultType, info))
+			}()
+			logger := h.logging.get().With(slog.String("plugin", info.PluginID), slog.String("path", info.Path), slog.String("method", info.Method), slog.Uint64("session", uint64(msg.ID)))
+			logger.Debug("method called")
 			if !ok {
-				socket.Write(archiveMessage(ResultObjectNotFound, msg.ID, nil))
+				logger.Debug("object not found")
+				resultType = ResultObjectNotFound
+				closeStreams(argStreams)
+				replier.write(archiveMessage(ResultObjectNotFound, msg.ID, nil))
 				return
 			}
 			defer func() {
 				err := recover()
 				if err != nil {
-					log.Printf("Remote Method Call Error: msgID: %d path: '%s' method: '%s'\n", msg.ID, method.Path, method.Method)
-					log.Printf("Params: %s\n", pp.Sprint(method.Params))
-					log.Printf("Error Detail: %v\n", err)
-					socket.Write(archiveMessage(ResultMethodError, msg.ID, nil))
+					logger.Error("method panicked", h.logging.params(info, method.Params), slog.Any("error", err))
+					resultType = ResultMethodError
+					closeStreams(argStreams)
+					replier.write(archiveMessage(ResultMethodError, msg.ID, nil))
 				}
 			}()
-			result, err := obj.Call(method.Method, method.Params...)
+			if !obj.hasMethod(method.Method) {
+				logger.Debug("method not found")
+				resultType = ResultMethodNotFound
+				closeStreams(argStreams)
+				replier.write(archiveMessage(ResultMethodNotFound, msg.ID, nil))
+				return
+			}
+			result, err := chainInterceptors(interceptors, obj.dispatch)(info, method.Params)
 			if err != nil {
-				socket.Write(archiveMessage(ResultMethodNotFound, msg.ID, nil))
+				logger.Debug("method call rejected", slog.Any("error", err))
+				resultType = ResultNG
+				closeStreams(argStreams)
+				replier.write(archiveMessage(ResultNG, msg.ID, []byte(err.Error())))
+			} else if result, err = exportReferences(result, h.publishReference(socket)); err != nil {
+				logger.Error("can't pass result by reference", slog.Any("error", err))
+				resultType = ResultNG
+				replier.write(archiveMessage(ResultNG, msg.ID, nil))
 			} else {
-				resultMessage, err := archiveMethodCallMessage(ReturnMethod, msg.ID, "", "", result)
-				if err != nil {
-					socket.Write(archiveMessage(ResultNG, msg.ID, nil))
-				}
-				socket.Write(resultMessage)
+				replier.sendResult(h.streams, c, maxFrameSize, msg.ID, info.Trailer, result)
 			}
-		}()
+		})
+		if !dispatched {
+			h.logging.get().Warn("dispatcher is busy", messageAttrs(msg, slog.String("plugin", h.GetPluginID(socket)), slog.String("path", method.Path), slog.String("method", method.Method))...)
+			h.metrics.recordCall(CallReceived, unknownLabel, unknownLabel, ResultNG, time.Now())
+			closeStreams(argStreams)
+			replier.write(archiveMessage(ResultNG, msg.ID, []byte(errDispatcherBusy.Error())))
+		}
+	case CallBatch:
+		h.lock.RLock()
+		c := h.getCodec(socket)
+		maxFrameSize := h.maxFrameSize
+		h.lock.RUnlock()
+		batch, err := parseBatchCallMessage(c, msg.body)
+		if err != nil {
+			h.logging.get().Warn("broken batch call", messageAttrs(msg, slog.String("plugin", h.GetPluginID(socket)), slog.Any("error", err))...)
+			h.logging.write(socket, archiveProtocolErrorMessage(msg.ID, err))
+			break
+		}
+		dispatched := h.dispatcher.dispatch(func() {
+			results := runBatch(batch, h.dispatcher.batchSlots(), func(entry *methodCall) *batchEntryResult {
+				return h.callBatchEntry(socket, msg.ID, entry)
+			})
+			h.logging.write(socket, archiveBatchReplyMessage(c, msg.ID, maxFrameSize, results))
+		})
+		if !dispatched {
+			h.logging.get().Warn("dispatcher is busy", messageAttrs(msg, slog.String("plugin", h.GetPluginID(socket)))...)
+			h.logging.write(socket, archiveMessage(ResultNG, msg.ID, []byte(errDispatcherBusy.Error())))
+		}
 	case CloseClient:
 		socketID := h.GetPluginID(socket)
 		if socketID == "" {
-			socket.Write(archiveMessage(ResultNG, msg.ID, nil))
+			h.logging.write(socket, archiveMessage(ResultNG, msg.ID, nil))
 		} else {
 			h.lock.Lock()
 			var removeTargetPaths []string
@@ -260,16 +1086,66 @@ func (h *Host) receiveMessage(socket net.Conn) error {
 				delete(h.pluginReservedSpaces, removeTargetPath)
 			}
 			delete(h.sockets, socketID)
+			delete(h.codecs, socket)
 			h.lock.Unlock()
-			socket.Write(archiveMessage(ResultOK, msg.ID, nil))
+			h.releaseLeases(socket)
+			h.logging.write(socket, archiveMessage(ResultOK, msg.ID, nil))
+			h.logging.get().Info("plugin disconnected", slog.String("plugin", socketID))
 		}
 	case ConfirmPath:
-		_, ok := h.localObjectMap[string(msg.body)]
-		if ok {
-			socket.Write(archiveMessage(ResultOK, msg.ID, nil))
+		path := string(msg.body)
+		h.lock.RLock()
+		_, ok := h.localObjectMap[path]
+		found := h.canFind(socket, path)
+		pluginID := h.pluginIDOf(socket)
+		h.lock.RUnlock()
+		if !found {
+			h.logging.get().Warn("access denied", slog.String("plugin", pluginID), slog.String("action", "confirm"), slog.String("path", path))
+			h.logging.write(socket, archiveMessage(ResultAccessDenied, msg.ID, nil))
+		} else if ok {
+			h.logging.write(socket, archiveMessage(ResultOK, msg.ID, nil))
 		} else {
-			socket.Write(archiveMessage(ResultObjectNotFound, msg.ID, nil))
+			h.logging.write(socket, archiveMessage(ResultObjectNotFound, msg.ID, nil))
+		}
+	case Monitor:
+		h.lock.RLock()
+		c := h.getCodec(socket)
+		pluginID := h.pluginIDOf(socket)
+		allowed := h.remoteMonitor
+		if h.policy != nil {
+			allowed = h.policy.CanMonitor(pluginID)
 		}
+		h.lock.RUnlock()
+		var filter MonitorFilter
+		if len(msg.body) > 0 {
+			err := c.Decode(msg.body, &filter)
+			if err != nil {
+				h.logging.write(socket, archiveProtocolErrorMessage(msg.ID, err))
+				break
+			}
+		}
+		if !allowed {
+			h.logging.get().Warn("access denied", slog.String("plugin", pluginID), slog.String("action", "monitor"))
+			h.logging.write(socket, archiveMessage(ResultAccessDenied, msg.ID, nil))
+			break
+		}
+		h.logging.write(socket, archiveMessage(ResultOK, msg.ID, nil))
+		h.monitors.addRemote(socket, msg.ID, c, filter, &h.logging)
+		h.logging.get().Info("monitor started", slog.String("plugin", pluginID))
+	case ListPaths:
+		// plugins can call only the objects of host that the policy allows
+		h.lock.RLock()
+		var paths []string
+		for path := range h.localObjectMap {
+			if h.canFind(socket, path) {
+				paths = append(paths, path)
+			}
+		}
+		h.lock.RUnlock()
+		h.logging.write(socket, archiveMessage(ResultOK, msg.ID, []byte(strings.Join(sortPaths(paths), "\x00"))))
+	default:
+		h.logging.get().Warn("unknown message type", messageAttrs(msg, slog.String("plugin", h.GetPluginID(socket)))...)
+		h.logging.write(socket, archiveProtocolErrorMessage(msg.ID, fmt.Errorf("unknown message type: %d", msg.Type)))
 	}
 	return nil
 }
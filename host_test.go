@@ -1,7 +1,12 @@
 package tobubus
 
 import (
+	"errors"
+	"fmt"
 	"github.com/shibukawa/mockconn"
+	"log/slog"
+	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -202,9 +207,10 @@ func TestHostPublishAndCallFromPluginOK(t *testing.T) {
 		t.Errorf("error should be nil, but %v", err)
 	}
 	socket := mockconn.New(t)
+	host.sockets["github.com/shibukawa/tobubus/1"] = socket
 	pluginSessionID := uint32(45)
-	receive, _ := archiveMethodCallMessage(CallMethod, pluginSessionID, "/image/reader", "TestMethod", []interface{}{"image.png"})
-	send, _ := archiveMethodCallMessage(ReturnMethod, pluginSessionID, "", "", []interface{}{"ok"})
+	receive, _ := archiveMethodCallMessage(CborCodec, CallMethod, pluginSessionID, "/image/reader", "TestMethod", []interface{}{"image.png"})
+	send, _ := archiveMethodCallMessage(CborCodec, ReturnMethod, pluginSessionID, "", "", []interface{}{"ok"})
 	socket.SetExpectedActions(
 		mockconn.Read(receive),
 		mockconn.Write(send),
@@ -230,8 +236,8 @@ func TestHostCallPluginFunctionOK(t *testing.T) {
 	host := newHostForTest("pipe.test")
 	socket := mockconn.New(t)
 	hostSessionID := host.sessions.getUniqueSessionID() + 1
-	send, _ := archiveMethodCallMessage(CallMethod, hostSessionID, "/image/reader", "TestMethod", []interface{}{"test value"})
-	receive, _ := archiveMethodCallMessage(ReturnMethod, hostSessionID, "", "", []interface{}{"ok"})
+	send, _ := archiveMethodCallMessage(CborCodec, CallMethod, hostSessionID, "/image/reader", "TestMethod", []interface{}{"test value"})
+	receive, _ := archiveMethodCallMessage(CborCodec, ReturnMethod, hostSessionID, "", "", []interface{}{"ok"})
 	pluginSessionID := uint32(1)
 	socket.SetExpectedActions(
 		mockconn.Read(archiveMessage(ConnectClient, pluginSessionID, []byte("github.com/shibukawa/tobubus/1"))),
@@ -328,6 +334,7 @@ func TestHostReceiveConfirmPath(t *testing.T) {
 		t.Errorf("error should be nil, but %v", err)
 	}
 	socket := mockconn.New(t)
+	host.sockets["github.com/shibukawa/tobubus/1"] = socket
 	pluginSessionID := uint32(1)
 	socket.SetExpectedActions(
 		mockconn.Read(archiveMessage(ConfirmPath, pluginSessionID+1, []byte("/image/reader"))),
@@ -343,3 +350,319 @@ func TestHostReceiveConfirmPath(t *testing.T) {
 	<-wait
 	socket.Verify()
 }
+
+func TestHostReceiveTooLargeFrame(t *testing.T) {
+	host := newHostForTest("pipe.test")
+	host.SetMaxFrameSize(4)
+	socket := mockconn.New(t)
+	pluginSessionID := uint32(1)
+	socket.SetExpectedActions(
+		mockconn.Read(archiveMessage(ConfirmPath, pluginSessionID, []byte("/image/reader"))),
+		mockconn.Write(archiveProtocolErrorMessage(pluginSessionID, &FrameSizeError{Size: 13, Limit: 4})),
+	)
+	err := host.receiveMessage(socket)
+	if err != nil {
+		t.Errorf("error should be nil, but %v", err)
+	}
+	socket.Verify()
+}
+
+func TestHostReceiveBrokenMethodCall(t *testing.T) {
+	host := newHostForTest("pipe.test")
+	socket := mockconn.New(t)
+	host.sockets["github.com/shibukawa/tobubus/1"] = socket
+	pluginSessionID := uint32(1)
+	_, decodeErr := parseMethodCallMessage(CborCodec, []byte("\xff"))
+	socket.SetExpectedActions(
+		mockconn.Read(archiveMessage(CallMethod, pluginSessionID, []byte("\xff"))),
+		mockconn.Write(archiveProtocolErrorMessage(pluginSessionID, decodeErr)),
+	)
+	host.receiveMessage(socket)
+	time.Sleep(time.Millisecond)
+	socket.Verify()
+}
+
+func TestHostReceiveUnknownMessage(t *testing.T) {
+	host := newHostForTest("pipe.test")
+	socket := mockconn.New(t)
+	host.sockets["github.com/shibukawa/tobubus/1"] = socket
+	pluginSessionID := uint32(1)
+	socket.SetExpectedActions(
+		mockconn.Read(archiveMessage(0x99, pluginSessionID, nil)),
+		mockconn.Write(archiveProtocolErrorMessage(pluginSessionID, errors.New("unknown message type: 153"))),
+	)
+	host.receiveMessage(socket)
+	socket.Verify()
+}
+
+func TestHostRejectRequestsBeforeConnect(t *testing.T) {
+	host := newHostForTest("pipe.test")
+	obj := testStruct{result: "ok"}
+	host.Publish("/image/reader", &obj)
+	call, _ := archiveMethodCallMessage(CborCodec, CallMethod, 1, "/image/reader", "TestMethod", []interface{}{"image.png"})
+	notify, _ := archiveMethodCallMessage(CborCodec, NotifyMethod, 0, "/image/reader", "TestMethod", []interface{}{"image.png"})
+	batch, _ := archiveBatchCallMessage(CborCodec, 1, []BatchCall{{Path: "/image/reader", Method: "TestMethod", Params: []interface{}{"image.png"}}}, BatchOptions{}, nil, func(params []interface{}) ([]interface{}, error) {
+		return params, nil
+	})
+	requests := [][]byte{
+		call,
+		batch,
+		archiveMessage(Publish, 1, []byte("/documents")),
+		archiveMessage(Acquire, 1, []byte("/image/reader")),
+		archiveMessage(ConfirmPath, 1, []byte("/image/reader")),
+		archiveMessage(ListPaths, 1, nil),
+		archiveMessage(Monitor, 1, nil),
+	}
+	for _, request := range requests {
+		socket := mockconn.New(t)
+		socket.SetExpectedActions(
+			mockconn.Read(request),
+			mockconn.Write(archiveMessage(ResultAccessDenied, 1, nil)),
+		)
+		host.receiveMessage(socket)
+		socket.Verify()
+	}
+	// notifications are dropped without reply
+	socket := mockconn.New(t)
+	socket.SetExpectedActions(mockconn.Read(notify))
+	host.receiveMessage(socket)
+	time.Sleep(time.Millisecond)
+	socket.Verify()
+	if len(obj.args) != 0 {
+		t.Errorf("obj.TestMethod should not be called, but %v", obj.args)
+	}
+	if host.ConfirmPath("/documents") {
+		t.Error("'/documents' should not be published")
+	}
+}
+
+func TestHostCallPluginFunctionNotFound(t *testing.T) {
+	// Host -> Plugin
+	host := newHostForTest("pipe.test")
+	socket := mockconn.New(t)
+	hostSessionID := host.sessions.getUniqueSessionID() + 1
+	send, _ := archiveMethodCallMessage(CborCodec, CallMethod, hostSessionID, "/image/reader", "WrongMethod", []interface{}{"test value"})
+	pluginSessionID := uint32(1)
+	socket.SetExpectedActions(
+		mockconn.Read(archiveMessage(ConnectClient, pluginSessionID, []byte("github.com/shibukawa/tobubus/1"))),
+		mockconn.Write(archiveMessage(ResultOK, pluginSessionID, nil)),
+		mockconn.Read(archiveMessage(Publish, pluginSessionID+1, []byte("/image/reader"))),
+		mockconn.Write(archiveMessage(ResultOK, pluginSessionID+1, nil)),
+		mockconn.Write(send),
+		mockconn.Read(archiveMessage(ResultMethodNotFound, hostSessionID, nil)),
+	)
+	wait := make(chan string)
+	go func() {
+		host.receiveMessage(socket)
+		host.receiveMessage(socket)
+		wait <- "before call"
+		time.Sleep(time.Millisecond)
+		host.receiveMessage(socket)
+		wait <- "done"
+	}()
+	<-wait
+	_, err := host.Call("/image/reader", "WrongMethod", "test value")
+	<-wait
+	if err == nil {
+		t.Error("error should not be nil")
+	}
+	socket.Verify()
+}
+
+func TestHostRejectOtherUser(t *testing.T) {
+	host := newHostForTest("pipe.test")
+	socket := mockconn.New(t)
+	host.credentials[socket] = &Credentials{PID: 1, UID: uint32(os.Getuid() + 1), GID: 1}
+	pluginSessionID := uint32(1)
+	socket.SetExpectedActions(
+		mockconn.Read(archiveMessage(ConnectClient, pluginSessionID, []byte("github.com/shibukawa/tobubus/1"))),
+		mockconn.Write(archiveMessage(ResultNG, pluginSessionID, []byte(fmt.Sprintf("plugin 'github.com/shibukawa/tobubus/1' is run by other user (uid: %d)", os.Getuid()+1)))),
+		mockconn.Close(),
+	)
+	host.receiveMessage(socket)
+	if host.GetSocket("github.com/shibukawa/tobubus/1") != nil {
+		t.Error("plugin should not be registered")
+	}
+	socket.Verify()
+}
+
+func TestHostPublishDeniedByPolicy(t *testing.T) {
+	host := newHostForTest("pipe.test")
+	host.SetPolicy(NewPolicy(PolicyRule{Plugin: "*", Publish: []string{"/editor/*"}}))
+	socket := mockconn.New(t)
+	host.sockets["github.com/shibukawa/tobubus/1"] = socket
+	pluginSessionID := uint32(1)
+	socket.SetExpectedActions(
+		mockconn.Read(archiveMessage(Publish, pluginSessionID, []byte("/documents"))),
+		mockconn.Write(archiveMessage(ResultAccessDenied, pluginSessionID, nil)),
+		mockconn.Read(archiveMessage(Publish, pluginSessionID+1, []byte("/editor/main"))),
+		mockconn.Write(archiveMessage(ResultOK, pluginSessionID+1, nil)),
+	)
+	host.receiveMessage(socket)
+	host.receiveMessage(socket)
+	if host.ConfirmPath("/documents") {
+		t.Error("'/documents' should not be published")
+	}
+	if !host.ConfirmPath("/editor/main") {
+		t.Error("'/editor/main' should be published")
+	}
+	socket.Verify()
+}
+
+func TestHostCallDeniedByPolicy(t *testing.T) {
+	host := newHostForTest("pipe.test")
+	host.SetPolicy(NewPolicy(PolicyRule{Plugin: "github.com/shibukawa/tobubus/1", Call: []string{"/image/reader#Read"}}))
+	obj := testStruct{result: "ok"}
+	host.Publish("/image/reader", &obj)
+	socket := mockconn.New(t)
+	host.sockets["github.com/shibukawa/tobubus/1"] = socket
+	pluginSessionID := uint32(45)
+	receive, _ := archiveMethodCallMessage(CborCodec, CallMethod, pluginSessionID, "/image/reader", "TestMethod", []interface{}{"image.png"})
+	socket.SetExpectedActions(
+		mockconn.Read(receive),
+		mockconn.Write(archiveMessage(ResultAccessDenied, pluginSessionID, nil)),
+	)
+	host.receiveMessage(socket)
+	time.Sleep(time.Millisecond)
+	if len(obj.args) != 0 {
+		t.Errorf("obj.TestMethod should not be called, but %v", obj.args)
+	}
+	socket.Verify()
+}
+
+func TestHostFindDeniedByPolicy(t *testing.T) {
+	host := newHostForTest("pipe.test")
+	host.SetPolicy(NewPolicy(PolicyRule{Plugin: "github.com/shibukawa/tobubus/1", Call: []string{"/image/reader#Read"}}))
+	host.Publish("/image/reader", &testStruct{})
+	host.Publish("/image/writer", &testStruct{})
+	socket := mockconn.New(t)
+	host.sockets["github.com/shibukawa/tobubus/1"] = socket
+	pluginSessionID := uint32(1)
+	socket.SetExpectedActions(
+		mockconn.Read(archiveMessage(ConfirmPath, pluginSessionID, []byte("/image/reader"))),
+		mockconn.Write(archiveMessage(ResultOK, pluginSessionID, nil)),
+		mockconn.Read(archiveMessage(ConfirmPath, pluginSessionID+1, []byte("/image/writer"))),
+		mockconn.Write(archiveMessage(ResultAccessDenied, pluginSessionID+1, nil)),
+		mockconn.Read(archiveMessage(ListPaths, pluginSessionID+2, nil)),
+		mockconn.Write(archiveMessage(ResultOK, pluginSessionID+2, []byte("/image/reader"))),
+	)
+	host.receiveMessage(socket)
+	host.receiveMessage(socket)
+	host.receiveMessage(socket)
+	socket.Verify()
+}
+
+func TestHostListPaths(t *testing.T) {
+	transport := NewInProcessTransport()
+	host := NewHostWithTransport("tobubus.list", transport)
+	host.Publish("/host/b", &testStruct{})
+	host.Publish("/host/a", &testStruct{})
+	host.Publish(referencePathPrefix+"host/1", &testStruct{})
+	err := host.Listen()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	defer host.Close()
+	plugin, err := NewPluginWithTransport("tobubus.list", "github.com/shibukawa/tobubus/list", transport)
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	plugin.Publish("/plugin", &testStruct{})
+	err = plugin.Connect()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	defer plugin.Close()
+	paths := host.ListPaths()
+	if strings.Join(paths, ",") != "/host/a,/host/b,/plugin" {
+		t.Errorf("host should list all paths, but %v", paths)
+	}
+	paths, err = plugin.ListPaths()
+	if err != nil || strings.Join(paths, ",") != "/host/a,/host/b" {
+		t.Errorf("plugin should list paths of host, but %v (%v)", paths, err)
+	}
+}
+
+type notifiedStruct struct {
+	notified chan string
+}
+
+func (n *notifiedStruct) Notified(info *CallInfo, message string) {
+	if !info.Notification {
+		message = "not notification"
+	}
+	n.notified <- message
+}
+
+func TestNotify(t *testing.T) {
+	transport := NewInProcessTransport()
+	host := NewHostWithTransport("tobubus.notify", transport)
+	var buffer lockedBuffer
+	host.SetLogger(slog.New(slog.NewTextHandler(&buffer, nil)))
+	hostObj := &notifiedStruct{notified: make(chan string, 1)}
+	host.Publish("/host", hostObj)
+	err := host.Listen()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	defer host.Close()
+	plugin, err := NewPluginWithTransport("tobubus.notify", "github.com/shibukawa/tobubus/notify", transport)
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	pluginObj := &notifiedStruct{notified: make(chan string, 1)}
+	plugin.Publish("/plugin", pluginObj)
+	err = plugin.Connect()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	defer plugin.Close()
+
+	err = plugin.Notify("/host", "Notified", "from plugin")
+	if err != nil {
+		t.Errorf("err should be nil, but %v", err)
+	}
+	if message := <-hostObj.notified; message != "from plugin" {
+		t.Errorf("host object should be notified, but %s", message)
+	}
+	err = host.Notify("/plugin", "Notified", "from host")
+	if err != nil {
+		t.Errorf("err should be nil, but %v", err)
+	}
+	if message := <-pluginObj.notified; message != "from host" {
+		t.Errorf("plugin object should be notified, but %s", message)
+	}
+	err = host.Notify("/host", "Notified", "local")
+	if err != nil || <-hostObj.notified != "local" {
+		t.Errorf("local object should be notified, but %v", err)
+	}
+
+	// errors are logged by the receiver
+	err = plugin.Notify("/host", "Unknown")
+	if err != nil {
+		t.Errorf("err should be nil, but %v", err)
+	}
+	if !waitUntil(func() bool { return strings.Contains(buffer.String(), "notification failed") }) {
+		t.Errorf("error should be logged, but %s", buffer.String())
+	}
+	if !strings.Contains(buffer.String(), "result=ResultMethodNotFound") || !strings.Contains(buffer.String(), "method=Unknown") {
+		t.Errorf("log should have the result and method, but %s", buffer.String())
+	}
+	err = host.Notify("/unknown", "Notified", "missing")
+	if err == nil {
+		t.Error("err should not be nil")
+	}
+	err = plugin.Notify("/host", "Notified", make(chan string))
+	if err == nil {
+		t.Error("streams should not be passed")
+	}
+	counted := false
+	for _, call := range plugin.Stats().Calls {
+		if call.Direction == CallSent && call.Method == "Notified" && call.Results[ResultOK] == 1 {
+			counted = true
+		}
+	}
+	if !counted {
+		t.Errorf("notification should be counted, but %v", plugin.Stats().Calls)
+	}
+}
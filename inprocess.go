@@ -0,0 +1,193 @@
+package tobubus
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// InProcessTransport connects host and plugins in the same process via in-memory pipes.
+//
+// Addresses are names in the transport. Host and plugins should use the same InProcessTransport instance.
+type InProcessTransport struct {
+	lock      sync.Mutex
+	listeners map[string]*inProcessListener
+}
+
+// NewInProcessTransport creates InProcessTransport.
+func NewInProcessTransport() *InProcessTransport {
+	return &InProcessTransport{
+		listeners: make(map[string]*inProcessListener),
+	}
+}
+
+func (t *InProcessTransport) Listen(address string) (net.Listener, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if _, ok := t.listeners[address]; ok {
+		return nil, fmt.Errorf("address '%s' is already in use", address)
+	}
+	l := &inProcessListener{
+		transport:   t,
+		address:     address,
+		connections: make(chan net.Conn),
+		closed:      make(chan struct{}),
+	}
+	t.listeners[address] = l
+	return l, nil
+}
+
+func (t *InProcessTransport) Dial(address string) (net.Conn, error) {
+	t.lock.Lock()
+	l, ok := t.listeners[address]
+	t.lock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no host is listening on '%s'", address)
+	}
+	client, server := newInProcessPipe(address)
+	select {
+	case l.connections <- server:
+		return client, nil
+	case <-l.closed:
+		return nil, fmt.Errorf("no host is listening on '%s'", address)
+	}
+}
+
+type inProcessListener struct {
+	transport   *InProcessTransport
+	address     string
+	connections chan net.Conn
+	closed      chan struct{}
+	once        sync.Once
+}
+
+func (l *inProcessListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.connections:
+		return conn, nil
+	case <-l.closed:
+		return nil, errors.New("listener is closed")
+	}
+}
+
+func (l *inProcessListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+		l.transport.lock.Lock()
+		delete(l.transport.listeners, l.address)
+		l.transport.lock.Unlock()
+	})
+	return nil
+}
+
+func (l *inProcessListener) Addr() net.Addr {
+	return inProcessAddr(l.address)
+}
+
+type inProcessAddr string
+
+func (a inProcessAddr) Network() string {
+	return "inprocess"
+}
+
+func (a inProcessAddr) String() string {
+	return string(a)
+}
+
+// pipeBuffer is one direction of inProcessConn. Unlike net.Pipe, Write doesn't wait for Read,
+// so both sides can write replies in their receiving loops like sockets.
+type pipeBuffer struct {
+	lock   sync.Mutex
+	cond   *sync.Cond
+	buffer bytes.Buffer
+	closed bool
+}
+
+func newPipeBuffer() *pipeBuffer {
+	b := &pipeBuffer{}
+	b.cond = sync.NewCond(&b.lock)
+	return b
+}
+
+func (b *pipeBuffer) read(data []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for b.buffer.Len() == 0 && !b.closed {
+		b.cond.Wait()
+	}
+	if b.buffer.Len() == 0 {
+		return 0, io.EOF
+	}
+	return b.buffer.Read(data)
+}
+
+func (b *pipeBuffer) write(data []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		return 0, io.ErrClosedPipe
+	}
+	n, err := b.buffer.Write(data)
+	b.cond.Broadcast()
+	return n, err
+}
+
+func (b *pipeBuffer) close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.closed = true
+	b.cond.Broadcast()
+}
+
+// inProcessConn is an end of the in-memory pipe. Deadlines are not supported.
+type inProcessConn struct {
+	address string
+	in      *pipeBuffer
+	out     *pipeBuffer
+	once    sync.Once
+}
+
+func newInProcessPipe(address string) (*inProcessConn, *inProcessConn) {
+	a, b := newPipeBuffer(), newPipeBuffer()
+	return &inProcessConn{address: address, in: a, out: b}, &inProcessConn{address: address, in: b, out: a}
+}
+
+func (c *inProcessConn) Read(data []byte) (int, error) {
+	return c.in.read(data)
+}
+
+func (c *inProcessConn) Write(data []byte) (int, error) {
+	return c.out.write(data)
+}
+
+func (c *inProcessConn) Close() error {
+	c.once.Do(func() {
+		c.in.close()
+		c.out.close()
+	})
+	return nil
+}
+
+func (c *inProcessConn) LocalAddr() net.Addr {
+	return inProcessAddr(c.address)
+}
+
+func (c *inProcessConn) RemoteAddr() net.Addr {
+	return inProcessAddr(c.address)
+}
+
+func (c *inProcessConn) SetDeadline(t time.Time) error {
+	return errors.New("deadline is not supported")
+}
+
+func (c *inProcessConn) SetReadDeadline(t time.Time) error {
+	return errors.New("deadline is not supported")
+}
+
+func (c *inProcessConn) SetWriteDeadline(t time.Time) error {
+	return errors.New("deadline is not supported")
+}
@@ -0,0 +1,24 @@
+package tobubus
+
+// Invoker calls the method described by info with params.
+type Invoker func(info *CallInfo, params []interface{}) ([]interface{}, error)
+
+// Interceptor wraps method calls. It can inspect and replace params and results, and can return error
+// without calling next.
+//
+// Client interceptors (UseClientInterceptor) wrap Host.Call and Plugin.Call. Their CallInfo describes the caller itself.
+// Server interceptors (UseServerInterceptor) wrap the calls from the other side and their CallInfo describes the caller.
+// Errors from server interceptors are sent to the caller as ResultNG.
+type Interceptor func(info *CallInfo, params []interface{}, next Invoker) ([]interface{}, error)
+
+// chainInterceptors returns Invoker that calls interceptors in order and invoker at last.
+func chainInterceptors(interceptors []Interceptor, invoker Invoker) Invoker {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor := interceptors[i]
+		next := invoker
+		invoker = func(info *CallInfo, params []interface{}) ([]interface{}, error) {
+			return interceptor(info, params, next)
+		}
+	}
+	return invoker
+}
@@ -0,0 +1,82 @@
+package tobubus
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestChainInterceptors(t *testing.T) {
+	var called []string
+	record := func(name string) Interceptor {
+		return func(info *CallInfo, params []interface{}, next Invoker) ([]interface{}, error) {
+			called = append(called, name)
+			return next(info, params)
+		}
+	}
+	invoker := chainInterceptors([]Interceptor{record("1"), record("2")}, func(info *CallInfo, params []interface{}) ([]interface{}, error) {
+		called = append(called, "method")
+		return params, nil
+	})
+	result, err := invoker(&CallInfo{}, []interface{}{"param"})
+	if err != nil || result[0] != "param" {
+		t.Errorf("invoker should return params, but %v (%v)", result, err)
+	}
+	if strings.Join(called, ",") != "1,2,method" {
+		t.Errorf("interceptors should be called in order, but %v", called)
+	}
+}
+
+func TestInterceptors(t *testing.T) {
+	transport := NewInProcessTransport()
+	host := NewHostWithTransport("tobubus.interceptor", transport)
+	obj := &testStruct{result: "ok"}
+	host.Publish("/host", obj)
+	var callers []string
+	host.UseServerInterceptor(func(info *CallInfo, params []interface{}, next Invoker) ([]interface{}, error) {
+		callers = append(callers, info.PluginID)
+		if params[0] == "forbidden" {
+			return nil, errors.New("forbidden argument")
+		}
+		return next(info, params)
+	})
+	err := host.Listen()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	defer host.Close()
+	plugin, err := NewPluginWithTransport("tobubus.interceptor", "github.com/shibukawa/tobubus/interceptor", transport)
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	plugin.UseClientInterceptor(func(info *CallInfo, params []interface{}, next Invoker) ([]interface{}, error) {
+		result, err := next(info, []interface{}{strings.ToLower(params[0].(string))})
+		if err == nil {
+			result[0] = strings.ToUpper(result[0].(string))
+		}
+		return result, err
+	})
+	err = plugin.Connect()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	defer plugin.Close()
+	result, err := plugin.Call("/host", "TestMethod", "ARG")
+	if err != nil || result[0] != "OK" {
+		t.Errorf("client interceptor should replace the result, but %v (%v)", result, err)
+	}
+	if len(obj.args) != 1 || obj.args[0] != "arg" {
+		t.Errorf("client interceptor should replace the params, but %v", obj.args)
+	}
+	_, err = plugin.Call("/host", "TestMethod", "FORBIDDEN")
+	if err == nil || !strings.Contains(err.Error(), "forbidden argument") {
+		t.Errorf("server interceptor should reject the call, but %v", err)
+	}
+	_, err = plugin.Call("/host", "Unknown", "arg")
+	if err == nil || !strings.Contains(err.Error(), "is not found") {
+		t.Errorf("err should be method not found error, but %v", err)
+	}
+	if len(callers) != 2 || callers[0] != "github.com/shibukawa/tobubus/interceptor" {
+		t.Errorf("server interceptor should know the caller, but %v", callers)
+	}
+}
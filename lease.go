@@ -0,0 +1,123 @@
+package tobubus
+
+import (
+	"net"
+	"sync"
+)
+
+// lease keeps the holders of a leased object. Holders are the connections the references are sent to.
+type lease struct {
+	holders map[net.Conn]int
+	sent    map[net.Conn]bool // connections the reference was handed to. Only they can acquire references.
+}
+
+// leaseTable tracks the references of objects published in leased mode.
+//
+// The object is dropped when all holders release it (or disconnect) after it is acquired at least once.
+type leaseTable struct {
+	lock   sync.Mutex
+	leases map[string]*lease // path -> lease
+}
+
+func newLeaseTable() *leaseTable {
+	return &leaseTable{
+		leases: make(map[string]*lease),
+	}
+}
+
+func (t *leaseTable) add(path string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.leases[path] = &lease{holders: make(map[net.Conn]int), sent: make(map[net.Conn]bool)}
+}
+
+func (t *leaseTable) remove(path string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.leases, path)
+}
+
+// acquire adds a reference from holder. It returns false if the path is not leased.
+func (t *leaseTable) acquire(path string, holder net.Conn) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	l, ok := t.leases[path]
+	if !ok {
+		return false
+	}
+	l.holders[holder]++
+	return true
+}
+
+// send adds a reference from holder like acquire and records that the reference is handed to holder.
+func (t *leaseTable) send(path string, holder net.Conn) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	l, ok := t.leases[path]
+	if !ok {
+		return false
+	}
+	l.holders[holder]++
+	l.sent[holder] = true
+	return true
+}
+
+// sentTo returns true if the reference of the object was handed to holder.
+func (t *leaseTable) sentTo(path string, holder net.Conn) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	l, ok := t.leases[path]
+	return ok && l.sent[holder]
+}
+
+// held returns true if holder has a reference of the object.
+func (t *leaseTable) held(path string, holder net.Conn) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	l, ok := t.leases[path]
+	return ok && l.holders[holder] > 0
+}
+
+// release removes a reference from holder. It returns true if the object should be dropped.
+func (t *leaseTable) release(path string, holder net.Conn) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	l, ok := t.leases[path]
+	if !ok || l.holders[holder] == 0 {
+		return false
+	}
+	l.holders[holder]--
+	if l.holders[holder] == 0 {
+		delete(l.holders, holder)
+	}
+	if len(l.holders) == 0 {
+		delete(t.leases, path)
+		return true
+	}
+	return false
+}
+
+// releaseHolder removes all references from holder. It returns the paths of objects that should be dropped.
+func (t *leaseTable) releaseHolder(holder net.Conn) []string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var dropped []string
+	for path, l := range t.leases {
+		if _, ok := l.holders[holder]; !ok {
+			continue
+		}
+		delete(l.holders, holder)
+		if len(l.holders) == 0 {
+			delete(t.leases, path)
+			dropped = append(dropped, path)
+		}
+	}
+	return dropped
+}
+
+// releaseFunc returns the function that sends Release message. Release doesn't have reply.
+func releaseFunc(socket net.Conn, path string) func() {
+	return func() {
+		socket.Write(archiveMessage(Release, 0, []byte(path)))
+	}
+}
@@ -0,0 +1,109 @@
+package tobubus
+
+import (
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestLeaseTable(t *testing.T) {
+	table := newLeaseTable()
+	holder1, holder2 := &net.UnixConn{}, &net.UnixConn{}
+	if table.acquire("/session", holder1) {
+		t.Error("acquire should fail for the path that is not leased")
+	}
+	table.add("/session")
+	table.acquire("/session", holder1)
+	table.acquire("/session", holder1)
+	table.acquire("/session", holder2)
+	if table.release("/session", holder1) {
+		t.Error("object should not be dropped while holder1 has one more reference")
+	}
+	if table.release("/session", holder1) {
+		t.Error("object should not be dropped while holder2 has reference")
+	}
+	if !table.release("/session", holder2) {
+		t.Error("object should be dropped after all holders release it")
+	}
+	table.add("/session2")
+	table.acquire("/session2", holder2)
+	if dropped := table.releaseHolder(holder2); len(dropped) != 1 || dropped[0] != "/session2" {
+		t.Errorf("object held by holder2 should be dropped, but %v", dropped)
+	}
+}
+
+func waitUntil(condition func() bool) bool {
+	for i := 0; i < 100; i++ {
+		if condition() {
+			return true
+		}
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestReleaseReturnedReference(t *testing.T) {
+	host, plugin, _ := startReferenceTest(t, "tobubus.lease.release")
+	defer host.Close()
+	defer plugin.Close()
+	result, err := host.Call("/documents", "Open", "readme.txt")
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	doc := result[0].(*RemoteObject)
+	path := doc.Path
+	doc.Close()
+	released := waitUntil(func() bool {
+		plugin.lock.RLock()
+		defer plugin.lock.RUnlock()
+		_, ok := plugin.objectMap[path]
+		return !ok
+	})
+	if !released {
+		t.Errorf("object at '%s' should be dropped after release", path)
+	}
+}
+
+func TestReleaseByFinalizer(t *testing.T) {
+	host, plugin, _ := startReferenceTest(t, "tobubus.lease.finalizer")
+	defer host.Close()
+	defer plugin.Close()
+	result, err := host.Call("/documents", "Open", "readme.txt")
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	path := result[0].(*RemoteObject).Path
+	result = nil
+	released := waitUntil(func() bool {
+		plugin.lock.RLock()
+		defer plugin.lock.RUnlock()
+		_, ok := plugin.objectMap[path]
+		return !ok
+	})
+	if !released {
+		t.Errorf("object at '%s' should be dropped after the handle is garbage-collected", path)
+	}
+}
+
+func TestReleaseWhenPluginDisconnects(t *testing.T) {
+	host, plugin, _ := startReferenceTest(t, "tobubus.lease.disconnect")
+	defer host.Close()
+	host.PublishLeased("/session/1", &testStruct{result: "ok"})
+	handle, err := plugin.Acquire("/session/1")
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	result, err := handle.Call("TestMethod", "arg")
+	if err != nil || result[0] != "ok" {
+		t.Errorf("TestMethod should return 'ok', but %v (%v)", result, err)
+	}
+	plugin.Close()
+	released := waitUntil(func() bool {
+		return !host.ConfirmPath("/session/1")
+	})
+	if !released {
+		t.Error("object should be dropped after the plugin is disconnected")
+	}
+}
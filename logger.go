@@ -0,0 +1,136 @@
+package tobubus
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+)
+
+// ParamRedactor replaces params of method calls before they are logged (e.g. to hide passwords).
+type ParamRedactor func(info *CallInfo, params []interface{}) []interface{}
+
+// RedactAllParams is ParamRedactor that logs only the types of params.
+func RedactAllParams(info *CallInfo, params []interface{}) []interface{} {
+	result := make([]interface{}, len(params))
+	for i, param := range params {
+		result[i] = fmt.Sprintf("%T", param)
+	}
+	return result
+}
+
+var messageTypeNames = map[MessageType]string{
+	ResultOK:             "ResultOK",
+	ResultNG:             "ResultNG",
+	ResultObjectNotFound: "ResultObjectNotFound",
+	ResultMethodNotFound: "ResultMethodNotFound",
+	ResultMethodError:    "ResultMethodError",
+	ResultProtocolError:  "ResultProtocolError",
+	ResultAccessDenied:   "ResultAccessDenied",
+	ConnectClient:        "ConnectClient",
+	CloseClient:          "CloseClient",
+	ConfirmPath:          "ConfirmPath",
+	Publish:              "Publish",
+	Unpublish:            "Unpublish",
+	Acquire:              "Acquire",
+	Release:              "Release",
+	ListPaths:            "ListPaths",
+	Monitor:              "Monitor",
+	CallMethod:           "CallMethod",
+	ReturnMethod:         "ReturnMethod",
+	ReturnStream:         "ReturnStream",
+	NotifyMethod:         "NotifyMethod",
+	CallBatch:            "CallBatch",
+	ReturnBatch:          "ReturnBatch",
+	StreamChunk:          "StreamChunk",
+	StreamEnd:            "StreamEnd",
+	StreamAck:            "StreamAck",
+	StreamCancel:         "StreamCancel",
+	MonitorFrame:         "MonitorFrame",
+}
+
+func (t MessageType) String() string {
+	if name, ok := messageTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("MessageType(0x%x)", uint32(t))
+}
+
+// logging keeps the logger of Host and Plugin. It has its own lock because it is used while they hold theirs.
+type logging struct {
+	lock     sync.RWMutex
+	logger   *slog.Logger
+	redactor ParamRedactor
+}
+
+func (l *logging) setLogger(logger *slog.Logger) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.logger = logger
+}
+
+func (l *logging) setRedactor(redactor ParamRedactor) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.redactor = redactor
+}
+
+// get returns the logger. It is slog.Default() if no logger is set.
+func (l *logging) get() *slog.Logger {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	if l.logger == nil {
+		return slog.Default()
+	}
+	return l.logger
+}
+
+// params returns the attribute of params that are redacted by ParamRedactor.
+func (l *logging) params(info *CallInfo, params []interface{}) slog.Attr {
+	return slog.Any("params", l.redact(info, params))
+}
+
+// redact returns params replaced by ParamRedactor. It returns params as they are if no redactor is set.
+func (l *logging) redact(info *CallInfo, params []interface{}) []interface{} {
+	l.lock.RLock()
+	redactor := l.redactor
+	l.lock.RUnlock()
+	if redactor != nil {
+		return redactor(info, params)
+	}
+	return params
+}
+
+// write sends the frame and logs the error. Frames are sent by one Write, so the error means the connection is broken.
+func (l *logging) write(socket net.Conn, data []byte) {
+	_, err := socket.Write(data)
+	if err != nil {
+		l.get().Error("write failed", frameAttrs(data, slog.String("remote", remoteAddr(socket)), slog.Any("error", err))...)
+	}
+}
+
+// frameAttrs returns the attributes of the frame header followed by attrs.
+func frameAttrs(data []byte, attrs ...interface{}) []interface{} {
+	if len(data) < 8 {
+		return attrs
+	}
+	return append([]interface{}{
+		slog.String("type", MessageType(binary.LittleEndian.Uint32(data)).String()),
+		slog.Uint64("session", uint64(binary.LittleEndian.Uint32(data[4:]))),
+	}, attrs...)
+}
+
+func messageAttrs(msg *message, attrs ...interface{}) []interface{} {
+	return append([]interface{}{
+		slog.String("type", msg.Type.String()),
+		slog.Uint64("session", uint64(msg.ID)),
+	}, attrs...)
+}
+
+func remoteAddr(socket net.Conn) string {
+	if addr := socket.RemoteAddr(); addr != nil {
+		return addr.String()
+	}
+	return ""
+}
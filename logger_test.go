@@ -0,0 +1,77 @@
+package tobubus
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type lockedBuffer struct {
+	lock   sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(data []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buffer.Write(data)
+}
+
+func (b *lockedBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buffer.String()
+}
+
+type panicStruct struct{}
+
+func (ps *panicStruct) Login(password string) string {
+	panic("can't login")
+}
+
+func TestMessageTypeString(t *testing.T) {
+	if MessageType(CallMethod).String() != "CallMethod" {
+		t.Errorf("name should be CallMethod, but %s", MessageType(CallMethod).String())
+	}
+	if MessageType(0xff).String() != "MessageType(0xff)" {
+		t.Errorf("unknown type should be shown as number, but %s", MessageType(0xff).String())
+	}
+}
+
+func TestLoggerRedactsParams(t *testing.T) {
+	var buffer lockedBuffer
+	transport := NewInProcessTransport()
+	host := NewHostWithTransport("tobubus.logger", transport)
+	host.SetLogger(slog.New(slog.NewTextHandler(&buffer, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	host.SetParamRedactor(RedactAllParams)
+	host.Publish("/login", &panicStruct{})
+	err := host.Listen()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	defer host.Close()
+	plugin, err := NewPluginWithTransport("tobubus.logger", "github.com/shibukawa/tobubus/logger", transport)
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	err = plugin.Connect()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	defer plugin.Close()
+	_, err = plugin.Call("/login", "Login", "secret-password")
+	if err == nil {
+		t.Error("err should not be nil")
+	}
+	log := buffer.String()
+	for _, expected := range []string{"plugin connected", "method panicked", "github.com/shibukawa/tobubus/logger", "/login"} {
+		if !strings.Contains(log, expected) {
+			t.Errorf("log should contain '%s', but %s", expected, log)
+		}
+	}
+	if strings.Contains(log, "secret-password") {
+		t.Errorf("log should not contain params, but %s", log)
+	}
+}
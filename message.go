@@ -2,9 +2,10 @@ package tobubus
 
 import (
 	"encoding/binary"
-	"github.com/ugorji/go/codec"
+	"fmt"
 	"io"
-	"net"
+	"io/ioutil"
+	"strings"
 )
 
 type MessageType uint32
@@ -15,15 +16,58 @@ const (
 	ResultObjectNotFound             = 0x3
 	ResultMethodNotFound             = 0x4
 	ResultMethodError                = 0x5
+	ResultProtocolError              = 0x6
+	ResultAccessDenied               = 0x7
 	ConnectClient                    = 0x10
 	CloseClient                      = 0x11
 	ConfirmPath                      = 0x20
 	Publish                          = 0x21
 	Unpublish                        = 0x22
+	Acquire                          = 0x23
+	Release                          = 0x24 // no reply
+	ListPaths                        = 0x25
+	Monitor                          = 0x26
 	CallMethod                       = 0x30
 	ReturnMethod                     = 0x31
+	ReturnStream                     = 0x32
+	NotifyMethod                     = 0x33 // no reply
+	CallBatch                        = 0x34
+	ReturnBatch                      = 0x35
+	StreamChunk                      = 0x40
+	StreamEnd                        = 0x41
+	StreamAck                        = 0x42
+	StreamCancel                     = 0x43
+	MonitorFrame                     = 0x50 // no reply
 )
 
+// DefaultMaxFrameSize is the default limit of the frame body size that Host and Plugin accept.
+const DefaultMaxFrameSize uint32 = 16 * 1024 * 1024
+
+// FrameSizeError is returned when a frame body exceeds the configured maximum frame size.
+type FrameSizeError struct {
+	Size  uint32
+	Limit uint32
+}
+
+func (e *FrameSizeError) Error() string {
+	return fmt.Sprintf("frame size %d exceeds the limit %d", e.Size, e.Limit)
+}
+
+// isReply returns true if the message type is an answer to a request sent from this side.
+// Replies are routed to waiting sessions and never answered.
+func isReply(msgType MessageType) bool {
+	switch msgType {
+	case ResultOK, ResultNG, ResultObjectNotFound, ResultMethodNotFound, ResultMethodError, ResultProtocolError, ResultAccessDenied,
+		ReturnMethod, ReturnStream, ReturnBatch:
+		return true
+	}
+	return false
+}
+
+func isStreamMessage(msgType MessageType) bool {
+	return msgType >= StreamChunk && msgType <= StreamCancel
+}
+
 type message struct {
 	Type MessageType
 	ID   uint32
@@ -31,9 +75,10 @@ type message struct {
 }
 
 type methodCall struct {
-	Path   string        `codec:"path,omitempty"`
-	Method string        `codec:"method,omitempty"`
-	Params []interface{} `codec:"params"`
+	Path     string            `codec:"path,omitempty"`
+	Method   string            `codec:"method,omitempty"`
+	Params   []interface{}     `codec:"params"`
+	Metadata map[string]string `codec:"metadata,omitempty"` // e.g. trace context. Peers ignore unknown keys.
 }
 
 func archiveMessage(msg MessageType, sessionID uint32, body []byte) []byte {
@@ -45,52 +90,124 @@ func archiveMessage(msg MessageType, sessionID uint32, body []byte) []byte {
 	return result
 }
 
-func parseMessage(conn net.Conn) (*message, error) {
+// parseMessage reads one frame from reader.
+//
+// If the body is larger than maxFrameSize, the body is skipped and the header part of the message
+// is returned with *FrameSizeError to let the caller send the reply.
+func parseMessage(reader io.Reader, maxFrameSize uint32) (*message, error) {
 	header := make([]byte, 12)
-	_, err := io.ReadAtLeast(conn, header, 12)
+	_, err := io.ReadFull(reader, header)
 	if err != nil {
 		return nil, err
 	}
 	messageType := binary.LittleEndian.Uint32(header)
 	sessionID := binary.LittleEndian.Uint32(header[4:])
 	bodySize := binary.LittleEndian.Uint32(header[8:])
-	var body []byte
+	result := &message{
+		Type: MessageType(messageType),
+		ID:   sessionID,
+	}
+	if bodySize > maxFrameSize {
+		_, err = io.CopyN(ioutil.Discard, reader, int64(bodySize))
+		if err != nil {
+			return nil, err
+		}
+		return result, &FrameSizeError{Size: bodySize, Limit: maxFrameSize}
+	}
 	if bodySize > 0 {
-		body = make([]byte, bodySize)
-		_, err = io.ReadAtLeast(conn, body, int(bodySize))
+		result.body = make([]byte, bodySize)
+		_, err = io.ReadFull(reader, result.body)
 		if err != nil {
 			return nil, err
 		}
 	}
-	return &message{
-		Type: MessageType(messageType),
-		ID:   sessionID,
-		body: body,
-	}, nil
+	return result, nil
+}
+
+func archiveProtocolErrorMessage(sessionID uint32, err error) []byte {
+	return archiveMessage(ResultProtocolError, sessionID, []byte(err.Error()))
+}
+
+// resultError converts the reply of method call into error.
+func resultError(msg *message, path, methodName string) error {
+	switch msg.Type {
+	case ReturnMethod, ReturnStream:
+		return nil
+	case ResultObjectNotFound:
+		return fmt.Errorf("There is no object in path '%s'.", path)
+	case ResultMethodNotFound:
+		return fmt.Errorf("Method '%s' is not found at '%s'.", methodName, path)
+	case ResultMethodError:
+		return fmt.Errorf("Method '%s' at '%s' causes error.", methodName, path)
+	case ResultProtocolError:
+		return fmt.Errorf("Protocol error: %s", string(msg.body))
+	case ResultNG:
+		if len(msg.body) > 0 {
+			return fmt.Errorf("Method '%s' at '%s' returns error: %s", methodName, path, string(msg.body))
+		}
+	case ResultAccessDenied:
+		return fmt.Errorf("Access to method '%s' at '%s' is denied.", methodName, path)
+	}
+	return fmt.Errorf("Remote method call error at '%s': result type %d", path, msg.Type)
 }
 
-func archiveMethodCallMessage(msg MessageType, msgID uint32, path, methodName string, params []interface{}) ([]byte, error) {
-	var ch codec.CborHandle
+func archiveMethodCallMessage(c Codec, msg MessageType, msgID uint32, path, methodName string, params []interface{}) ([]byte, error) {
+	return archiveMethodCallMessageWithMetadata(c, msg, msgID, path, methodName, nil, params)
+}
+
+func archiveMethodCallMessageWithMetadata(c Codec, msg MessageType, msgID uint32, path, methodName string, metadata map[string]string, params []interface{}) ([]byte, error) {
+	if len(metadata) == 0 {
+		// codecs write empty map even if it is omitempty. Frames without metadata are the same as before.
+		metadata = nil
+	}
 	src := methodCall{
-		Path:   path,
-		Method: methodName,
-		Params: params,
+		Path:     path,
+		Method:   methodName,
+		Params:   params,
+		Metadata: metadata,
 	}
-	var data []byte
-	ch.SignedInteger = true
-	enc := codec.NewEncoderBytes(&data, &ch)
-	err := enc.Encode(src)
+	data, err := c.Encode(src)
 	if err != nil {
 		return nil, err
 	}
 	return archiveMessage(msg, msgID, data), nil
 }
 
-func parseMethodCallMessage(data []byte) *methodCall {
-	var ch codec.CborHandle
-	ch.SignedInteger = true
+func parseMethodCallMessage(c Codec, data []byte) (*methodCall, error) {
 	result := &methodCall{}
-	dec := codec.NewDecoderBytes(data, &ch)
-	dec.Decode(result)
-	return result
+	err := c.Decode(data, result)
+	if err != nil {
+		return nil, fmt.Errorf("can't decode method call: %v", err)
+	}
+	return result, nil
+}
+
+// archiveConnectClientBody creates the body of ConnectClient message.
+//
+// The body is plugin ID. If plugin uses other codec than default, its name is appended after NUL.
+// If plugin has token, it is appended after one more NUL (codec name is empty for default codec).
+func archiveConnectClientBody(pluginID string, c Codec, token string) []byte {
+	codecName := ""
+	if c != nil && c.Name() != CborCodec.Name() {
+		codecName = c.Name()
+	}
+	if token != "" {
+		return []byte(pluginID + "\x00" + codecName + "\x00" + token)
+	}
+	if codecName != "" {
+		return []byte(pluginID + "\x00" + codecName)
+	}
+	return []byte(pluginID)
+}
+
+func parseConnectClientBody(body []byte) (pluginID, codecName, token string) {
+	fields := strings.SplitN(string(body), "\x00", 3)
+	pluginID = fields[0]
+	if len(fields) > 1 {
+		codecName = fields[1]
+	}
+	if len(fields) > 2 {
+		token = fields[2]
+	}
+	return
 }
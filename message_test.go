@@ -19,7 +19,7 @@ func TestParseMessage(t *testing.T) {
 	socket.SetExpectedActions(
 		mockconn.Read([]byte("\x10\x00\x00\x00\x00\x00\x00\x00\x1e\x00\x00\x00github.com/shibukawa/tobubus/1")),
 	)
-	message, err := parseMessage(socket)
+	message, err := parseMessage(socket, DefaultMaxFrameSize)
 	if err != nil {
 		t.Errorf("err should be nil, but %v", err)
 	}
@@ -32,7 +32,7 @@ func TestParseMessage(t *testing.T) {
 }
 
 func TestArchiveMethodCall(t *testing.T) {
-	data, err := archiveMethodCallMessage(ConnectClient, 0, "/image", "open", []interface{}{"test.png", 0777})
+	data, err := archiveMethodCallMessage(CborCodec, ConnectClient, 0, "/image", "open", []interface{}{"test.png", 0777})
 	if err != nil {
 		t.Errorf("err should be nil, but %v", err)
 		return
@@ -42,3 +42,68 @@ func TestArchiveMethodCall(t *testing.T) {
 		mockconn.Read(data),
 	)
 }
+
+func TestParseMessageTooLarge(t *testing.T) {
+	data := append(archiveMessage(CallMethod, 3, []byte("0123456789")), archiveMessage(ResultOK, 4, nil)...)
+	reader := bytes.NewReader(data)
+	message, err := parseMessage(reader, 8)
+	if _, ok := err.(*FrameSizeError); !ok {
+		t.Errorf("err should be FrameSizeError, but %v", err)
+	}
+	if message == nil || message.Type != CallMethod || message.ID != 3 {
+		t.Errorf("header should be returned, but %v", message)
+	}
+	// body is skipped and next frame can be read
+	message, err = parseMessage(reader, 8)
+	if err != nil {
+		t.Errorf("err should be nil, but %v", err)
+	} else if message.Type != ResultOK || message.ID != 4 {
+		t.Errorf("parse error: %v", message)
+	}
+}
+
+func TestParseMessageTruncated(t *testing.T) {
+	data := archiveMessage(CallMethod, 3, []byte("0123456789"))
+	_, err := parseMessage(bytes.NewReader(data[:16]), DefaultMaxFrameSize)
+	if err == nil {
+		t.Error("err should not be nil")
+	}
+}
+
+func TestParseMethodCallMessage(t *testing.T) {
+	data, _ := archiveMethodCallMessage(CborCodec, CallMethod, 0, "/image", "open", []interface{}{"test.png"})
+	method, err := parseMethodCallMessage(CborCodec, data[12:])
+	if err != nil {
+		t.Errorf("err should be nil, but %v", err)
+	} else if method.Path != "/image" || method.Method != "open" || len(method.Params) != 1 {
+		t.Errorf("parse error: %v", method)
+	}
+	_, err = parseMethodCallMessage(CborCodec, []byte("\xff\x00broken"))
+	if err == nil {
+		t.Error("err should not be nil")
+	}
+}
+
+func FuzzParseMessage(f *testing.F) {
+	f.Add(archiveMessage(ConnectClient, 0, []byte("github.com/shibukawa/tobubus/1")))
+	f.Add(archiveMessage(ResultOK, 1, nil))
+	f.Add([]byte("\x30\x00\x00\x00\x00\x00\x00\x00\xff\xff\xff\xff"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		message, err := parseMessage(bytes.NewReader(data), 1024)
+		if err == nil && uint32(len(message.body)) > 1024 {
+			t.Errorf("body exceeds the limit: %d", len(message.body))
+		}
+	})
+}
+
+func FuzzParseMethodCallMessage(f *testing.F) {
+	data, _ := archiveMethodCallMessage(CborCodec, CallMethod, 0, "/image", "open", []interface{}{"test.png", 0777})
+	f.Add(data[12:])
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		method, err := parseMethodCallMessage(CborCodec, data)
+		if err == nil && method == nil {
+			t.Error("method should not be nil without error")
+		}
+	})
+}
@@ -0,0 +1,74 @@
+package tobubus
+
+import (
+	"context"
+)
+
+type metadataKey struct{}
+
+type trailerKey struct{}
+
+// ContextWithMetadata returns the context that carries metadata. Calls made by CallContext with the context
+// send metadata (e.g. locale or request ID) to the published method. It is merged with the metadata in ctx.
+//
+// Published methods read it from CallInfo.Metadata. Keys "traceparent" and "tracestate" are reserved for trace context.
+func ContextWithMetadata(ctx context.Context, metadata map[string]string) context.Context {
+	merged := make(map[string]string)
+	mergeMetadata(merged, MetadataFromContext(ctx))
+	mergeMetadata(merged, metadata)
+	return context.WithValue(ctx, metadataKey{}, merged)
+}
+
+// MetadataFromContext returns the metadata set by ContextWithMetadata. The result is a copy.
+func MetadataFromContext(ctx context.Context) map[string]string {
+	metadata, _ := ctx.Value(metadataKey{}).(map[string]string)
+	if len(metadata) == 0 {
+		return nil
+	}
+	result := make(map[string]string, len(metadata))
+	mergeMetadata(result, metadata)
+	return result
+}
+
+// ContextWithTrailer returns the context that receives the trailer of the call made by CallContext.
+// The entries published methods set to CallInfo.Trailer are stored in trailer after the call returns.
+func ContextWithTrailer(ctx context.Context, trailer map[string]string) context.Context {
+	return context.WithValue(ctx, trailerKey{}, trailer)
+}
+
+func trailerFromContext(ctx context.Context) map[string]string {
+	trailer, _ := ctx.Value(trailerKey{}).(map[string]string)
+	return trailer
+}
+
+// mergeMetadata copies entries of src to dst. dst may be nil if src is empty.
+func mergeMetadata(dst, src map[string]string) {
+	for key, value := range src {
+		dst[key] = value
+	}
+}
+
+// callMetadata returns the metadata of CallMethod: the metadata of the call and its trace context.
+func callMetadata(info *CallInfo) map[string]string {
+	trace := traceMetadata(info.Trace)
+	if len(info.Metadata) == 0 {
+		return trace
+	}
+	metadata := make(map[string]string, len(info.Metadata)+len(trace))
+	mergeMetadata(metadata, info.Metadata)
+	mergeMetadata(metadata, trace)
+	return metadata
+}
+
+// newCallInfo returns CallInfo of the call made by CallContext.
+func newCallInfo(ctx context.Context, pluginID, path, methodName string) *CallInfo {
+	info := &CallInfo{
+		PluginID: pluginID,
+		Path:     path,
+		Method:   methodName,
+		Metadata: make(map[string]string),
+		Trailer:  make(map[string]string),
+	}
+	mergeMetadata(info.Metadata, MetadataFromContext(ctx))
+	return info
+}
@@ -0,0 +1,70 @@
+package tobubus
+
+import (
+	"context"
+	"testing"
+)
+
+type greeter struct{}
+
+func (g *greeter) Greet(info *CallInfo, name string) string {
+	info.Trailer["served-by"] = "greeter"
+	if info.Metadata["locale"] == "ja" {
+		return "konnichiwa " + name + " (" + info.Metadata["request-id"] + ")"
+	}
+	return "hello " + name
+}
+
+func TestContextWithMetadata(t *testing.T) {
+	ctx := ContextWithMetadata(context.Background(), map[string]string{"locale": "en", "user": "a"})
+	ctx = ContextWithMetadata(ctx, map[string]string{"locale": "ja"})
+	metadata := MetadataFromContext(ctx)
+	if metadata["locale"] != "ja" || metadata["user"] != "a" {
+		t.Errorf("metadata should be merged, but %v", metadata)
+	}
+	metadata["locale"] = "fr"
+	if MetadataFromContext(ctx)["locale"] != "ja" {
+		t.Error("metadata in context should not be modified")
+	}
+	if MetadataFromContext(context.Background()) != nil {
+		t.Error("metadata should be nil")
+	}
+}
+
+func TestCallMetadata(t *testing.T) {
+	transport := NewInProcessTransport()
+	host := NewHostWithTransport("tobubus.metadata", transport)
+	host.UseClientInterceptor(func(info *CallInfo, params []interface{}, next Invoker) ([]interface{}, error) {
+		info.Metadata["request-id"] = "42"
+		return next(info, params)
+	})
+	err := host.Listen()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	defer host.Close()
+	plugin, err := NewPluginWithTransport("tobubus.metadata", "github.com/shibukawa/tobubus/metadata", transport)
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	plugin.Publish("/greeter", &greeter{})
+	err = plugin.Connect()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	defer plugin.Close()
+
+	trailer := make(map[string]string)
+	ctx := ContextWithTrailer(ContextWithMetadata(context.Background(), map[string]string{"locale": "ja"}), trailer)
+	result, err := host.CallContext(ctx, "/greeter", "Greet", "shibukawa")
+	if err != nil || result[0] != "konnichiwa shibukawa (42)" {
+		t.Errorf("method should receive metadata, but %v (%v)", result, err)
+	}
+	if trailer["served-by"] != "greeter" {
+		t.Errorf("trailer should be received, but %v", trailer)
+	}
+	result, err = plugin.Call("/greeter", "Greet", "shibukawa")
+	if err != nil || result[0] != "hello shibukawa" {
+		t.Errorf("call without metadata should work, but %v (%v)", result, err)
+	}
+}
@@ -0,0 +1,282 @@
+package tobubus
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds of the buckets of latency histograms.
+var LatencyBuckets = []time.Duration{
+	100 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+}
+
+const (
+	// CallReceived is the direction of calls from the peer to the objects of this side.
+	CallReceived = "received"
+	// CallSent is the direction of calls from this side to the objects of the peer.
+	CallSent = "sent"
+)
+
+// Stats is the snapshot of metrics of Host or Plugin.
+type Stats struct {
+	Calls            []CallStats
+	InFlightSessions int // sessions waiting for the replies from the peer
+	ConnectedPlugins int // always 0 or 1 for Plugin
+	BytesIn          uint64
+	BytesOut         uint64
+	FramesIn         uint64
+	FramesOut        uint64
+}
+
+// CallStats is the statistics of calls of one method.
+//
+// The objects passed by reference are published at temporary paths. Their calls are counted
+// at "/tobubus/ref/*" to keep the number of CallStats small. For the same reason, received calls
+// to missing objects and methods, denied calls and calls rejected by the busy dispatcher are counted
+// at "<unknown>".
+type CallStats struct {
+	Direction string // CallReceived or CallSent
+	Path      string
+	Method    string
+	Results   map[MessageType]uint64 // ResultOK for succeeded calls
+	Latency   Histogram
+}
+
+// Histogram is the distribution of durations. Counts[i] is the number of durations
+// that are less than or equal to Bounds[i]. The last of Counts is for the larger durations.
+type Histogram struct {
+	Bounds []time.Duration
+	Counts []uint64
+	Count  uint64
+	Sum    time.Duration
+}
+
+func (h *Histogram) observe(duration time.Duration) {
+	i := sort.Search(len(h.Bounds), func(i int) bool {
+		return duration <= h.Bounds[i]
+	})
+	h.Counts[i]++
+	h.Count++
+	h.Sum += duration
+}
+
+type callKey struct {
+	direction string
+	path      string
+	method    string
+}
+
+// metrics counts calls, bytes and frames of Host and Plugin. The zero value is ready to use.
+type metrics struct {
+	bytesIn   uint64 // 64-bit fields are accessed atomically and should be first
+	bytesOut  uint64
+	framesIn  uint64
+	framesOut uint64
+	lock      sync.Mutex
+	calls     map[callKey]*CallStats
+}
+
+// unknownLabel is used instead of paths and methods of received calls that are not resolved.
+// They come from the peer and shouldn't make unbounded number of CallStats.
+const unknownLabel = "<unknown>"
+
+// recordCall counts the call that is finished with result.
+func (m *metrics) recordCall(direction, path, method string, result MessageType, start time.Time) {
+	duration := time.Since(start)
+	if direction == CallReceived {
+		switch result {
+		case ResultObjectNotFound, ResultAccessDenied:
+			path, method = unknownLabel, unknownLabel
+		case ResultMethodNotFound:
+			method = unknownLabel
+		}
+	}
+	if strings.HasPrefix(path, referencePathPrefix) {
+		path = referencePathPrefix + "*"
+	}
+	key := callKey{direction: direction, path: path, method: method}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.calls == nil {
+		m.calls = make(map[callKey]*CallStats)
+	}
+	stats, ok := m.calls[key]
+	if !ok {
+		stats = &CallStats{
+			Direction: direction,
+			Path:      path,
+			Method:    method,
+			Results:   make(map[MessageType]uint64),
+			Latency: Histogram{
+				Bounds: LatencyBuckets,
+				Counts: make([]uint64, len(LatencyBuckets)+1),
+			},
+		}
+		m.calls[key] = stats
+	}
+	stats.Results[result]++
+	stats.Latency.observe(duration)
+}
+
+func (m *metrics) receivedFrame() {
+	atomic.AddUint64(&m.framesIn, 1)
+}
+
+// stats returns the snapshot. Calls are sorted by direction, path and method.
+func (m *metrics) stats(sessions *sessionManager) Stats {
+	result := Stats{
+		InFlightSessions: sessions.count(),
+		BytesIn:          atomic.LoadUint64(&m.bytesIn),
+		BytesOut:         atomic.LoadUint64(&m.bytesOut),
+		FramesIn:         atomic.LoadUint64(&m.framesIn),
+		FramesOut:        atomic.LoadUint64(&m.framesOut),
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, stats := range m.calls {
+		copied := *stats
+		copied.Results = make(map[MessageType]uint64)
+		for resultType, count := range stats.Results {
+			copied.Results[resultType] = count
+		}
+		copied.Latency.Counts = append([]uint64(nil), stats.Latency.Counts...)
+		result.Calls = append(result.Calls, copied)
+	}
+	sort.Slice(result.Calls, func(i, j int) bool {
+		a, b := result.Calls[i], result.Calls[j]
+		if a.Direction != b.Direction {
+			return a.Direction < b.Direction
+		}
+		if a.Path != b.Path {
+			return a.Path < b.Path
+		}
+		return a.Method < b.Method
+	})
+	return result
+}
+
+// conn returns the connection that counts bytes and frames of socket. onWrite is called with each frame before it is sent
+// if it is not nil.
+func (m *metrics) conn(socket net.Conn, onWrite func(socket net.Conn, data []byte)) net.Conn {
+	return &meteredConn{Conn: socket, metrics: m, onWrite: onWrite}
+}
+
+// meteredConn counts bytes it reads and writes. Each Write sends one frame.
+type meteredConn struct {
+	net.Conn
+	metrics *metrics
+	onWrite func(socket net.Conn, data []byte)
+}
+
+func (c *meteredConn) Read(data []byte) (int, error) {
+	n, err := c.Conn.Read(data)
+	atomic.AddUint64(&c.metrics.bytesIn, uint64(n))
+	return n, err
+}
+
+func (c *meteredConn) Write(data []byte) (int, error) {
+	if c.onWrite != nil && len(data) > 0 {
+		c.onWrite(c, data)
+	}
+	n, err := c.Conn.Write(data)
+	atomic.AddUint64(&c.metrics.bytesOut, uint64(n))
+	if n > 0 {
+		atomic.AddUint64(&c.metrics.framesOut, 1)
+	}
+	return n, err
+}
+
+// unwrapConn returns the connection of transport. Transports check their own connection types.
+func unwrapConn(socket net.Conn) net.Conn {
+	if c, ok := socket.(*meteredConn); ok {
+		return c.Conn
+	}
+	return socket
+}
+
+// replyResult returns the result type of the call from its reply.
+func replyResult(msg *message) MessageType {
+	if msg.Type == ReturnMethod || msg.Type == ReturnStream {
+		return ResultOK
+	}
+	return msg.Type
+}
+
+// StatsSource is implemented by Host and Plugin.
+type StatsSource interface {
+	Stats() Stats
+}
+
+// MetricsHandler returns http.Handler that serves the stats of source in Prometheus text format.
+func MetricsHandler(source StatsSource) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writePrometheus(w, source.Stats())
+	})
+}
+
+func writePrometheus(w io.Writer, stats Stats) {
+	fmt.Fprintln(w, "# HELP tobubus_calls_total Number of method calls by result.")
+	fmt.Fprintln(w, "# TYPE tobubus_calls_total counter")
+	for _, call := range stats.Calls {
+		resultTypes := make([]MessageType, 0, len(call.Results))
+		for resultType := range call.Results {
+			resultTypes = append(resultTypes, resultType)
+		}
+		sort.Slice(resultTypes, func(i, j int) bool {
+			return resultTypes[i] < resultTypes[j]
+		})
+		for _, resultType := range resultTypes {
+			fmt.Fprintf(w, "tobubus_calls_total{%s,result=%s} %d\n", callLabels(call), quoteLabel(resultType.String()), call.Results[resultType])
+		}
+	}
+	fmt.Fprintln(w, "# HELP tobubus_call_duration_seconds Latency of method calls.")
+	fmt.Fprintln(w, "# TYPE tobubus_call_duration_seconds histogram")
+	for _, call := range stats.Calls {
+		labels := callLabels(call)
+		var cumulative uint64
+		for i, bound := range call.Latency.Bounds {
+			cumulative += call.Latency.Counts[i]
+			fmt.Fprintf(w, "tobubus_call_duration_seconds_bucket{%s,le=\"%g\"} %d\n", labels, bound.Seconds(), cumulative)
+		}
+		fmt.Fprintf(w, "tobubus_call_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, call.Latency.Count)
+		fmt.Fprintf(w, "tobubus_call_duration_seconds_sum{%s} %g\n", labels, call.Latency.Sum.Seconds())
+		fmt.Fprintf(w, "tobubus_call_duration_seconds_count{%s} %d\n", labels, call.Latency.Count)
+	}
+	writePrometheusValue(w, "tobubus_in_flight_sessions", "gauge", "Number of sessions waiting for replies.", uint64(stats.InFlightSessions))
+	writePrometheusValue(w, "tobubus_connected_plugins", "gauge", "Number of connected plugins.", uint64(stats.ConnectedPlugins))
+	writePrometheusValue(w, "tobubus_received_bytes_total", "counter", "Bytes received from peers.", stats.BytesIn)
+	writePrometheusValue(w, "tobubus_sent_bytes_total", "counter", "Bytes sent to peers.", stats.BytesOut)
+	writePrometheusValue(w, "tobubus_received_frames_total", "counter", "Frames received from peers.", stats.FramesIn)
+	writePrometheusValue(w, "tobubus_sent_frames_total", "counter", "Frames sent to peers.", stats.FramesOut)
+}
+
+func writePrometheusValue(w io.Writer, name, metricType, help string, value uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, metricType, name, value)
+}
+
+func callLabels(call CallStats) string {
+	return fmt.Sprintf("direction=%s,path=%s,method=%s", quoteLabel(call.Direction), quoteLabel(call.Path), quoteLabel(call.Method))
+}
+
+var labelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteLabel(value string) string {
+	return `"` + labelReplacer.Replace(value) + `"`
+}
@@ -0,0 +1,124 @@
+package tobubus
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogramObserve(t *testing.T) {
+	histogram := Histogram{
+		Bounds: []time.Duration{time.Millisecond, time.Second},
+		Counts: make([]uint64, 3),
+	}
+	histogram.observe(time.Millisecond)
+	histogram.observe(2 * time.Millisecond)
+	histogram.observe(time.Minute)
+	if histogram.Counts[0] != 1 || histogram.Counts[1] != 1 || histogram.Counts[2] != 1 {
+		t.Errorf("each bucket should have one duration, but %v", histogram.Counts)
+	}
+	if histogram.Count != 3 || histogram.Sum != time.Minute+3*time.Millisecond {
+		t.Errorf("count and sum are wrong: %d, %v", histogram.Count, histogram.Sum)
+	}
+}
+
+func TestStats(t *testing.T) {
+	transport := NewInProcessTransport()
+	host := NewHostWithTransport("tobubus.metrics", transport)
+	host.Publish("/host", &testStruct{result: "ok"})
+	err := host.Listen()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	defer host.Close()
+	plugin, err := NewPluginWithTransport("tobubus.metrics", "github.com/shibukawa/tobubus/metrics", transport)
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	err = plugin.Connect()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	defer plugin.Close()
+	plugin.Call("/host", "TestMethod", "arg")
+	plugin.Call("/host", "TestMethod", "arg")
+	plugin.Call("/host", "Unknown")
+
+	stats := plugin.Stats()
+	if len(stats.Calls) != 2 {
+		t.Fatalf("plugin should have stats of 2 methods, but %v", stats.Calls)
+	}
+	call := stats.Calls[0]
+	if call.Direction != CallSent || call.Path != "/host" || call.Method != "TestMethod" || call.Results[ResultOK] != 2 || call.Latency.Count != 2 {
+		t.Errorf("stats of TestMethod are wrong: %v", call)
+	}
+	if stats.Calls[1].Results[ResultMethodNotFound] != 1 {
+		t.Errorf("stats of Unknown are wrong: %v", stats.Calls[1])
+	}
+	if stats.ConnectedPlugins != 1 || stats.InFlightSessions != 0 {
+		t.Errorf("plugin should be connected without sessions, but %d, %d", stats.ConnectedPlugins, stats.InFlightSessions)
+	}
+	if stats.FramesOut < 4 || stats.FramesIn < 4 || stats.BytesOut == 0 || stats.BytesIn == 0 {
+		t.Errorf("traffic is not counted: %v", stats)
+	}
+
+	var hostStats Stats
+	if !waitUntil(func() bool {
+		hostStats = host.Stats()
+		return len(hostStats.Calls) == 2
+	}) {
+		t.Fatalf("host should have stats of 2 methods, but %v", hostStats.Calls)
+	}
+	// "<unknown>" is sorted before "TestMethod"
+	if hostStats.Calls[1].Direction != CallReceived || hostStats.Calls[1].Results[ResultOK] != 2 {
+		t.Errorf("host should count received calls, but %v", hostStats.Calls[1])
+	}
+	if hostStats.ConnectedPlugins != 1 {
+		t.Errorf("host should have 1 plugin, but %d", hostStats.ConnectedPlugins)
+	}
+
+	recorder := httptest.NewRecorder()
+	MetricsHandler(host).ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := ioutil.ReadAll(recorder.Body)
+	for _, expected := range []string{
+		`tobubus_calls_total{direction="received",path="/host",method="TestMethod",result="ResultOK"} 2`,
+		`tobubus_calls_total{direction="received",path="/host",method="<unknown>",result="ResultMethodNotFound"} 1`,
+		`tobubus_call_duration_seconds_count{direction="received",path="/host",method="TestMethod"} 2`,
+		`tobubus_call_duration_seconds_bucket{direction="received",path="/host",method="TestMethod",le="+Inf"} 2`,
+		"tobubus_connected_plugins 1",
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Errorf("metrics should contain '%s', but\n%s", expected, body)
+		}
+	}
+}
+
+func TestRecordCallUnknownLabels(t *testing.T) {
+	var m metrics
+	start := time.Now()
+	m.recordCall(CallReceived, "/missing/1", "Method", ResultObjectNotFound, start)
+	m.recordCall(CallReceived, "/missing/2", "Method", ResultAccessDenied, start)
+	m.recordCall(CallReceived, "/host", "Missing", ResultMethodNotFound, start)
+	m.recordCall(CallSent, "/missing/3", "Method", ResultObjectNotFound, start)
+	stats := m.stats(newSessionManager(recycleStrategy)).Calls
+	if len(stats) != 3 {
+		t.Fatalf("stats should have 3 entries, but %v", stats)
+	}
+	if stats[0].Path != "/host" || stats[0].Method != unknownLabel {
+		t.Errorf("missing method should be counted at '<unknown>', but %v", stats[0])
+	}
+	if stats[1].Path != unknownLabel || stats[1].Method != unknownLabel || stats[1].Results[ResultObjectNotFound] != 1 || stats[1].Results[ResultAccessDenied] != 1 {
+		t.Errorf("missing objects and denied calls should be counted at '<unknown>', but %v", stats[1])
+	}
+	if stats[2].Direction != CallSent || stats[2].Path != "/missing/3" {
+		t.Errorf("sent calls should be counted at their paths, but %v", stats[2])
+	}
+}
+
+func TestQuoteLabel(t *testing.T) {
+	if quoted := quoteLabel("a\"b\\c\n"); quoted != `"a\"b\\c\n"` {
+		t.Errorf("label is not escaped: %s", quoted)
+	}
+}
@@ -0,0 +1,311 @@
+package tobubus
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Directions of frames in MonitorEvent.
+const (
+	FrameReceived = "received"
+	FrameSent     = "sent"
+)
+
+// MonitorEvent is the frame that Host received from or sent to the plugin.
+type MonitorEvent struct {
+	Time      time.Time         `codec:"time"`
+	Direction string            `codec:"direction"` // FrameReceived or FrameSent (from the view of host)
+	PluginID  string            `codec:"plugin,omitempty"`
+	Type      MessageType       `codec:"type"`
+	SessionID uint32            `codec:"session"`
+	Path      string            `codec:"path,omitempty"`   // path of CallMethod, Publish, etc. Replies of CallMethod have the path of the call.
+	Method    string            `codec:"method,omitempty"` // method of CallMethod and its reply
+	Params    []interface{}     `codec:"params,omitempty"`
+	Results   []interface{}     `codec:"results,omitempty"`
+	Metadata  map[string]string `codec:"metadata,omitempty"`
+	Error     string            `codec:"error,omitempty"` // body of error results
+}
+
+func (e *MonitorEvent) String() string {
+	arrow := "<-"
+	if e.Direction == FrameSent {
+		arrow = "->"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s %s %s #%d", e.Time.Format("15:04:05.000000"), arrow, e.PluginID, e.Type, e.SessionID)
+	if e.Path != "" {
+		fmt.Fprintf(&b, " %s", e.Path)
+	}
+	if e.Method != "" {
+		fmt.Fprintf(&b, "#%s", e.Method)
+	}
+	if e.Params != nil {
+		fmt.Fprintf(&b, " params=%v", e.Params)
+	}
+	if e.Results != nil {
+		fmt.Fprintf(&b, " results=%v", e.Results)
+	}
+	if len(e.Metadata) > 0 {
+		fmt.Fprintf(&b, " metadata=%v", e.Metadata)
+	}
+	if e.Error != "" {
+		fmt.Fprintf(&b, " error=%q", e.Error)
+	}
+	return b.String()
+}
+
+// MonitorFilter selects the frames to monitor. Entries are patterns of path.Match ("*" matches all).
+// Empty lists match all frames. Frames without paths (e.g. stream chunks) don't match Paths.
+type MonitorFilter struct {
+	PluginIDs []string `codec:"plugins,omitempty"`
+	Paths     []string `codec:"paths,omitempty"`
+}
+
+func (f *MonitorFilter) match(event *MonitorEvent) bool {
+	return matchAny(f.PluginIDs, event.PluginID) && matchAny(f.Paths, event.Path)
+}
+
+func matchAny(patterns []string, name string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if matchPattern(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+type monitor struct {
+	filter   MonitorFilter
+	callback func(event *MonitorEvent)
+}
+
+type monitoredSocket struct {
+	pluginID string
+	codec    Codec
+}
+
+// monitorCall is the key of CallMethod waiting for the reply.
+type monitorCall struct {
+	socket    net.Conn
+	session   uint32
+	direction string
+}
+
+// monitorSet keeps monitors of Host. It has its own lock because frames are sent while Host holds its lock.
+type monitorSet struct {
+	logging  *logging // redacts params and results of events
+	lock     sync.RWMutex
+	monitors map[*monitor]bool
+	remotes  map[net.Conn]*remoteMonitor // monitor plugins. Their frames are not monitored.
+	sockets  map[net.Conn]monitoredSocket
+	calls    map[monitorCall][2]string // path and method
+}
+
+func (s *monitorSet) add(m *monitor) func() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.monitors == nil {
+		s.monitors = make(map[*monitor]bool)
+		s.remotes = make(map[net.Conn]*remoteMonitor)
+		s.calls = make(map[monitorCall][2]string)
+	}
+	s.monitors[m] = true
+	return func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		delete(s.monitors, m)
+	}
+}
+
+// setPlugin registers the plugin ID and codec to decode frames of socket.
+func (s *monitorSet) setPlugin(socket net.Conn, pluginID string, c Codec) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.sockets == nil {
+		s.sockets = make(map[net.Conn]monitoredSocket)
+	}
+	s.sockets[socket] = monitoredSocket{pluginID: pluginID, codec: c}
+}
+
+// closeSocket forgets socket and stops the monitor plugin of socket.
+func (s *monitorSet) closeSocket(socket net.Conn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.sockets, socket)
+	if remote, ok := s.remotes[socket]; ok {
+		delete(s.monitors, remote.monitor)
+		delete(s.remotes, socket)
+		close(remote.done)
+	}
+	for call := range s.calls {
+		if call.socket == socket {
+			delete(s.calls, call)
+		}
+	}
+}
+
+// observeFrame monitors the frame that is sent via socket.
+func (s *monitorSet) observeFrame(socket net.Conn, data []byte) {
+	if len(data) < 12 || !s.active() {
+		return
+	}
+	s.observe(socket, FrameSent, &message{
+		Type: MessageType(binary.LittleEndian.Uint32(data)),
+		ID:   binary.LittleEndian.Uint32(data[4:]),
+		body: data[12:],
+	})
+}
+
+func (s *monitorSet) active() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return len(s.monitors) > 0
+}
+
+// observe passes the frame to monitors that match it.
+func (s *monitorSet) observe(socket net.Conn, direction string, msg *message) {
+	if !s.active() {
+		return
+	}
+	s.lock.Lock()
+	if len(s.monitors) == 0 || s.remotes[socket] != nil {
+		s.lock.Unlock()
+		return
+	}
+	event := s.decode(socket, direction, msg)
+	var monitors []*monitor
+	for m := range s.monitors {
+		if m.filter.match(event) {
+			monitors = append(monitors, m)
+		}
+	}
+	s.lock.Unlock()
+	for _, m := range monitors {
+		m.callback(event)
+	}
+}
+
+// decode converts the frame to MonitorEvent. It should be called with lock.
+func (s *monitorSet) decode(socket net.Conn, direction string, msg *message) *MonitorEvent {
+	info, ok := s.sockets[socket]
+	if !ok {
+		info.codec = CborCodec
+	}
+	event := &MonitorEvent{
+		Time:      time.Now(),
+		Direction: direction,
+		PluginID:  info.pluginID,
+		Type:      msg.Type,
+		SessionID: msg.ID,
+	}
+	switch msg.Type {
+	case CallMethod, NotifyMethod, ReturnMethod, ReturnStream:
+		method, err := parseMethodCallMessage(info.codec, msg.body)
+		if err != nil {
+			event.Error = err.Error()
+			break
+		}
+		event.Metadata = method.Metadata
+		if msg.Type == CallMethod || msg.Type == NotifyMethod {
+			event.Path, event.Method, event.Params = method.Path, method.Method, method.Params
+		}
+		if msg.Type == CallMethod {
+			s.calls[monitorCall{socket: socket, session: msg.ID, direction: direction}] = [2]string{method.Path, method.Method}
+		} else if msg.Type != NotifyMethod {
+			event.Results = method.Params
+		}
+	case ConnectClient:
+		event.PluginID, _, _ = parseConnectClientBody(msg.body)
+	case ConfirmPath, Publish, Unpublish, Acquire, Release:
+		event.Path = string(msg.body)
+	default:
+		if msg.Type < ConnectClient && len(msg.body) > 0 && msg.Type != ResultOK {
+			event.Error = string(msg.body)
+		}
+	}
+	if isReply(msg.Type) {
+		// the call was sent in the opposite direction
+		callDirection := FrameReceived
+		if direction == FrameReceived {
+			callDirection = FrameSent
+		}
+		key := monitorCall{socket: socket, session: msg.ID, direction: callDirection}
+		if call, ok := s.calls[key]; ok {
+			event.Path, event.Method = call[0], call[1]
+			delete(s.calls, key)
+		}
+	}
+	s.redact(event)
+	return event
+}
+
+// redact replaces params and results of the event by ParamRedactor like logs.
+func (s *monitorSet) redact(event *MonitorEvent) {
+	if s.logging == nil || (event.Params == nil && event.Results == nil) {
+		return
+	}
+	info := &CallInfo{
+		SessionID:    event.SessionID,
+		Path:         event.Path,
+		Method:       event.Method,
+		Notification: event.Type == NotifyMethod,
+		Metadata:     event.Metadata,
+	}
+	// the caller is the plugin if the call is received or the reply is sent
+	if (event.Direction == FrameReceived) == (event.Params != nil) {
+		info.PluginID = event.PluginID
+	}
+	if event.Params != nil {
+		event.Params = s.logging.redact(info, event.Params)
+	}
+	if event.Results != nil {
+		event.Results = s.logging.redact(info, event.Results)
+	}
+}
+
+// remoteMonitor sends MonitorEvent to the plugin that requested Monitor.
+// Events are dropped if the plugin can't receive them fast enough.
+type remoteMonitor struct {
+	monitor *monitor
+	events  chan *MonitorEvent
+	done    chan struct{}
+}
+
+// addRemote starts sending events to socket in MonitorFrame with sessionID.
+func (s *monitorSet) addRemote(socket net.Conn, sessionID uint32, c Codec, filter MonitorFilter, logging *logging) {
+	remote := &remoteMonitor{events: make(chan *MonitorEvent, 256), done: make(chan struct{})}
+	remote.monitor = &monitor{filter: filter, callback: func(event *MonitorEvent) {
+		select {
+		case remote.events <- event:
+		case <-remote.done:
+		default:
+		}
+	}}
+	s.add(remote.monitor)
+	s.lock.Lock()
+	s.remotes[socket] = remote
+	s.lock.Unlock()
+	go func() {
+		for {
+			select {
+			case event := <-remote.events:
+				data, err := c.Encode(event)
+				if err != nil {
+					logging.get().Warn("can't encode monitor event", slog.String("type", event.Type.String()), slog.Any("error", err))
+					continue
+				}
+				logging.write(socket, archiveMessage(MonitorFrame, sessionID, data))
+			case <-remote.done:
+				return
+			}
+		}
+	}()
+}
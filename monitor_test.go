@@ -0,0 +1,148 @@
+package tobubus
+
+import (
+	"strings"
+	"sync"
+	"testing"
+)
+
+type eventRecorder struct {
+	lock   sync.Mutex
+	events []*MonitorEvent
+}
+
+func (r *eventRecorder) record(event *MonitorEvent) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.events = append(r.events, event)
+}
+
+func (r *eventRecorder) find(direction string, msgType MessageType) *MonitorEvent {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, event := range r.events {
+		if event.Direction == direction && event.Type == msgType {
+			return event
+		}
+	}
+	return nil
+}
+
+func startMonitorTest(t *testing.T, address string) (*Host, *Plugin, *InProcessTransport) {
+	transport := NewInProcessTransport()
+	host := NewHostWithTransport(address, transport)
+	host.Publish("/host", &testStruct{result: "ok"})
+	host.Publish("/other", &testStruct{result: "other"})
+	err := host.Listen()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	plugin, err := NewPluginWithTransport(address, "github.com/shibukawa/tobubus/caller", transport)
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	err = plugin.Connect()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	return host, plugin, transport
+}
+
+func TestHostMonitor(t *testing.T) {
+	host, plugin, _ := startMonitorTest(t, "tobubus.monitor")
+	defer host.Close()
+	defer plugin.Close()
+	var recorder eventRecorder
+	stop := host.Monitor(MonitorFilter{Paths: []string{"/host"}}, recorder.record)
+	plugin.Call("/host", "TestMethod", "arg")
+	plugin.Call("/other", "TestMethod", "arg")
+	var reply *MonitorEvent
+	waitUntil(func() bool {
+		reply = recorder.find(FrameSent, ReturnMethod)
+		return reply != nil
+	})
+	call := recorder.find(FrameReceived, CallMethod)
+	if call == nil || call.PluginID != "github.com/shibukawa/tobubus/caller" || call.Path != "/host" || call.Method != "TestMethod" || call.Params[0] != "arg" {
+		t.Errorf("call should be monitored, but %v", call)
+	}
+	if reply == nil || reply.Path != "/host" || reply.Method != "TestMethod" || reply.Results[0] != "ok" || reply.SessionID != call.SessionID {
+		t.Errorf("reply should be monitored with the path of call, but %v", reply)
+	}
+	recorder.lock.Lock()
+	for _, event := range recorder.events {
+		if event.Path != "/host" {
+			t.Errorf("filter should drop other paths, but %v", event)
+		}
+	}
+	count := len(recorder.events)
+	recorder.lock.Unlock()
+	stop()
+	plugin.Call("/host", "TestMethod", "arg")
+	recorder.lock.Lock()
+	if len(recorder.events) != count {
+		t.Errorf("stopped monitor should not receive events, but %d", len(recorder.events))
+	}
+	recorder.lock.Unlock()
+	if !strings.Contains(call.String(), "<- github.com/shibukawa/tobubus/caller CallMethod") {
+		t.Errorf("event is not formatted: %s", call)
+	}
+}
+
+func TestPluginMonitor(t *testing.T) {
+	host, plugin, transport := startMonitorTest(t, "tobubus.monitor.remote")
+	defer host.Close()
+	defer plugin.Close()
+	host.SetRemoteMonitor(true)
+	host.SetParamRedactor(RedactAllParams)
+	monitor, err := NewPluginWithTransport("tobubus.monitor.remote", "github.com/shibukawa/tobubus/monitor", transport)
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	err = monitor.Connect()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	defer monitor.Close()
+	var recorder eventRecorder
+	err = monitor.Monitor(MonitorFilter{PluginIDs: []string{"github.com/shibukawa/*/caller"}}, recorder.record)
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	plugin.Call("/host", "TestMethod", "arg")
+	var reply *MonitorEvent
+	waitUntil(func() bool {
+		reply = recorder.find(FrameSent, ReturnMethod)
+		return reply != nil
+	})
+	if reply == nil || reply.PluginID != "github.com/shibukawa/tobubus/caller" || reply.Method != "TestMethod" || reply.Results[0] != "string" {
+		t.Errorf("monitor plugin should receive the redacted reply, but %v", reply)
+	}
+	if call := recorder.find(FrameReceived, CallMethod); call == nil || call.Params[0] != "string" {
+		t.Errorf("monitor plugin should receive the redacted call, but %v", call)
+	}
+	if reply != nil && reply.Time.IsZero() {
+		t.Error("time should be sent")
+	}
+}
+
+func TestPluginMonitorDeniedByPolicy(t *testing.T) {
+	host, plugin, _ := startMonitorTest(t, "tobubus.monitor.denied")
+	defer host.Close()
+	defer plugin.Close()
+	// monitoring is disabled by default
+	err := plugin.Monitor(MonitorFilter{}, func(event *MonitorEvent) {})
+	if err == nil || !strings.Contains(err.Error(), "denied") {
+		t.Errorf("monitor should be denied, but %v", err)
+	}
+	host.SetRemoteMonitor(true)
+	host.SetPolicy(NewPolicy(PolicyRule{Plugin: "*", Call: []string{"*"}}))
+	err = plugin.Monitor(MonitorFilter{}, func(event *MonitorEvent) {})
+	if err == nil || !strings.Contains(err.Error(), "denied") {
+		t.Errorf("monitor should be denied by policy, but %v", err)
+	}
+	host.SetPolicy(NewPolicy(PolicyRule{Plugin: "github.com/shibukawa/*/caller", Monitor: true}))
+	err = plugin.Monitor(MonitorFilter{}, func(event *MonitorEvent) {})
+	if err != nil {
+		t.Errorf("monitor should be allowed, but %v", err)
+	}
+}
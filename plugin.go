@@ -1,13 +1,14 @@
 package tobubus
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"github.com/k0kubun/pp"
-	"github.com/shibukawa/localsocket"
-	"log"
+	"log/slog"
 	"net"
+	"strings"
 	"sync"
+	"time"
 )
 
 type Plugin struct {
@@ -16,9 +17,24 @@ type Plugin struct {
 	socket    net.Conn
 	connected bool
 	sessions  *sessionManager
+	streams   *streamTable
+	leases    *leaseTable
 	lock      sync.RWMutex
 
-	objectMap map[string]*Proxy
+	objectMap    map[string]*Proxy
+	maxFrameSize uint32
+	codec        Codec
+	token        string
+	logging      logging
+	metrics      metrics
+	tracer       Tracer
+	recording    recording
+	dispatcher   dispatcher
+
+	clientInterceptors []Interceptor
+	serverInterceptors []Interceptor
+	references         referenceCounter
+	monitors           map[uint32]func(event *MonitorEvent) // session ID of Monitor -> callback
 }
 
 // NewPlugin creates Plugin instance.
@@ -29,17 +45,127 @@ type Plugin struct {
 //
 // Second argument is a ID of plugin
 func NewPlugin(pipeName, id string) (*Plugin, error) {
-	socket, err := localsocket.NewLocalSocket(pipeName)
+	return NewPluginWithTransport(pipeName, id, LocalTransport)
+}
+
+// NewPluginWithTransport creates Plugin instance that connects to the host at the address via transport.
+func NewPluginWithTransport(address, id string, transport Transport) (*Plugin, error) {
+	socket, err := transport.Dial(address)
 	if err != nil {
 		return nil, err
 	}
-	return &Plugin{
-		pipeName:  pipeName,
-		id:        id,
-		socket:    socket,
-		objectMap: make(map[string]*Proxy),
-		sessions:  newSessionManager(recycleStrategy),
-	}, nil
+	return newPlugin(address, id, socket), nil
+}
+
+func newPlugin(address, id string, socket net.Conn) *Plugin {
+	plugin := &Plugin{
+		pipeName:     address,
+		id:           id,
+		objectMap:    make(map[string]*Proxy),
+		sessions:     newSessionManager(recycleStrategy),
+		streams:      newStreamTable(),
+		leases:       newLeaseTable(),
+		maxFrameSize: DefaultMaxFrameSize,
+		codec:        CborCodec,
+	}
+	plugin.socket = plugin.metrics.conn(socket, plugin.recording.sent)
+	return plugin
+}
+
+// SetCodec selects the codec of method call messages. It should be called before connecting to host.
+//
+// Host should know the codec (built-in codecs or codecs registered by RegisterCodec).
+func (p *Plugin) SetCodec(c Codec) error {
+	if c == nil {
+		return errors.New("codec should not be nil")
+	}
+	if p.connected {
+		return errors.New("Plugin is already connected to host")
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.codec = c
+	return nil
+}
+
+// SetDispatcher limits the method calls from host that run at the same time. workers goroutines call methods
+// and up to queueSize calls wait for them. Calls over the limit are answered with ResultNG.
+// workers 0 (default) runs each call in its own goroutine. Unordered entries of CallBatch share the workers' limit.
+//
+// A method that makes a nested call to the other side keeps its worker until the reply. If the other side calls back
+// while all workers are busy, the callback waits in the queue and the calls deadlock.
+func (p *Plugin) SetDispatcher(workers, queueSize int) {
+	p.dispatcher.configure(workers, queueSize)
+}
+
+// UseClientInterceptor adds interceptors around Call.
+func (p *Plugin) UseClientInterceptor(interceptors ...Interceptor) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.clientInterceptors = append(p.clientInterceptors, interceptors...)
+}
+
+// UseServerInterceptor adds interceptors around the method calls from host.
+func (p *Plugin) UseServerInterceptor(interceptors ...Interceptor) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.serverInterceptors = append(p.serverInterceptors, interceptors...)
+}
+
+// SetLogger sets the logger of connection, protocol and dispatch events. nil uses slog.Default().
+//
+// Levels are configured by the handler of logger. Successful calls are logged at debug level.
+func (p *Plugin) SetLogger(logger *slog.Logger) {
+	p.logging.setLogger(logger)
+}
+
+// SetParamRedactor sets the function that replaces params before they are logged.
+func (p *Plugin) SetParamRedactor(redactor ParamRedactor) {
+	p.logging.setRedactor(redactor)
+}
+
+// SetTracer sets the tracer that starts spans around calls. nil disables tracing (default),
+// but the trace context received from host is still passed to the nested calls.
+func (p *Plugin) SetTracer(tracer Tracer) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.tracer = tracer
+}
+
+// SetToken sets the token that is sent to host when connecting. Transports like WebSocket authenticate plugins by it.
+func (p *Plugin) SetToken(token string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.token = token
+}
+
+// SetMaxFrameSize sets the maximum body size of frames the plugin receives from and sends to the host.
+// Larger frames from the host are skipped and answered with ResultProtocolError.
+func (p *Plugin) SetMaxFrameSize(size uint32) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.maxFrameSize = size
+}
+
+// SetRecorder starts recording frames of the connection to recorder. nil stops recording.
+// Recordings are not redacted (see Recorder).
+func (p *Plugin) SetRecorder(recorder *Recorder) {
+	p.recording.set(recorder)
+}
+
+// Stats returns the snapshot of metrics of calls, connection and traffic.
+func (p *Plugin) Stats() Stats {
+	stats := p.metrics.stats(p.sessions)
+	if p.connected && p.socket != nil {
+		stats.ConnectedPlugins = 1
+	}
+	return stats
+}
+
+func (p *Plugin) getMaxFrameSize() uint32 {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.maxFrameSize
 }
 
 // Register methods notifies to host that plugin is ready to work
@@ -47,13 +173,17 @@ func (p *Plugin) Connect() (err error) {
 	if p.socket == nil {
 		return errors.New("Socket is already closed")
 	}
+	socket := p.socket
 	go func() {
 		for {
-			err = p.receiveMessage()
+			err := p.receiveMessage()
 			if err != nil {
 				break
 			}
 		}
+		p.streams.closeSocket(socket)
+		p.sessions.closeSocket(socket)
+		p.releaseLeases(socket)
 	}()
 	err = p.connect()
 	if err != nil {
@@ -69,10 +199,14 @@ func (p *Plugin) ConnectAndServe() (err error) {
 		return errors.New("Socket is already closed")
 	}
 	wait := make(chan error)
+	socket := p.socket
 	go func() {
 		for {
-			err = p.receiveMessage()
+			err := p.receiveMessage()
 			if err != nil {
+				p.streams.closeSocket(socket)
+				p.sessions.closeSocket(socket)
+				p.releaseLeases(socket)
 				wait <- err
 				break
 			}
@@ -93,9 +227,14 @@ func (p *Plugin) Close() error {
 		return errors.New("Socket is already closed")
 	}
 	sessionID := p.sessions.getUniqueSessionID()
-	socket.Write(archiveMessage(CloseClient, sessionID, nil))
+	_, err := socket.Write(archiveMessage(CloseClient, sessionID, nil))
+	if err != nil {
+		// already closed by host
+		p.sessions.closeSession(sessionID)
+		return err
+	}
 	message := p.sessions.receiveAndClose(sessionID)
-	err := socket.Close()
+	err = socket.Close()
 	if err != nil {
 		return err
 	}
@@ -116,14 +255,68 @@ func (p *Plugin) ConfirmPath(path string) bool {
 	return message.Type == ResultOK
 }
 
-func (p *Plugin) Publish(path string, service interface{}) error {
+// Monitor receives the frames the host exchanges with other plugins that match filter until the plugin is disconnected.
+// The host denies it unless it is enabled by Host.SetRemoteMonitor or allowed by Policy.
+//
+// callback is called in order from the goroutine that receives messages. It shouldn't block or call methods of the host.
+func (p *Plugin) Monitor(filter MonitorFilter, callback func(event *MonitorEvent)) error {
+	if p.socket == nil {
+		return errors.New("Socket is already closed")
+	}
+	body, err := p.codec.Encode(filter)
+	if err != nil {
+		return err
+	}
+	// the session is kept while monitoring because MonitorFrame uses its ID
+	sessionID := p.sessions.getUniqueSessionID()
+	p.lock.Lock()
+	if p.monitors == nil {
+		p.monitors = make(map[uint32]func(event *MonitorEvent))
+	}
+	p.monitors[sessionID] = callback
+	p.lock.Unlock()
+	p.socket.Write(archiveMessage(Monitor, sessionID, body))
+	message := p.sessions.receive(sessionID)
+	if message.Type != ResultOK {
+		p.lock.Lock()
+		delete(p.monitors, sessionID)
+		p.lock.Unlock()
+		p.sessions.closeSession(sessionID)
+		if message.Type == ResultAccessDenied {
+			return errors.New("Monitoring is denied")
+		}
+		return fmt.Errorf("Can't monitor '%s'", p.pipeName)
+	}
+	return nil
+}
+
+// ListPaths returns the sorted paths of objects published by the host.
+func (p *Plugin) ListPaths() ([]string, error) {
+	if p.socket == nil {
+		return nil, errors.New("Socket is already closed")
+	}
+	sessionID := p.sessions.getUniqueSessionID()
+	p.socket.Write(archiveMessage(ListPaths, sessionID, nil))
+	message := p.sessions.receiveAndClose(sessionID)
+	if message.Type != ResultOK {
+		return nil, fmt.Errorf("Can't list paths of '%s'", p.pipeName)
+	}
+	if len(message.body) == 0 {
+		return nil, nil
+	}
+	return strings.Split(string(message.body), "\x00"), nil
+}
+
+// Publish publishes the object at path. options choose how the object receives calls from host
+// (Concurrent, Serialized or WithExecutor). It should be called before connecting to host.
+func (p *Plugin) Publish(path string, service interface{}, options ...PublishOption) error {
 	if p.socket == nil {
 		return errors.New("Socket is already closed")
 	}
 	if p.connected {
 		return errors.New("Plugin is already connected to host")
 	}
-	proxy, err := NewProxy(service)
+	proxy, err := newProxyWithOptions(service, options)
 	if err != nil {
 		return err
 	}
@@ -133,101 +326,550 @@ func (p *Plugin) Publish(path string, service interface{}) error {
 	return nil
 }
 
+// PublishLeased publishes the object in leased mode. Unlike Publish, it is available after connecting to host.
+//
+// Host gets the handle of the object via Host.Acquire (or as a reference) and releases it via RemoteObject.Close.
+// The object is unpublished when all handles are released or the plugin is disconnected.
+func (p *Plugin) PublishLeased(path string, service interface{}, options ...PublishOption) error {
+	if p.socket == nil {
+		return errors.New("Socket is already closed")
+	}
+	proxy, err := newProxyWithOptions(service, options)
+	if err != nil {
+		return err
+	}
+	p.lock.Lock()
+	p.objectMap[path] = proxy
+	p.lock.Unlock()
+	p.leases.add(path)
+	if p.connected {
+		return p.publish(path, proxy)
+	}
+	return nil
+}
+
+// Acquire returns the handle of the object. If the object is published by host in leased mode,
+// the host keeps the object until the handle is closed.
+func (p *Plugin) Acquire(path string) (*RemoteObject, error) {
+	if p.socket == nil {
+		return nil, errors.New("Socket is already closed")
+	}
+	p.lock.RLock()
+	_, ok := p.objectMap[path]
+	p.lock.RUnlock()
+	if ok {
+		return newRemoteObject(path, p, nil), nil
+	}
+	socket := p.socket
+	sessionID := p.sessions.getUniqueSessionID()
+	socket.Write(archiveMessage(Acquire, sessionID, []byte(path)))
+	message := p.sessions.receiveAndClose(sessionID)
+	if message.Type != ResultOK {
+		return nil, fmt.Errorf("Can't acquire object at '%s'", path)
+	}
+	return newRemoteObject(path, p, releaseFunc(socket, path)), nil
+}
+
 func (p *Plugin) ID() string {
 	return p.id
 }
 
 func (p *Plugin) Call(path, methodName string, params ...interface{}) ([]interface{}, error) {
+	return p.CallContext(context.Background(), path, methodName, params...)
+}
+
+// CallContext calls the method like Call. The call continues the trace in ctx (see SpanContextFromContext)
+// and sends the metadata in ctx (see ContextWithMetadata).
+//
+// Published methods that take context.Context should pass it to CallContext to trace their nested calls.
+func (p *Plugin) CallContext(ctx context.Context, path, methodName string, params ...interface{}) ([]interface{}, error) {
+	return p.call(ctx, nil, path, methodName, params)
+}
+
+// CallAsync calls the method in another goroutine and returns immediately.
+//
+//	calls := []*tobubus.PendingCall{
+//	    plugin.CallAsync("/a", "Method"),
+//	    plugin.CallAsync("/b", "Method"),
+//	}
+//	err := tobubus.WaitAll(calls...)
+func (p *Plugin) CallAsync(path, methodName string, params ...interface{}) *PendingCall {
+	return p.CallAsyncContext(context.Background(), path, methodName, params...)
+}
+
+// CallAsyncContext calls the method like CallAsync with the trace and the metadata in ctx.
+func (p *Plugin) CallAsyncContext(ctx context.Context, path, methodName string, params ...interface{}) *PendingCall {
+	pending := newPendingCall()
+	go func() {
+		result, err := p.call(ctx, pending.canceled, path, methodName, params)
+		pending.finish(result, err)
+	}()
+	return pending
+}
+
+// call is the body of CallContext and CallAsyncContext. Remote calls stop waiting the reply when canceled is closed.
+func (p *Plugin) call(ctx context.Context, canceled <-chan struct{}, path, methodName string, params []interface{}) ([]interface{}, error) {
 	if p.socket == nil {
 		return nil, errors.New("Socket is already closed")
 	}
 	p.lock.RLock()
+	interceptors := p.clientInterceptors
+	tracer := p.tracer
+	p.lock.RUnlock()
+	info := newCallInfo(ctx, p.id, path, methodName)
+	info.canceled = canceled
+	span := startSpan(tracer, SpanContextFromContext(ctx), SpanClient, info)
+	result, err := chainInterceptors(interceptors, p.invoke)(info, params)
+	endSpan(span, err)
+	if trailer := trailerFromContext(ctx); trailer != nil {
+		mergeMetadata(trailer, info.Trailer)
+	}
+	return result, err
+}
+
+// invoke calls the method of local object or host's object. It is the last of client interceptors.
+func (p *Plugin) invoke(info *CallInfo, params []interface{}) ([]interface{}, error) {
+	path, methodName := info.Path, info.Method
+	p.lock.RLock()
 	obj, ok := p.objectMap[path]
 	p.lock.RUnlock()
 	if ok {
-		return obj.Call(methodName, params...)
+		return obj.CallWithInfo(info, methodName, params...)
 	}
-	sessionID := p.sessions.getUniqueSessionID()
-	data, err := archiveMethodCallMessage(CallMethod, sessionID, path, methodName, params)
+	params, err := exportReferences(params, p.publishReference)
 	if err != nil {
 		return nil, err
 	}
-	_, err = p.socket.Write(data)
+	start := time.Now()
+	message, stream, err := callRemote(p.socket, p.sessions, p.streams, p.codec, p.getMaxFrameSize(), path, methodName, callMetadata(info), params, info.canceled)
+	if message != nil {
+		p.metrics.recordCall(CallSent, path, methodName, replyResult(message), start)
+	}
 	if err != nil {
 		return nil, err
 	}
-	message := p.sessions.receiveAndClose(sessionID)
-	result := parseMethodCallMessage(message.body)
+	if stream != nil {
+		value, err := stream.collect()
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{value}, nil
+	}
+	result, err := parseMethodCallMessage(p.codec, message.body)
+	if err != nil {
+		return nil, err
+	}
+	if info.Trailer != nil {
+		mergeMetadata(info.Trailer, result.Metadata)
+	}
+	importReferences(result.Params, p.resolveReference)
 	return result.Params, nil
 }
 
-func (p *Plugin) receiveMessage() error {
+// Notify calls the method without waiting for the result. The host doesn't reply, so errors of the method
+// (e.g. missing object) are only logged by the host. Notify returns the error of sending the notification.
+//
+// Methods of local objects are called in another goroutine. Streams can't be passed to notifications.
+func (p *Plugin) Notify(path, methodName string, params ...interface{}) error {
+	return p.NotifyContext(context.Background(), path, methodName, params...)
+}
+
+// NotifyContext sends the notification like Notify with the trace and the metadata in ctx.
+func (p *Plugin) NotifyContext(ctx context.Context, path, methodName string, params ...interface{}) error {
 	if p.socket == nil {
 		return errors.New("Socket is already closed")
 	}
-	msg, err := parseMessage(p.socket)
+	p.lock.RLock()
+	interceptors := p.clientInterceptors
+	tracer := p.tracer
+	p.lock.RUnlock()
+	info := newCallInfo(ctx, p.id, path, methodName)
+	info.Notification = true
+	span := startSpan(tracer, SpanContextFromContext(ctx), SpanClient, info)
+	_, err := chainInterceptors(interceptors, p.notify)(info, params)
+	endSpan(span, err)
+	return err
+}
+
+// notify sends the notification to local object or host's object. It is the last of client interceptors.
+func (p *Plugin) notify(info *CallInfo, params []interface{}) ([]interface{}, error) {
+	path, methodName := info.Path, info.Method
+	p.lock.RLock()
+	obj, ok := p.objectMap[path]
+	p.lock.RUnlock()
+	if ok {
+		notifyLocal(&p.logging, obj, info, params)
+		return nil, nil
+	}
+	params, err := exportReferences(params, p.publishReference)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	start := time.Now()
+	err = notifyRemote(p.socket, p.codec, p.getMaxFrameSize(), path, methodName, callMetadata(info), params)
+	if err != nil {
+		return nil, err
+	}
+	p.metrics.recordCall(CallSent, path, methodName, ResultOK, start)
+	return nil, nil
+}
+
+// CallBatch calls the methods in one frame and returns their results in the order of calls.
+// All entries should be host objects or local objects. Host doesn't forward entries to other plugins.
+//
+// Errors of entries are returned in BatchResult. The error is returned only if the batch itself fails.
+// Client interceptors are called for the entries on local objects like Call. Streams can't be passed or returned.
+func (p *Plugin) CallBatch(calls []BatchCall, options BatchOptions) ([]BatchResult, error) {
+	return p.CallBatchContext(context.Background(), calls, options)
+}
+
+// CallBatchContext calls the methods like CallBatch with the trace and the metadata in ctx.
+func (p *Plugin) CallBatchContext(ctx context.Context, calls []BatchCall, options BatchOptions) ([]BatchResult, error) {
+	if p.socket == nil {
+		return nil, errors.New("Socket is already closed")
+	}
+	p.lock.RLock()
+	local := 0
+	for _, call := range calls {
+		if _, ok := p.objectMap[call.Path]; ok {
+			local++
+		}
+	}
+	tracer := p.tracer
+	interceptors := p.clientInterceptors
+	p.lock.RUnlock()
+	if local > 0 && local < len(calls) {
+		return nil, errors.New("Batch calls should be sent to host or local objects.")
+	}
+	info := newCallInfo(ctx, p.id, "", "CallBatch")
+	span := startSpan(tracer, SpanContextFromContext(ctx), SpanClient, info)
+	if local > 0 {
+		results := callBatchLocal(calls, options, info, func(path string) *Proxy {
+			p.lock.RLock()
+			defer p.lock.RUnlock()
+			return p.objectMap[path]
+		}, chainInterceptors(interceptors, p.invoke), p.logging.get())
+		endSpan(span, nil)
+		return results, nil
+	}
+	results, err := callBatchRemote(p.socket, p.sessions, p.codec, p.getMaxFrameSize(), calls, options, callMetadata(info), func(params []interface{}) ([]interface{}, error) {
+		return exportReferences(params, p.publishReference)
+	}, &p.metrics)
+	endSpan(span, err)
+	return results, err
+}
+
+// callBatchEntry calls an entry of CallBatch sent by the host.
+func (p *Plugin) callBatchEntry(sessionID uint32, entry *methodCall) *batchEntryResult {
+	start := time.Now()
+	importReferences(entry.Params, p.resolveReference)
+	p.lock.RLock()
+	obj := p.objectMap[entry.Path]
+	interceptors := p.serverInterceptors
+	tracer := p.tracer
+	p.lock.RUnlock()
+	info := &CallInfo{
+		SessionID: sessionID,
+		Path:      entry.Path,
+		Method:    entry.Method,
+		Metadata:  entry.Metadata,
+		Trailer:   make(map[string]string),
+	}
+	span := startSpan(tracer, traceFromMetadata(entry.Metadata), SpanServer, info)
+	logger := p.logging.get().With(slog.String("path", info.Path), slog.String("method", info.Method), slog.Uint64("session", uint64(sessionID)))
+	result := callBatchEntry(obj, chainInterceptors(interceptors, obj.dispatch), info, entry.Params, logger)
+	if result.Type == ReturnMethod {
+		var err error
+		if result.Params, err = exportReferences(result.Params, p.publishReference); err != nil {
+			logger.Error("can't pass result by reference", slog.Any("error", err))
+			result = &batchEntryResult{Type: ResultNG}
+		}
+	}
+	p.metrics.recordCall(CallReceived, info.Path, info.Method, result.resultType(), start)
+	endSpan(span, callResultError(result.resultType(), info))
+	return result
+}
+
+// CallStream calls the method that returns a stream (receivable channel or io.Reader).
+//
+// The stream is sent in chunks and the returned Stream receives them. Stream should be closed
+// if it is not read until the end.
+func (p *Plugin) CallStream(path, methodName string, params ...interface{}) (*Stream, error) {
+	if p.socket == nil {
+		return nil, errors.New("Socket is already closed")
+	}
+	p.lock.RLock()
+	obj, ok := p.objectMap[path]
+	p.lock.RUnlock()
+	if ok {
+		return callLocalStream(obj, path, methodName, params)
+	}
+	params, err := exportReferences(params, p.publishReference)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	message, stream, err := callRemote(p.socket, p.sessions, p.streams, p.codec, p.getMaxFrameSize(), path, methodName, nil, params, nil)
+	if message != nil {
+		p.metrics.recordCall(CallSent, path, methodName, replyResult(message), start)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if stream == nil {
+		return nil, fmt.Errorf("Method '%s' at '%s' doesn't return stream.", methodName, path)
+	}
+	return stream, nil
+}
+
+// publishReference publishes the object passed by reference at a temporary path in leased mode.
+//
+// Host doesn't need to know the path because only host can call it via the socket.
+func (p *Plugin) publishReference(obj interface{}) (string, error) {
+	proxy, err := NewProxy(obj)
+	if err != nil {
+		return "", err
+	}
+	path := p.references.nextPath(p.id)
+	p.lock.Lock()
+	p.objectMap[path] = proxy
+	p.lock.Unlock()
+	p.leases.add(path)
+	p.leases.acquire(path, p.socket)
+	return path, nil
+}
+
+// resolveReference converts the reference received from host into object.
+// The objects published by the plugin are resolved into themselves.
+func (p *Plugin) resolveReference(path string, leased bool) interface{} {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	if obj, ok := p.objectMap[path]; ok {
+		return obj.instance
+	}
+	if leased {
+		return newRemoteObject(path, p, releaseFunc(p.socket, path))
+	}
+	return newRemoteObject(path, p, nil)
+}
+
+// releaseLeases drops all leased objects held by the host. It is called when the connection is closed.
+func (p *Plugin) releaseLeases(socket net.Conn) {
+	dropped := p.leases.releaseHolder(socket)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, path := range dropped {
+		delete(p.objectMap, path)
+	}
+}
+
+func (p *Plugin) receiveMessage() error {
+	socket := p.socket
+	if socket == nil {
+		return errors.New("Socket is already closed")
+	}
+	msg, err := parseMessage(socket, p.getMaxFrameSize())
+	if msg != nil {
+		p.metrics.receivedFrame()
+		p.recording.received(socket, msg)
+	}
+	if err != nil {
+		if _, ok := err.(*FrameSizeError); !ok {
+			return err
+		}
+		p.logging.get().Warn("frame too large", messageAttrs(msg, slog.Any("error", err))...)
+		if isReply(msg.Type) {
+			// let the waiting caller know that the reply was dropped
+			p.sessions.deliver(&message{Type: ResultProtocolError, ID: msg.ID, body: []byte(err.Error())})
+		} else {
+			p.logging.write(socket, archiveProtocolErrorMessage(msg.ID, err))
+		}
+		return nil
+	}
+	if isReply(msg.Type) {
+		p.sessions.deliver(msg)
+		return nil
+	}
+	if isStreamMessage(msg.Type) {
+		p.streams.dispatch(socket, msg)
+		return nil
 	}
 	switch msg.Type {
-	case ResultOK, ResultNG, ReturnMethod:
-		channel := p.sessions.getChannelOfSessionID(msg.ID)
-		channel <- msg
-	case CallMethod:
-		go func() {
-			method := parseMethodCallMessage(msg.body)
+	case CallMethod, NotifyMethod:
+		method, err := parseMethodCallMessage(p.codec, msg.body)
+		if err != nil {
+			p.logging.get().Warn("broken method call", messageAttrs(msg, slog.Any("error", err))...)
+			if msg.Type == CallMethod {
+				p.logging.write(socket, archiveProtocolErrorMessage(msg.ID, err))
+			}
+			break
+		}
+		importReferences(method.Params, p.resolveReference)
+		// argument streams should be ready before reading their chunks
+		replier := newReplier(socket, &p.logging, msg.Type, method)
+		argStreams := p.streams.receiveArguments(socket, msg.ID, p.codec, method.Params)
+		maxFrameSize := p.getMaxFrameSize()
+		dispatched := p.dispatcher.dispatch(func() {
 			p.lock.RLock()
 			obj, ok := p.objectMap[method.Path]
+			interceptors := p.serverInterceptors
+			tracer := p.tracer
 			p.lock.RUnlock()
+			info := &CallInfo{
+				SessionID:    msg.ID,
+				Path:         method.Path,
+				Method:       method.Method,
+				Metadata:     method.Metadata,
+				Notification: msg.Type == NotifyMethod,
+				Trailer:      make(map[string]string),
+			}
+			start := time.Now()
+			resultType := MessageType(ResultOK)
+			span := startSpan(tracer, traceFromMetadata(method.Metadata), SpanServer, info)
+			defer func() {
+				p.metrics.recordCall(CallReceived, info.Path, info.Method, resultType, start)
+				endSpan(span, callResultError(resultType, info))
+			}()
+			logger := p.logging.get().With(slog.String("path", info.Path), slog.String("method", info.Method), slog.Uint64("session", uint64(msg.ID)))
+			logger.Debug("method called")
 			if !ok {
-				p.socket.Write(archiveMessage(ResultObjectNotFound, msg.ID, nil))
+				logger.Debug("object not found")
+				resultType = ResultObjectNotFound
+				closeStreams(argStreams)
+				replier.write(archiveMessage(ResultObjectNotFound, msg.ID, nil))
 				return
 			}
 			defer func() {
 				err := recover()
 				if err != nil {
-					log.Printf("Remote Method Call Error: msgID: %d path: '%s' method: '%s'\n", msg.ID, method.Path, method.Method)
-					log.Printf("Params: %s\n", pp.Sprint(method.Params))
-					log.Printf("Error Detail: %v\n", err)
-					p.socket.Write(archiveMessage(ResultMethodError, msg.ID, nil))
+					logger.Error("method panicked", p.logging.params(info, method.Params), slog.Any("error", err))
+					resultType = ResultMethodError
+					closeStreams(argStreams)
+					replier.write(archiveMessage(ResultMethodError, msg.ID, nil))
 				}
 			}()
-			result, err := obj.Call(method.Method, method.Params...)
+			if !obj.hasMethod(method.Method) {
+				logger.Debug("method not found")
+				resultType = ResultMethodNotFound
+				closeStreams(argStreams)
+				replier.write(archiveMessage(ResultMethodNotFound, msg.ID, nil))
+				return
+			}
+			result, err := chainInterceptors(interceptors, obj.dispatch)(info, method.Params)
 			if err != nil {
-				p.socket.Write(archiveMessage(ResultMethodNotFound, msg.ID, nil))
+				logger.Debug("method call rejected", slog.Any("error", err))
+				resultType = ResultNG
+				closeStreams(argStreams)
+				replier.write(archiveMessage(ResultNG, msg.ID, []byte(err.Error())))
+			} else if result, err = exportReferences(result, p.publishReference); err != nil {
+				logger.Error("can't pass result by reference", slog.Any("error", err))
+				resultType = ResultNG
+				replier.write(archiveMessage(ResultNG, msg.ID, nil))
 			} else {
-				resultMessage, err := archiveMethodCallMessage(ReturnMethod, msg.ID, "", "", result)
-				if err != nil {
-					p.socket.Write(archiveMessage(ResultNG, msg.ID, nil))
-				}
-				p.socket.Write(resultMessage)
+				replier.sendResult(p.streams, p.codec, maxFrameSize, msg.ID, info.Trailer, result)
 			}
-		}()
+		})
+		if !dispatched {
+			p.logging.get().Warn("dispatcher is busy", messageAttrs(msg, slog.String("path", method.Path), slog.String("method", method.Method))...)
+			p.metrics.recordCall(CallReceived, unknownLabel, unknownLabel, ResultNG, time.Now())
+			closeStreams(argStreams)
+			replier.write(archiveMessage(ResultNG, msg.ID, []byte(errDispatcherBusy.Error())))
+		}
+	case CallBatch:
+		batch, err := parseBatchCallMessage(p.codec, msg.body)
+		if err != nil {
+			p.logging.get().Warn("broken batch call", messageAttrs(msg, slog.Any("error", err))...)
+			p.logging.write(socket, archiveProtocolErrorMessage(msg.ID, err))
+			break
+		}
+		maxFrameSize := p.getMaxFrameSize()
+		dispatched := p.dispatcher.dispatch(func() {
+			results := runBatch(batch, p.dispatcher.batchSlots(), func(entry *methodCall) *batchEntryResult {
+				return p.callBatchEntry(msg.ID, entry)
+			})
+			p.logging.write(socket, archiveBatchReplyMessage(p.codec, msg.ID, maxFrameSize, results))
+		})
+		if !dispatched {
+			p.logging.get().Warn("dispatcher is busy", messageAttrs(msg)...)
+			p.logging.write(socket, archiveMessage(ResultNG, msg.ID, []byte(errDispatcherBusy.Error())))
+		}
 	case CloseClient:
-		socket := p.socket
 		p.socket = nil
-		socket.Write(archiveMessage(ResultOK, msg.ID, nil))
+		p.logging.write(socket, archiveMessage(ResultOK, msg.ID, nil))
+		p.logging.get().Info("disconnected by host", slog.String("plugin", p.id))
 		err := socket.Close()
 		if err != nil {
 			return err
 		}
 		return errors.New("socket closed")
-	case ConfirmPath:
-		p.socket.Write(archiveMessage(ResultNG, msg.ID, nil))
+	case Acquire:
+		path := string(msg.body)
+		p.lock.RLock()
+		_, ok := p.objectMap[path]
+		p.lock.RUnlock()
+		if ok {
+			p.leases.acquire(path, socket)
+			p.logging.write(socket, archiveMessage(ResultOK, msg.ID, nil))
+		} else {
+			p.logging.write(socket, archiveMessage(ResultObjectNotFound, msg.ID, nil))
+		}
+	case Release:
+		path := string(msg.body)
+		if p.leases.release(path, socket) {
+			p.lock.Lock()
+			delete(p.objectMap, path)
+			p.lock.Unlock()
+		}
+	case Unpublish:
+		// another plugin took over the path
+		path := string(msg.body)
+		p.lock.Lock()
+		delete(p.objectMap, path)
+		p.lock.Unlock()
+		p.leases.remove(path)
+		p.logging.write(socket, archiveMessage(ResultOK, msg.ID, nil))
+		p.logging.get().Info("unpublished by host", slog.String("plugin", p.id), slog.String("path", path))
+	case MonitorFrame:
+		p.lock.RLock()
+		callback, ok := p.monitors[msg.ID]
+		p.lock.RUnlock()
+		if !ok {
+			break
+		}
+		event := &MonitorEvent{}
+		err := p.codec.Decode(msg.body, event)
+		if err != nil {
+			p.logging.get().Warn("broken monitor frame", messageAttrs(msg, slog.Any("error", err))...)
+			break
+		}
+		callback(event)
+	case ConfirmPath, ListPaths, Monitor:
+		p.logging.write(socket, archiveMessage(ResultNG, msg.ID, nil))
 	case ConnectClient:
-		p.socket.Write(archiveMessage(ResultNG, msg.ID, nil))
+		p.logging.write(socket, archiveMessage(ResultNG, msg.ID, nil))
+	default:
+		p.logging.get().Warn("unknown message type", messageAttrs(msg)...)
+		p.logging.write(socket, archiveProtocolErrorMessage(msg.ID, fmt.Errorf("unknown message type: %d", msg.Type)))
 	}
 	return nil
 }
 
 func (p *Plugin) connect() error {
 	sessionID := p.sessions.getUniqueSessionID()
-	p.socket.Write(archiveMessage(ConnectClient, sessionID, []byte(p.id)))
+	p.socket.Write(archiveMessage(ConnectClient, sessionID, archiveConnectClientBody(p.id, p.codec, p.token)))
 	message := p.sessions.receiveAndClose(sessionID)
 	if message.Type != ResultOK {
 		p.socket.Close()
+		p.logging.get().Warn("connection rejected", slog.String("plugin", p.id), slog.String("host", p.pipeName), slog.String("reason", string(message.body)))
+		if len(message.body) > 0 {
+			return fmt.Errorf("Can't connect to '%s': %s", p.pipeName, string(message.body))
+		}
 		return fmt.Errorf("Can't connect to '%s'", p.pipeName)
 	}
+	if p.codec.Name() != CborCodec.Name() && string(message.body) != p.codec.Name() {
+		p.socket.Close()
+		return fmt.Errorf("Host at '%s' doesn't support codec '%s'", p.pipeName, p.codec.Name())
+	}
 	for path, proxy := range p.objectMap {
 		err := p.publish(path, proxy)
 		if err != nil {
@@ -236,6 +878,7 @@ func (p *Plugin) connect() error {
 		}
 	}
 	p.connected = true
+	p.logging.get().Info("connected to host", slog.String("plugin", p.id), slog.String("host", p.pipeName), slog.String("codec", p.codec.Name()))
 	return nil
 }
 
@@ -243,7 +886,9 @@ func (p *Plugin) publish(path string, proxy *Proxy) error {
 	sessionID := p.sessions.getUniqueSessionID()
 	p.socket.Write(archiveMessage(Publish, sessionID, []byte(path)))
 	message := p.sessions.receiveAndClose(sessionID)
-	if message.Type != ResultOK {
+	if message.Type == ResultAccessDenied {
+		return fmt.Errorf("Publishing object at '%s' is denied", path)
+	} else if message.Type != ResultOK {
 		return fmt.Errorf("Can't publish object at '%s'", path)
 	}
 	return nil
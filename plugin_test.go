@@ -1,6 +1,7 @@
 package tobubus
 
 import (
+	"errors"
 	"github.com/shibukawa/mockconn"
 	"testing"
 	"time"
@@ -116,8 +117,8 @@ func TestPluginConfirmPathNG(t *testing.T) {
 func TestPluginCallMethod(t *testing.T) {
 	plugin, socket := newPluginForTest("pipe.test", "github.com/shibukawa/tobubus/1", t)
 	sessionID := plugin.sessions.getUniqueSessionID() + 1
-	send, _ := archiveMethodCallMessage(CallMethod, sessionID, "/image/reader", "open", []interface{}{"image.png"})
-	receive, _ := archiveMethodCallMessage(ReturnMethod, sessionID, "", "", []interface{}{"ok"})
+	send, _ := archiveMethodCallMessage(CborCodec, CallMethod, sessionID, "/image/reader", "open", []interface{}{"image.png"})
+	receive, _ := archiveMethodCallMessage(CborCodec, ReturnMethod, sessionID, "", "", []interface{}{"ok"})
 	socket.SetExpectedActions(
 		mockconn.Write(send),
 		mockconn.Read(receive),
@@ -183,8 +184,8 @@ func TestPluginCallLocalMethod(t *testing.T) {
 func TestPluginMethodCalledFromHost(t *testing.T) {
 	plugin, socket := newPluginForTest("pipe.test", "github.com/shibukawa/tobubus/1", t)
 	hostSessionID := uint32(45)
-	receive, _ := archiveMethodCallMessage(CallMethod, hostSessionID, "/image/reader", "TestMethod", []interface{}{"image.png"})
-	send, _ := archiveMethodCallMessage(ReturnMethod, hostSessionID, "", "", []interface{}{"ok"})
+	receive, _ := archiveMethodCallMessage(CborCodec, CallMethod, hostSessionID, "/image/reader", "TestMethod", []interface{}{"image.png"})
+	send, _ := archiveMethodCallMessage(CborCodec, ReturnMethod, hostSessionID, "", "", []interface{}{"ok"})
 
 	sessionID := plugin.sessions.getUniqueSessionID() + 1
 
@@ -226,3 +227,47 @@ func TestPluginMethodCalledFromHost(t *testing.T) {
 	}
 	socket.Verify()
 }
+
+func TestPluginReceiveTooLargeReply(t *testing.T) {
+	plugin, socket := newPluginForTest("pipe.test", "github.com/shibukawa/tobubus/1", t)
+	sessionID := plugin.sessions.getUniqueSessionID() + 1
+	send, _ := archiveMethodCallMessage(CborCodec, CallMethod, sessionID, "/image/reader", "open", []interface{}{"a"})
+	receive, _ := archiveMethodCallMessage(CborCodec, ReturnMethod, sessionID, "", "", []interface{}{"very long result which exceeds the limit"})
+	plugin.SetMaxFrameSize(uint32(len(send) - 12))
+	socket.SetExpectedActions(
+		mockconn.Write(send),
+		mockconn.Read(receive),
+	)
+	go func() {
+		time.Sleep(time.Millisecond)
+		plugin.receiveMessage()
+	}()
+	_, err := plugin.Call("/image/reader", "open", "a")
+	if err == nil {
+		t.Error("err should not be nil")
+	}
+	socket.Verify()
+}
+
+func TestPluginReceiveUnknownMessage(t *testing.T) {
+	plugin, socket := newPluginForTest("pipe.test", "github.com/shibukawa/tobubus/1", t)
+	socket.SetExpectedActions(
+		mockconn.Read(archiveMessage(0x99, 7, nil)),
+		mockconn.Write(archiveProtocolErrorMessage(7, errors.New("unknown message type: 153"))),
+	)
+	plugin.receiveMessage()
+	socket.Verify()
+}
+
+func TestPluginNotify(t *testing.T) {
+	plugin, socket := newPluginForTest("pipe.test", "github.com/shibukawa/tobubus/1", t)
+	send, _ := archiveMethodCallMessage(CborCodec, NotifyMethod, 0, "/image/reader", "open", []interface{}{"a"})
+	socket.SetExpectedActions(
+		mockconn.Write(send),
+	)
+	err := plugin.Notify("/image/reader", "open", "a")
+	if err != nil {
+		t.Errorf("err should be nil, but %v", err)
+	}
+	socket.Verify()
+}
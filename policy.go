@@ -0,0 +1,134 @@
+package tobubus
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path"
+	"strings"
+	"sync"
+)
+
+// PolicyRule allows the plugins that match Plugin to publish and call objects.
+//
+// Plugin, Publish and Call are patterns of path.Match. "*" in Plugin matches all plugin IDs.
+// Call entries are "<path>" (all methods) or "<path>#<method>". Plugins find only the objects they can call.
+// Objects that plugins pass by reference are published at "/tobubus/ref/<plugin ID>/<n>" and need Publish entries too.
+// Monitor allows the plugins to monitor all frames of the host (see Plugin.Monitor).
+type PolicyRule struct {
+	Plugin  string   `json:"plugin"`
+	Publish []string `json:"publish"`
+	Call    []string `json:"call"`
+	Monitor bool     `json:"monitor"`
+}
+
+// Policy decides which paths plugins may publish and which methods of host objects they may call.
+//
+// Everything that no rule allows is denied and logged by the logger of Host. Host without Policy allows everything.
+type Policy struct {
+	lock  sync.RWMutex
+	rules []PolicyRule
+}
+
+// NewPolicy creates Policy with rules.
+func NewPolicy(rules ...PolicyRule) *Policy {
+	return &Policy{rules: rules}
+}
+
+// LoadPolicyFile reads Policy from JSON file like this:
+//
+//	{"rules": [{"plugin": "github.com/shibukawa/*", "publish": ["/editor/*"], "call": ["/documents#Open"]}]}
+func LoadPolicyFile(fileName string) (*Policy, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Rules []PolicyRule `json:"rules"`
+	}
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return nil, err
+	}
+	return NewPolicy(file.Rules...), nil
+}
+
+// Allow adds the rule.
+func (p *Policy) Allow(rule PolicyRule) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.rules = append(p.rules, rule)
+}
+
+// CanPublish returns true if the plugin may publish object at objectPath.
+func (p *Policy) CanPublish(pluginID, objectPath string) bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	for _, rule := range p.rules {
+		if !matchPattern(rule.Plugin, pluginID) {
+			continue
+		}
+		for _, pattern := range rule.Publish {
+			if matchPattern(pattern, objectPath) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CanCall returns true if the plugin may call the method of the object at objectPath.
+func (p *Policy) CanCall(pluginID, objectPath, methodName string) bool {
+	return p.matchCall(pluginID, objectPath, func(methodPattern string) bool {
+		return matchPattern(methodPattern, methodName)
+	})
+}
+
+// CanFind returns true if the plugin may call any method of the object at objectPath.
+// The other objects are hidden from ConfirmPath and ListPaths of the plugin.
+func (p *Policy) CanFind(pluginID, objectPath string) bool {
+	return p.matchCall(pluginID, objectPath, func(methodPattern string) bool {
+		return true
+	})
+}
+
+func (p *Policy) matchCall(pluginID, objectPath string, matchMethod func(methodPattern string) bool) bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	for _, rule := range p.rules {
+		if !matchPattern(rule.Plugin, pluginID) {
+			continue
+		}
+		for _, pattern := range rule.Call {
+			pathPattern := pattern
+			methodPattern := "*"
+			if i := strings.LastIndex(pattern, "#"); i != -1 {
+				pathPattern = pattern[:i]
+				methodPattern = pattern[i+1:]
+			}
+			if matchPattern(pathPattern, objectPath) && matchMethod(methodPattern) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CanMonitor returns true if the plugin may monitor frames of the host.
+func (p *Policy) CanMonitor(pluginID string) bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	for _, rule := range p.rules {
+		if rule.Monitor && matchPattern(rule.Plugin, pluginID) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPattern(pattern, name string) bool {
+	if pattern == "*" {
+		return true
+	}
+	matched, err := path.Match(pattern, name)
+	return err == nil && matched
+}
@@ -0,0 +1,66 @@
+package tobubus
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPolicy(t *testing.T) {
+	policy := NewPolicy(PolicyRule{
+		Plugin:  "github.com/shibukawa/*",
+		Publish: []string{"/editor/*"},
+		Call:    []string{"/documents#Open", "/image/*"},
+	})
+	policy.Allow(PolicyRule{Plugin: "*", Call: []string{"/version#Get"}})
+	pluginID := "github.com/shibukawa/editor"
+	if !policy.CanPublish(pluginID, "/editor/main") {
+		t.Error("plugin should be able to publish '/editor/main'")
+	}
+	if policy.CanPublish(pluginID, "/documents") {
+		t.Error("plugin should not be able to publish '/documents'")
+	}
+	if !policy.CanCall(pluginID, "/documents", "Open") {
+		t.Error("plugin should be able to call '/documents#Open'")
+	}
+	if policy.CanCall(pluginID, "/documents", "Delete") {
+		t.Error("plugin should not be able to call '/documents#Delete'")
+	}
+	if !policy.CanCall(pluginID, "/image/reader", "Read") {
+		t.Error("plugin should be able to call all methods at '/image/reader'")
+	}
+	if !policy.CanCall("example.com/other", "/version", "Get") {
+		t.Error("all plugins should be able to call '/version#Get'")
+	}
+	if policy.CanCall("example.com/other", "/documents", "Open") {
+		t.Error("other plugin should not be able to call '/documents#Open'")
+	}
+	if !policy.CanFind(pluginID, "/documents") || !policy.CanFind("example.com/other", "/version") {
+		t.Error("plugins should be able to find the objects that they can call")
+	}
+	if policy.CanFind("example.com/other", "/documents") {
+		t.Error("other plugin should not be able to find '/documents'")
+	}
+}
+
+func TestLoadPolicyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tobubus")
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "policy.json")
+	ioutil.WriteFile(fileName, []byte(`{"rules": [{"plugin": "*", "publish": ["/editor"], "call": ["/documents#Open"]}]}`), 0644)
+	policy, err := LoadPolicyFile(fileName)
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	if !policy.CanPublish("github.com/shibukawa/editor", "/editor") || !policy.CanCall("github.com/shibukawa/editor", "/documents", "Open") {
+		t.Errorf("policy should be loaded from file, but %v", policy.rules)
+	}
+	_, err = LoadPolicyFile(filepath.Join(dir, "missing.json"))
+	if err == nil {
+		t.Error("err should not be nil")
+	}
+}
@@ -11,6 +11,8 @@ type Proxy struct {
 	instance       interface{}
 	methods        map[string]reflect.Value
 	privateMethods map[string]bool
+	callInfoArgs   map[string]callInfoArg
+	executor       Executor // runs calls from the other side. nil runs them at the same time.
 }
 
 func hasUpperPrefix(name string) bool {
@@ -26,14 +28,23 @@ func NewProxy(instance interface{}) (*Proxy, error) {
 		instance:       instance,
 		methods:        make(map[string]reflect.Value),
 		privateMethods: make(map[string]bool),
+		callInfoArgs:   make(map[string]callInfoArg),
 	}
 	v := reflect.ValueOf(instance)
+	if v.Kind() == reflect.Func {
+		// function (e.g. callback passed by reference) is called via "Call" method
+		proxy.methods["Call"] = v
+		proxy.callInfoArgs["Call"] = callInfoArgOf(v.Type())
+		return proxy, nil
+	}
 	t := v.Type()
 	n := t.NumMethod()
 	for i := 0; i < n; i++ {
 		name := t.Method(i).Name
 		if hasUpperPrefix(name) {
-			proxy.methods[name] = v.MethodByName(name)
+			method := v.MethodByName(name)
+			proxy.methods[name] = method
+			proxy.callInfoArgs[name] = callInfoArgOf(method.Type())
 		} else {
 			proxy.privateMethods[name] = true
 		}
@@ -42,7 +53,45 @@ func NewProxy(instance interface{}) (*Proxy, error) {
 	return proxy, nil
 }
 
+func (p *Proxy) hasMethod(name string) bool {
+	_, ok := p.methods[name]
+	return ok
+}
+
+// invoke is Invoker of the proxy.
+func (p *Proxy) invoke(info *CallInfo, params []interface{}) ([]interface{}, error) {
+	return p.CallWithInfo(info, info.Method, params...)
+}
+
+// dispatch is Invoker of the proxy for calls from the other side. It runs the method on the executor of the object.
+// Panics of the method are passed to the caller.
+func (p *Proxy) dispatch(info *CallInfo, params []interface{}) (result []interface{}, err error) {
+	if p.executor == nil {
+		return p.invoke(info, params)
+	}
+	done := make(chan struct{})
+	var panicked interface{}
+	p.executor.Execute(func() {
+		defer func() {
+			panicked = recover()
+			close(done)
+		}()
+		result, err = p.invoke(info, params)
+	})
+	<-done
+	if panicked != nil {
+		panic(panicked)
+	}
+	return result, err
+}
+
 func (p *Proxy) Call(name string, args ...interface{}) ([]interface{}, error) {
+	return p.CallWithInfo(&CallInfo{Method: name}, name, args...)
+}
+
+// CallWithInfo calls the method like Call. If the method takes CallInfo (or context.Context) as the first argument,
+// info is passed to it.
+func (p *Proxy) CallWithInfo(info *CallInfo, name string, args ...interface{}) ([]interface{}, error) {
 	method, ok := p.methods[name]
 	if !ok {
 		if p.privateMethods[name] {
@@ -51,9 +100,12 @@ func (p *Proxy) Call(name string, args ...interface{}) ([]interface{}, error) {
 			return nil, fmt.Errorf("Method '%s' is undefined", name)
 		}
 	}
-	newArgs := make([]reflect.Value, len(args))
-	for i, arg := range args {
-		newArgs[i] = reflect.ValueOf(arg)
+	var newArgs []reflect.Value
+	if a := p.callInfoArgs[name]; a != noCallInfo {
+		newArgs = append(newArgs, a.value(info))
+	}
+	for _, arg := range args {
+		newArgs = append(newArgs, reflect.ValueOf(arg))
 	}
 	results := method.Call(newArgs)
 	newResults := make([]interface{}, len(results))
@@ -0,0 +1,271 @@
+package tobubus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// recordMagic is written at the beginning of recorded files.
+//
+// Each record follows it: 8 bytes of time (Unix nanoseconds), 4 bytes of connection number, 1 byte of direction
+// (0 for received frames, 1 for sent frames) and the frame itself in the format of the wire protocol.
+// Integers are little endian like the frame header.
+const recordMagic = "tobubus1"
+
+// Record is the frame that Host or Plugin received or sent.
+type Record struct {
+	Time       time.Time
+	Direction  string // FrameReceived or FrameSent (from the view of the recorded side)
+	Connection uint32 // 1, 2, ... in the order the recorder saw connections. Always 1 for Plugin.
+	Type       MessageType
+	SessionID  uint32
+	Body       []byte
+}
+
+func (r *Record) String() string {
+	arrow := "<-"
+	if r.Direction == FrameSent {
+		arrow = "->"
+	}
+	return fmt.Sprintf("%s %s #%d (%d bytes)", arrow, r.Type, r.SessionID, len(r.Body))
+}
+
+// Recorder writes the frames of Host or Plugin to a file. Set it by SetRecorder of Host or Plugin.
+//
+// Frames that are too large to receive are recorded without their bodies.
+//
+// Frames are recorded as they are to be replayed. ParamRedactor is not applied, so recordings contain params,
+// results and tokens in ConnectClient. Protect the files like credentials.
+type Recorder struct {
+	lock        sync.Mutex
+	writer      io.Writer
+	connections map[net.Conn]uint32
+	count       uint32
+	err         error
+}
+
+// NewRecorder creates Recorder that writes records to writer.
+func NewRecorder(writer io.Writer) (*Recorder, error) {
+	_, err := io.WriteString(writer, recordMagic)
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{
+		writer:      writer,
+		connections: make(map[net.Conn]uint32),
+	}, nil
+}
+
+// Err returns the first error of writing records. Recorder stops writing after the error.
+func (r *Recorder) Err() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.err
+}
+
+// Close closes the writer if it is io.Closer. It returns the first error of writing records if any.
+func (r *Recorder) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var err error
+	if closer, ok := r.writer.(io.Closer); ok {
+		err = closer.Close()
+	}
+	if r.err != nil {
+		return r.err
+	}
+	r.err = errors.New("Recorder is already closed")
+	return err
+}
+
+func (r *Recorder) record(socket net.Conn, direction string, frame []byte) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.err != nil {
+		return
+	}
+	connection, ok := r.connections[socket]
+	if !ok {
+		r.count++
+		connection = r.count
+		r.connections[socket] = connection
+	}
+	data := make([]byte, 13, 13+len(frame))
+	binary.LittleEndian.PutUint64(data, uint64(time.Now().UnixNano()))
+	binary.LittleEndian.PutUint32(data[8:], connection)
+	if direction == FrameSent {
+		data[12] = 1
+	}
+	_, r.err = r.writer.Write(append(data, frame...))
+}
+
+func (r *Recorder) forget(socket net.Conn) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.connections, socket)
+}
+
+// ReadRecords reads all records written by Recorder. Frames larger than DefaultMaxFrameSize are rejected with *FrameSizeError.
+func ReadRecords(reader io.Reader) ([]*Record, error) {
+	magic := make([]byte, len(recordMagic))
+	_, err := io.ReadFull(reader, magic)
+	if err != nil || string(magic) != recordMagic {
+		return nil, errors.New("It is not a file of Recorder")
+	}
+	var records []*Record
+	header := make([]byte, 13)
+	for {
+		_, err := io.ReadFull(reader, header)
+		if err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return records, err
+		}
+		msg, err := parseMessage(reader, DefaultMaxFrameSize)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return records, err
+		}
+		record := &Record{
+			Time:       time.Unix(0, int64(binary.LittleEndian.Uint64(header))),
+			Direction:  FrameReceived,
+			Connection: binary.LittleEndian.Uint32(header[8:]),
+			Type:       msg.Type,
+			SessionID:  msg.ID,
+			Body:       msg.body,
+		}
+		if header[12] == 1 {
+			record.Direction = FrameSent
+		}
+		records = append(records, record)
+	}
+}
+
+// ConnectionRecords returns the records of one connection. Recordings of Host should be split by it before replaying.
+func ConnectionRecords(records []*Record, connection uint32) []*Record {
+	var result []*Record
+	for _, record := range records {
+		if record.Connection == connection {
+			result = append(result, record)
+		}
+	}
+	return result
+}
+
+// recording keeps the recorder of Host and Plugin. It has its own lock because frames are sent while they hold theirs.
+type recording struct {
+	lock     sync.RWMutex
+	recorder *Recorder
+}
+
+func (r *recording) set(recorder *Recorder) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.recorder = recorder
+}
+
+func (r *recording) get() *Recorder {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.recorder
+}
+
+// sent records the frame before it is sent to keep the order of the request and its reply.
+func (r *recording) sent(socket net.Conn, data []byte) {
+	if recorder := r.get(); recorder != nil {
+		recorder.record(socket, FrameSent, data)
+	}
+}
+
+func (r *recording) received(socket net.Conn, msg *message) {
+	if recorder := r.get(); recorder != nil {
+		recorder.record(socket, FrameReceived, archiveMessage(msg.Type, msg.ID, msg.body))
+	}
+}
+
+func (r *recording) closeSocket(socket net.Conn) {
+	if recorder := r.get(); recorder != nil {
+		recorder.forget(socket)
+	}
+}
+
+// ReplayError is returned by Replayer when the peer sends the frame that is different from the record.
+type ReplayError struct {
+	Index    int // index of the record
+	Expected *Record
+	Actual   *Record // nil if the connection is closed
+	Err      error   // error of reading the frame
+}
+
+func (e *ReplayError) Error() string {
+	if e.Actual == nil {
+		return fmt.Sprintf("record %d: %s is expected, but %v", e.Index, e.Expected, e.Err)
+	}
+	return fmt.Sprintf("record %d: %s is expected, but %s", e.Index, e.Expected, e.Actual)
+}
+
+// Replayer acts as the peer of the recorded connection to reproduce the session.
+//
+// It sends the frames that the recorded side received, and checks that the side under test sends the same frames
+// that the recorded side sent. Frames are replayed in the recorded order as fast as possible, so the session
+// should not depend on timing (e.g. concurrent calls may be sent in a different order).
+type Replayer struct {
+	Records    []*Record // records of one connection
+	IgnoreBody bool      // compares only types and session IDs (e.g. for bodies that contain time or random IDs)
+}
+
+// NewReplayer creates Replayer of the records of one connection.
+func NewReplayer(records []*Record) *Replayer {
+	return &Replayer{Records: records}
+}
+
+// Replay replays the records via socket that is connected to the side under test.
+// It returns *ReplayError if the side under test sends an unexpected frame or a frame larger than DefaultMaxFrameSize.
+func (r *Replayer) Replay(socket net.Conn) error {
+	for i, record := range r.Records {
+		if record.Direction == FrameReceived {
+			_, err := socket.Write(archiveMessage(record.Type, record.SessionID, record.Body))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		msg, err := parseMessage(socket, DefaultMaxFrameSize)
+		if err != nil {
+			return &ReplayError{Index: i, Expected: record, Err: err}
+		}
+		if msg.Type != record.Type || msg.ID != record.SessionID || (!r.IgnoreBody && !bytes.Equal(msg.body, record.Body)) {
+			actual := &Record{Direction: FrameSent, Connection: record.Connection, Type: msg.Type, SessionID: msg.ID, Body: msg.body}
+			return &ReplayError{Index: i, Expected: record, Actual: actual}
+		}
+	}
+	return nil
+}
+
+// ReplayToHost connects to the host as the recorded plugin and replays the records of the host.
+func (r *Replayer) ReplayToHost(transport Transport, address string) error {
+	socket, err := transport.Dial(address)
+	if err != nil {
+		return err
+	}
+	defer socket.Close()
+	return r.Replay(socket)
+}
+
+// ReplayToPlugin accepts the connection of the plugin as the recorded host and replays the records of the plugin.
+func (r *Replayer) ReplayToPlugin(listener net.Listener) error {
+	socket, err := listener.Accept()
+	if err != nil {
+		return err
+	}
+	defer socket.Close()
+	return r.Replay(socket)
+}
@@ -0,0 +1,146 @@
+package tobubus
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func recordHostSession(t *testing.T, transport *InProcessTransport, address string) []*Record {
+	host := NewHostWithTransport(address, transport)
+	host.Publish("/host", &testStruct{result: "ok"})
+	var buffer bytes.Buffer
+	recorder, err := NewRecorder(&buffer)
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	host.SetRecorder(recorder)
+	err = host.Listen()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	defer host.Close()
+	plugin, err := NewPluginWithTransport(address, "github.com/shibukawa/tobubus/recorded", transport)
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	err = plugin.Connect()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	plugin.Call("/host", "TestMethod", "arg")
+	plugin.Close()
+	records, err := ReadRecords(&buffer)
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	return records
+}
+
+func TestRecordHost(t *testing.T) {
+	records := recordHostSession(t, NewInProcessTransport(), "tobubus.record")
+	var types []string
+	for _, record := range records {
+		if record.Connection != 1 {
+			t.Errorf("connection should be 1, but %d", record.Connection)
+		}
+		types = append(types, record.Direction+":"+record.Type.String())
+	}
+	expected := "received:ConnectClient sent:ResultOK received:CallMethod sent:ReturnMethod received:CloseClient sent:ResultOK"
+	if strings.Join(types, " ") != expected {
+		t.Errorf("records should be '%s', but '%s'", expected, strings.Join(types, " "))
+	}
+	if len(records) > 0 && records[0].Time.IsZero() {
+		t.Error("time should be recorded")
+	}
+	_, err := ReadRecords(strings.NewReader("unknown file"))
+	if err == nil {
+		t.Error("err should not be nil")
+	}
+}
+
+func TestReplayToHost(t *testing.T) {
+	transport := NewInProcessTransport()
+	records := ConnectionRecords(recordHostSession(t, transport, "tobubus.replay.recorded"), 1)
+
+	host := NewHostWithTransport("tobubus.replay", transport)
+	host.Publish("/host", &testStruct{result: "ok"})
+	err := host.Listen()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	defer host.Close()
+	err = NewReplayer(records).ReplayToHost(transport, "tobubus.replay")
+	if err != nil {
+		t.Errorf("host should send the same frames, but %v", err)
+	}
+
+	changed := NewHostWithTransport("tobubus.replay.changed", transport)
+	changed.Publish("/host", &testStruct{result: "changed"})
+	err = changed.Listen()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	defer changed.Close()
+	err = (&Replayer{Records: records, IgnoreBody: true}).ReplayToHost(transport, "tobubus.replay.changed")
+	if err != nil {
+		t.Errorf("body should be ignored, but %v", err)
+	}
+	err = NewReplayer(records).ReplayToHost(transport, "tobubus.replay.changed")
+	replayErr, ok := err.(*ReplayError)
+	if !ok || replayErr.Index != 3 || replayErr.Actual.Type != ReturnMethod {
+		t.Errorf("changed result should be detected, but %v", err)
+	}
+}
+
+func TestReplayToPlugin(t *testing.T) {
+	transport := NewInProcessTransport()
+	host := NewHostWithTransport("tobubus.replay.plugin.recorded", transport)
+	host.Publish("/host", &testStruct{result: "ok"})
+	err := host.Listen()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	defer host.Close()
+	var buffer bytes.Buffer
+	recorder, _ := NewRecorder(&buffer)
+	plugin, err := NewPluginWithTransport("tobubus.replay.plugin.recorded", "github.com/shibukawa/tobubus/recorded", transport)
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	plugin.SetRecorder(recorder)
+	plugin.Connect()
+	plugin.Call("/host", "TestMethod", "arg")
+	plugin.Close()
+	records, err := ReadRecords(&buffer)
+	if err != nil || len(records) != 6 {
+		t.Fatalf("6 records should be read, but %d (%v)", len(records), err)
+	}
+
+	listener, err := transport.Listen("tobubus.replay.plugin")
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	defer listener.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- NewReplayer(records).ReplayToPlugin(listener)
+	}()
+	plugin, err = NewPluginWithTransport("tobubus.replay.plugin", "github.com/shibukawa/tobubus/recorded", transport)
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	err = plugin.Connect()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	result, err := plugin.Call("/host", "TestMethod", "arg")
+	if err != nil || result[0] != "ok" {
+		t.Errorf("replayer should return the recorded result, but %v (%v)", result, err)
+	}
+	plugin.Close()
+	err = <-done
+	if err != nil {
+		t.Errorf("plugin should send the same frames, but %v", err)
+	}
+}
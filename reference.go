@@ -0,0 +1,180 @@
+package tobubus
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// referenceKey is the key of placeholder map that is sent instead of the object passed by reference.
+const referenceKey = "$tobubus.ref"
+
+// leaseKey is used instead of referenceKey if the receiver should release the object after use.
+const leaseKey = "$tobubus.lease"
+
+// referencePathPrefix is the prefix of paths that objects passed by reference are published at.
+const referencePathPrefix = "/tobubus/ref/"
+
+type caller interface {
+	Call(path, methodName string, params ...interface{}) ([]interface{}, error)
+}
+
+// RemoteObject is a proxy of the object that is passed by reference from the other side.
+//
+// Its methods are called via Call. Path is available for Host.Call or Plugin.Call too.
+// If RemoteObject is passed back to the owner side, the owner receives the original object.
+//
+// If the object is leased, Close releases it. It is also released when RemoteObject is garbage-collected.
+// Host lets only the plugins that the reference was sent to acquire it by path.
+type RemoteObject struct {
+	Path    string
+	caller  caller
+	release func()
+	once    sync.Once
+}
+
+func newRemoteObject(path string, c caller, release func()) *RemoteObject {
+	r := &RemoteObject{Path: path, caller: c, release: release}
+	if release != nil {
+		runtime.SetFinalizer(r, (*RemoteObject).Close)
+	}
+	return r
+}
+
+// Call calls the method of the remote object.
+func (r *RemoteObject) Call(methodName string, params ...interface{}) ([]interface{}, error) {
+	return r.caller.Call(r.Path, methodName, params...)
+}
+
+// Close releases the leased object. The owner drops it when all holders release it.
+func (r *RemoteObject) Close() error {
+	if r.release != nil {
+		r.once.Do(func() {
+			runtime.SetFinalizer(r, nil)
+			r.release()
+		})
+	}
+	return nil
+}
+
+type byReference struct {
+	obj interface{}
+}
+
+// ByReference marks the object to be passed by reference.
+//
+// The object is published at a temporary path in leased mode and the other side receives *RemoteObject.
+// Functions, and pointers of structs that have methods but no exported fields are passed by reference
+// without marking.
+func ByReference(obj interface{}) interface{} {
+	return &byReference{obj: obj}
+}
+
+func hasExportedField(t reflect.Type) bool {
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).PkgPath == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// referencedObject returns the object if the value should be passed by reference.
+func referencedObject(value interface{}) (interface{}, bool) {
+	switch v := value.(type) {
+	case nil:
+		return nil, false
+	case *byReference:
+		return v.obj, true
+	case *RemoteObject:
+		return v, true
+	}
+	if streamKindOf(value) != "" {
+		return nil, false
+	}
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Func, reflect.Chan, reflect.UnsafePointer:
+		return value, true
+	case reflect.Ptr:
+		if v.Elem().Kind() == reflect.Struct && v.Type().NumMethod() > 0 && !hasExportedField(v.Elem().Type()) {
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+// exportReferences replaces the values that are passed by reference with placeholders.
+// publish is called to publish the object in leased mode and returns its path.
+func exportReferences(values []interface{}, publish func(obj interface{}) (string, error)) ([]interface{}, error) {
+	result := values
+	copied := false
+	for i, value := range values {
+		obj, ok := referencedObject(value)
+		if !ok {
+			continue
+		}
+		var path string
+		key := leaseKey
+		if remote, ok := obj.(*RemoteObject); ok {
+			path = remote.Path
+			key = referenceKey
+		} else {
+			var err error
+			path, err = publish(obj)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if !copied {
+			result = make([]interface{}, len(values))
+			copy(result, values)
+			copied = true
+		}
+		result[i] = map[string]interface{}{key: path}
+	}
+	return result, nil
+}
+
+// importReferences replaces placeholders with the values that resolve returns.
+// If resolve returns nil, the placeholder is left as it is.
+func importReferences(values []interface{}, resolve func(path string, leased bool) interface{}) {
+	for i, value := range values {
+		var obj interface{}
+		if path, ok := placeholderValue(value, referenceKey).(string); ok {
+			obj = resolve(path, false)
+		} else if path, ok := placeholderValue(value, leaseKey).(string); ok {
+			obj = resolve(path, true)
+		}
+		if obj != nil {
+			values[i] = obj
+		}
+	}
+}
+
+// placeholderValue returns the value if param is a placeholder map that has only key.
+func placeholderValue(param interface{}, key string) interface{} {
+	switch m := param.(type) {
+	case map[interface{}]interface{}:
+		if len(m) == 1 {
+			return m[key]
+		}
+	case map[string]interface{}:
+		if len(m) == 1 {
+			return m[key]
+		}
+	}
+	return nil
+}
+
+type referenceCounter struct {
+	count uint32
+}
+
+// nextPath generates unique path to publish the object passed by reference.
+// owner is "host" or plugin ID to avoid conflict among plugins.
+func (r *referenceCounter) nextPath(owner string) string {
+	return fmt.Sprintf("%s%s/%d", referencePathPrefix, owner, atomic.AddUint32(&r.count, 1))
+}
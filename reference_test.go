@@ -0,0 +1,276 @@
+package tobubus
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+type document struct {
+	title string
+}
+
+func (d *document) Title() string {
+	return d.title
+}
+
+type referenceService struct {
+	documents []*document
+}
+
+func (s *referenceService) Open(title string) *document {
+	doc := &document{title: title}
+	s.documents = append(s.documents, doc)
+	return doc
+}
+
+func (s *referenceService) Each(count int64, callback *RemoteObject) int64 {
+	var sum int64
+	for i := int64(0); i < count; i++ {
+		result, err := callback.Call("Call", i)
+		if err != nil {
+			return -1
+		}
+		sum += result[0].(int64)
+	}
+	return sum
+}
+
+func (s *referenceService) TitleOf(doc *document) string {
+	return doc.title
+}
+
+func startReferenceTest(t *testing.T, pipeName string) (*Host, *Plugin, *referenceService) {
+	service := &referenceService{}
+	host := NewHost(pipeName)
+	err := host.Listen()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	plugin, err := NewPlugin(pipeName, "github.com/shibukawa/tobubus/reference")
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	plugin.Publish("/documents", service)
+	err = plugin.Connect()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	return host, plugin, service
+}
+
+func TestReturnObjectByReference(t *testing.T) {
+	host, plugin, _ := startReferenceTest(t, "tobubus.reference.return")
+	defer host.Close()
+	defer plugin.Close()
+	result, err := host.Call("/documents", "Open", "readme.txt")
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	doc, ok := result[0].(*RemoteObject)
+	if !ok {
+		t.Fatalf("result should be *RemoteObject, but %#v", result[0])
+	}
+	title, err := doc.Call("Title")
+	if err != nil || title[0] != "readme.txt" {
+		t.Errorf("Title should return 'readme.txt', but %v (%v)", title, err)
+	}
+	title, err = host.Call(doc.Path, "Title")
+	if err != nil || title[0] != "readme.txt" {
+		t.Errorf("Title should return 'readme.txt' via path, but %v (%v)", title, err)
+	}
+	// passing back the reference makes the original object
+	title, err = host.Call("/documents", "TitleOf", doc)
+	if err != nil || title[0] != "readme.txt" {
+		t.Errorf("TitleOf should return 'readme.txt', but %v (%v)", title, err)
+	}
+}
+
+func TestPassCallbackByReference(t *testing.T) {
+	host, plugin, _ := startReferenceTest(t, "tobubus.reference.callback")
+	defer host.Close()
+	defer plugin.Close()
+	var called []int64
+	callback := func(i int64) int64 {
+		called = append(called, i)
+		return i * 10
+	}
+	result, err := host.Call("/documents", "Each", int64(3), callback)
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	if result[0] != int64(30) {
+		t.Errorf("Each should return 30, but %v", result[0])
+	}
+	if len(called) != 3 {
+		t.Errorf("callback should be called 3 times, but %v", called)
+	}
+}
+
+type referenceChecker struct {
+	referenceService
+}
+
+func (c *referenceChecker) TypeOf(value interface{}) string {
+	return fmt.Sprintf("%T", value)
+}
+
+func TestResolveReferenceFromPlugin(t *testing.T) {
+	host, plugin, _ := startReferenceTest(t, "tobubus.reference.resolve")
+	defer host.Close()
+	defer plugin.Close()
+	host.Publish("/checker", &referenceChecker{})
+
+	// references are resolved only in the space of the plugin. the others are left as placeholders
+	ownPath := referencePathPrefix + plugin.ID() + "/100"
+	cases := []struct {
+		key      string
+		path     string
+		expected string
+	}{
+		{referenceKey, "/checker", "map"},
+		{referenceKey, "/missing", "map"},
+		{leaseKey, referencePathPrefix + "other/1", "map"},
+		{leaseKey, ownPath, "*tobubus.RemoteObject"},
+	}
+	for _, c := range cases {
+		result, err := plugin.Call("/checker", "TypeOf", map[string]interface{}{c.key: c.path})
+		if err != nil || !strings.HasPrefix(result[0].(string), c.expected) {
+			t.Errorf("reference to '%s' should be %s, but %v (%v)", c.path, c.expected, result, err)
+		}
+	}
+	if host.ConfirmPath("/missing") || host.ConfirmPath(referencePathPrefix+"other/1") {
+		t.Error("references out of the plugin's space should not be registered")
+	}
+	if !host.ConfirmPath(ownPath) {
+		t.Error("reference in the plugin's space should be registered")
+	}
+
+	// the object the plugin holds is resolved into itself
+	result, err := plugin.Call("/checker", "Open", "readme.txt")
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	doc := result[0].(*RemoteObject)
+	result, err = plugin.Call("/checker", "TitleOf", doc)
+	if err != nil || result[0] != "readme.txt" {
+		t.Errorf("TitleOf should return 'readme.txt', but %v (%v)", result, err)
+	}
+	result, err = plugin.Call("/checker", "TypeOf", map[string]interface{}{referenceKey: doc.Path})
+	if err != nil || result[0] != "*tobubus.document" {
+		t.Errorf("held reference should be the original object, but %v (%v)", result, err)
+	}
+}
+
+func TestResolveReferenceDeniedByPolicy(t *testing.T) {
+	host, plugin, _ := startReferenceTest(t, "tobubus.reference.policy")
+	defer host.Close()
+	defer plugin.Close()
+	host.Publish("/checker", &referenceChecker{})
+	deniedPath := referencePathPrefix + plugin.ID() + "/100"
+	allowedPath := referencePathPrefix + plugin.ID() + "/101"
+	host.SetPolicy(NewPolicy(PolicyRule{Plugin: plugin.ID(), Publish: []string{allowedPath}, Call: []string{"/checker#TypeOf"}}))
+
+	result, err := plugin.Call("/checker", "TypeOf", map[string]interface{}{leaseKey: deniedPath})
+	if err != nil || !strings.HasPrefix(result[0].(string), "map") {
+		t.Errorf("reference that policy denies should be left as placeholder, but %v (%v)", result, err)
+	}
+	if host.ConfirmPath(deniedPath) {
+		t.Error("reference that policy denies should not be registered")
+	}
+	result, err = plugin.Call("/checker", "TypeOf", map[string]interface{}{leaseKey: allowedPath})
+	if err != nil || result[0] != "*tobubus.RemoteObject" {
+		t.Errorf("reference that policy allows should be resolved, but %v (%v)", result, err)
+	}
+}
+
+func TestAcquireReferenceDeniedByPolicy(t *testing.T) {
+	host, plugin, _ := startReferenceTest(t, "tobubus.reference.acquire")
+	defer host.Close()
+	defer plugin.Close()
+	host.Publish("/checker", &referenceChecker{})
+	host.SetPolicy(NewPolicy(PolicyRule{Plugin: "*", Call: []string{"/checker"}}))
+	other, err := NewPlugin("tobubus.reference.acquire", "github.com/shibukawa/tobubus/other")
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	err = other.Connect()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	defer other.Close()
+
+	result, err := plugin.Call("/checker", "Open", "readme.txt")
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	doc := result[0].(*RemoteObject)
+	// the other plugin can't become a holder of the reference to bypass the policy
+	_, err = other.Acquire(doc.Path)
+	if err == nil {
+		t.Error("other plugin should not acquire the reference")
+	}
+	_, err = other.Call(doc.Path, "Title")
+	if err == nil {
+		t.Error("other plugin should not call the reference")
+	}
+	title, err := doc.Call("Title")
+	if err != nil || title[0] != "readme.txt" {
+		t.Errorf("holder should call the reference, but %v (%v)", title, err)
+	}
+}
+
+func TestAcquireReferenceNotSent(t *testing.T) {
+	host, plugin, _ := startReferenceTest(t, "tobubus.reference.sent")
+	defer host.Close()
+	defer plugin.Close()
+	host.Publish("/checker", &referenceChecker{})
+	other, err := NewPlugin("tobubus.reference.sent", "github.com/shibukawa/tobubus/other")
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	err = other.Connect()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	defer other.Close()
+
+	result, err := plugin.Call("/checker", "Open", "readme.txt")
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	doc := result[0].(*RemoteObject)
+	// the path is guessable, but the reference was not sent to the other plugin
+	_, err = other.Acquire(doc.Path)
+	if err == nil {
+		t.Error("other plugin should not acquire the reference")
+	}
+	handle, err := plugin.Acquire(doc.Path)
+	if err != nil {
+		t.Errorf("plugin that received the reference should acquire it, but %v", err)
+	} else {
+		handle.Close()
+	}
+}
+
+func TestExportReferences(t *testing.T) {
+	var published []interface{}
+	publish := func(obj interface{}) (string, error) {
+		published = append(published, obj)
+		return "/tobubus/ref/test/1", nil
+	}
+	doc := &document{}
+	values, err := exportReferences([]interface{}{"text", int64(1), doc, ByReference(&testStruct{})}, publish)
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	if values[0] != "text" || values[1] != int64(1) {
+		t.Errorf("serializable values should not be changed: %v", values)
+	}
+	if placeholderValue(values[2], leaseKey) != "/tobubus/ref/test/1" || placeholderValue(values[3], leaseKey) == nil {
+		t.Errorf("values should be replaced with references: %v", values)
+	}
+	if len(published) != 2 || published[0] != doc {
+		t.Errorf("two objects should be published, but %v", published)
+	}
+}
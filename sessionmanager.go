@@ -2,6 +2,7 @@ package tobubus
 
 import (
 	"math"
+	"net"
 	"sync"
 )
 
@@ -15,6 +16,7 @@ const (
 type sessionManager struct {
 	lock          sync.RWMutex
 	sessions      map[uint32]chan *message
+	canceled      map[uint32]net.Conn // sessions that nobody waits. They are reserved until their replies arrive or the sockets close.
 	strategy      sessionStrategy
 	nextSessionID uint32
 }
@@ -22,6 +24,7 @@ type sessionManager struct {
 func newSessionManager(strategy sessionStrategy) *sessionManager {
 	return &sessionManager{
 		sessions: make(map[uint32]chan *message),
+		canceled: make(map[uint32]net.Conn),
 		strategy: strategy,
 	}
 }
@@ -34,29 +37,78 @@ func (g *sessionManager) getUniqueSessionID() uint32 {
 		var id uint32
 		for id = 0; id < math.MaxUint32; id++ {
 			if _, ok := g.sessions[id]; !ok {
-				g.sessions[id] = make(chan *message)
+				g.sessions[id] = make(chan *message, 1)
 				return id
 			}
 		}
 	case incrementStrategy:
 		result := g.nextSessionID
 		g.nextSessionID++
+		g.sessions[result] = make(chan *message, 1)
 		return result
 	}
 	panic("id error")
 }
 
 func (g *sessionManager) receiveAndClose(id uint32) *message {
+	result := g.receive(id)
+	g.closeSession(id)
+	return result
+}
+
+// receive waits the reply of the session without releasing the session ID.
+// It is used when the session continues after the reply (e.g. streaming).
+func (g *sessionManager) receive(id uint32) *message {
+	return <-g.getChannelOfSessionID(id)
+}
+
+// receiveOrCancel waits the reply of the session like receive. If canceled is closed before the reply,
+// it returns false and the reply from socket is dropped when it arrives.
+func (g *sessionManager) receiveOrCancel(id uint32, socket net.Conn, canceled <-chan struct{}) (*message, bool) {
+	channel := g.getChannelOfSessionID(id)
+	select {
+	case result := <-channel:
+		return result, true
+	case <-canceled:
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	select {
+	case <-channel:
+		// the reply has arrived while canceling
+		delete(g.sessions, id)
+	default:
+		g.canceled[id] = socket
+	}
+	return nil, false
+}
+
+// deliver passes the reply to the session. Replies of canceled, closed and unknown sessions are dropped.
+// It doesn't block because each session receives one reply.
+func (g *sessionManager) deliver(msg *message) {
 	g.lock.Lock()
-	channel, ok := g.sessions[id]
+	defer g.lock.Unlock()
+	if _, ok := g.canceled[msg.ID]; ok {
+		delete(g.canceled, msg.ID)
+		delete(g.sessions, msg.ID)
+		return
+	}
+	channel, ok := g.sessions[msg.ID]
 	if !ok {
-		channel = make(chan *message)
-		g.sessions[id] = channel
+		// nobody waits for it
+		return
+	}
+	select {
+	case channel <- msg:
+	default:
+		// the peer sent a reply twice
 	}
-	g.lock.Unlock()
-	result := <-channel
+}
+
+func (g *sessionManager) closeSession(id uint32) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
 	delete(g.sessions, id)
-	return result
 }
 
 func (g *sessionManager) getChannelOfSessionID(id uint32) chan *message {
@@ -65,7 +117,27 @@ func (g *sessionManager) getChannelOfSessionID(id uint32) chan *message {
 	if channel, ok := g.sessions[id]; ok {
 		return channel
 	}
-	channel := make(chan *message)
+	channel := make(chan *message, 1)
 	g.sessions[id] = channel
 	return channel
 }
+
+// closeSocket releases the canceled sessions on the socket because their replies never arrive.
+// It is called when the connection is closed.
+func (g *sessionManager) closeSocket(socket net.Conn) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for id, canceledSocket := range g.canceled {
+		if canceledSocket == socket {
+			delete(g.canceled, id)
+			delete(g.sessions, id)
+		}
+	}
+}
+
+// count returns the number of sessions that wait for their replies. Canceled sessions are not counted.
+func (g *sessionManager) count() int {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	return len(g.sessions) - len(g.canceled)
+}
@@ -1,6 +1,7 @@
 package tobubus
 
 import (
+	"net"
 	"testing"
 )
 
@@ -47,3 +48,66 @@ func TestGetUniqueSessionWithIncrementStrategy(t *testing.T) {
 		t.Errorf("expected 3, but %d", id)
 	}
 }
+
+func TestSessionManagerCancel(t *testing.T) {
+	sm := newSessionManager(recycleStrategy)
+	canceled := make(chan struct{})
+	close(canceled)
+
+	id := sm.getUniqueSessionID()
+	_, ok := sm.receiveOrCancel(id, nil, canceled)
+	if ok {
+		t.Error("receiveOrCancel should be canceled")
+	}
+	if sm.getUniqueSessionID() == id {
+		t.Error("canceled session should be reserved until the reply")
+	}
+	sm.deliver(&message{Type: ReturnMethod, ID: id})
+	if sm.count() != 1 {
+		t.Errorf("only the second session should remain, but %d", sm.count())
+	}
+
+	// the reply has already arrived
+	id2 := sm.getUniqueSessionID()
+	sm.deliver(&message{Type: ReturnMethod, ID: id2})
+	msg, ok := sm.receiveOrCancel(id2, nil, make(chan struct{}))
+	if !ok || msg.ID != id2 {
+		t.Errorf("reply should be received, but %v", msg)
+	}
+}
+
+func TestSessionManagerReleasesCanceledOnClose(t *testing.T) {
+	sm := newSessionManager(recycleStrategy)
+	socket, other := net.Pipe()
+	defer socket.Close()
+	defer other.Close()
+	canceled := make(chan struct{})
+	close(canceled)
+
+	id := sm.getUniqueSessionID()
+	sm.receiveOrCancel(id, socket, canceled)
+	otherID := sm.getUniqueSessionID()
+	sm.receiveOrCancel(otherID, other, canceled)
+	if sm.count() != 0 {
+		t.Errorf("canceled sessions should not be in flight, but %d", sm.count())
+	}
+	// the peer never replies
+	sm.closeSocket(socket)
+	if sm.getUniqueSessionID() != id {
+		t.Error("canceled session should be released when the socket closes")
+	}
+	if _, ok := sm.canceled[otherID]; !ok {
+		t.Error("canceled session on the other socket should be reserved")
+	}
+}
+
+func TestSessionManagerDropsUnknownReply(t *testing.T) {
+	sm := newSessionManager(recycleStrategy)
+	id := sm.getUniqueSessionID()
+	sm.closeSession(id)
+	sm.deliver(&message{Type: ReturnMethod, ID: id})
+	sm.deliver(&message{Type: ReturnMethod, ID: 100})
+	if sm.count() != 0 {
+		t.Errorf("replies of closed and unknown sessions should be dropped, but %d sessions", sm.count())
+	}
+}
@@ -0,0 +1,124 @@
+package tobubus
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// streamConn adapts pipes (e.g. stdin/stdout of child process) to net.Conn.
+// Deadlines are not supported.
+type streamConn struct {
+	reader  io.Reader
+	writer  io.Writer
+	closers []io.Closer
+	name    string
+	once    sync.Once
+}
+
+func (c *streamConn) Read(data []byte) (int, error) {
+	return c.reader.Read(data)
+}
+
+func (c *streamConn) Write(data []byte) (int, error) {
+	return c.writer.Write(data)
+}
+
+func (c *streamConn) Close() error {
+	var err error
+	c.once.Do(func() {
+		for _, closer := range c.closers {
+			closeErr := closer.Close()
+			if err == nil {
+				err = closeErr
+			}
+		}
+	})
+	return err
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+	return stdioAddr(c.name)
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return stdioAddr(c.name)
+}
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	return errors.New("deadline is not supported")
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	return errors.New("deadline is not supported")
+}
+
+func (c *streamConn) SetWriteDeadline(t time.Time) error {
+	return errors.New("deadline is not supported")
+}
+
+type stdioAddr string
+
+func (a stdioAddr) Network() string {
+	return "stdio"
+}
+
+func (a stdioAddr) String() string {
+	return string(a)
+}
+
+// connOf returns conn as net.Conn.
+func connOf(conn io.ReadWriteCloser, name string) net.Conn {
+	if c, ok := conn.(net.Conn); ok {
+		return c
+	}
+	return &streamConn{reader: conn, writer: conn, closers: []io.Closer{conn}, name: name}
+}
+
+// NewPluginWithConn creates Plugin instance that talks to the host over the connection that is already established.
+func NewPluginWithConn(conn io.ReadWriteCloser, id string) *Plugin {
+	return newPlugin("", id, connOf(conn, id))
+}
+
+// NewStdioPlugin creates Plugin instance that talks to the host over os.Stdin and os.Stdout.
+// The plugin should be launched by Host.StartPlugin. It shouldn't write anything else to os.Stdout.
+func NewStdioPlugin(id string) *Plugin {
+	return newPlugin("stdio", id, &streamConn{reader: os.Stdin, writer: os.Stdout, closers: []io.Closer{os.Stdout, os.Stdin}, name: "stdio"})
+}
+
+// ServeConn talks to the plugin over the connection that is already established (e.g. pipes of child process).
+// The plugin is registered when it sends ConnectClient like plugins connected via transport.
+func (h *Host) ServeConn(conn io.ReadWriteCloser) {
+	go h.listenAndServeTo(connOf(conn, "conn"))
+}
+
+// StartPlugin launches the plugin as a child process and talks to it over its stdin and stdout.
+// The plugin should be created by NewStdioPlugin. cmd.Stdin and cmd.Stdout should not be set.
+//
+// The child process is waited for after the connection is closed. If the host also listens on transport,
+// Listen should be called before StartPlugin because it closes the existing connections.
+func (h *Host) StartPlugin(cmd *exec.Cmd) error {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+	conn := &streamConn{reader: stdout, writer: stdin, closers: []io.Closer{stdin, stdout}, name: cmd.Path}
+	go func() {
+		h.listenAndServeTo(conn)
+		conn.Close()
+		cmd.Wait()
+	}()
+	return nil
+}
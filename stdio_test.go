@@ -0,0 +1,58 @@
+package tobubus
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+)
+
+const stdioPluginID = "github.com/shibukawa/tobubus/stdio"
+
+// TestStdioPluginProcess is run as the child process of TestStartPlugin.
+func TestStdioPluginProcess(t *testing.T) {
+	if os.Getenv("TOBUBUS_STDIO_PLUGIN") != "1" {
+		return
+	}
+	plugin := NewStdioPlugin(stdioPluginID)
+	plugin.Publish("/child", &testStruct{result: "from child"})
+	plugin.ConnectAndServe()
+	// exit before testing package writes the result to stdout
+	os.Exit(0)
+}
+
+func TestStartPlugin(t *testing.T) {
+	host := NewHost("tobubus.stdio")
+	cmd := exec.Command(os.Args[0], "-test.run=TestStdioPluginProcess")
+	cmd.Env = append(os.Environ(), "TOBUBUS_STDIO_PLUGIN=1")
+	cmd.Stderr = os.Stderr
+	err := host.StartPlugin(cmd)
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	defer host.Close()
+	connected := waitUntil(func() bool {
+		return host.GetSocket(stdioPluginID) != nil && host.ConfirmPath("/child")
+	})
+	if !connected {
+		t.Fatal("child process should connect to host")
+	}
+	result, err := host.Call("/child", "TestMethod", "arg")
+	if err != nil || result[0] != "from child" {
+		t.Errorf("TestMethod should return 'from child', but %v (%v)", result, err)
+	}
+	err = host.Unregister(stdioPluginID)
+	if err != nil {
+		t.Errorf("err should be nil, but %v", err)
+	}
+}
+
+func TestServeConn(t *testing.T) {
+	host := NewHost("tobubus.conn")
+	host.Publish("/host", &testStruct{result: "from host"})
+	hostSide, pluginSide := newInProcessPipe("pipe")
+	host.ServeConn(hostSide)
+	defer host.Close()
+	plugin := NewPluginWithConn(pluginSide, "github.com/shibukawa/tobubus/conn")
+	defer plugin.Close()
+	startTransportTest(t, host, plugin)
+}
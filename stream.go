@@ -0,0 +1,610 @@
+package tobubus
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"sync"
+)
+
+const (
+	// streamWindow is the number of chunks that the sender can send without acknowledgement.
+	streamWindow = 16
+	// streamChunkSize is the maximum payload size of chunks read from io.Reader.
+	streamChunkSize = 32 * 1024
+)
+
+const (
+	streamValues = "values"
+	streamBytes  = "bytes"
+)
+
+// streamArgumentKey is the key of placeholder map that is sent instead of stream argument.
+const streamArgumentKey = "$tobubus.stream"
+
+var errStreamCanceled = errors.New("stream is canceled")
+var errStreamDisconnected = errors.New("connection is closed while streaming")
+
+// streamKey identifies a stream on a connection.
+//
+// Session ID is allocated by the caller. Index 0 is the result stream (callee -> caller)
+// and index n is the stream of n-th argument (caller -> callee).
+type streamKey struct {
+	socket  net.Conn
+	session uint32
+	index   uint32
+}
+
+func archiveStreamMessage(msgType MessageType, key streamKey, payload []byte) []byte {
+	body := make([]byte, 4+len(payload))
+	binary.LittleEndian.PutUint32(body, key.index)
+	copy(body[4:], payload)
+	return archiveMessage(msgType, key.session, body)
+}
+
+// streamKindOf returns the kind of stream if the value is sent as a stream.
+// Receivable channels are sent as values, and io.Reader is sent as bytes.
+func streamKindOf(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	if _, ok := value.(io.Reader); ok {
+		return streamBytes
+	}
+	v := reflect.ValueOf(value)
+	if v.Kind() == reflect.Chan && v.Type().ChanDir()&reflect.RecvDir != 0 {
+		return streamValues
+	}
+	return ""
+}
+
+// streamPlaceholderKind returns the kind of stream if param is a placeholder of stream argument.
+func streamPlaceholderKind(param interface{}) string {
+	kind := placeholderValue(param, streamArgumentKey)
+	if kind == streamValues || kind == streamBytes {
+		return kind.(string)
+	}
+	return ""
+}
+
+// replaceStreamArguments replaces stream arguments by placeholders. Streams are returned by its index.
+func replaceStreamArguments(params []interface{}) ([]interface{}, map[uint32]interface{}) {
+	var streams map[uint32]interface{}
+	result := params
+	for i, param := range params {
+		kind := streamKindOf(param)
+		if kind == "" {
+			continue
+		}
+		if streams == nil {
+			streams = make(map[uint32]interface{})
+			result = make([]interface{}, len(params))
+			copy(result, params)
+		}
+		streams[uint32(i+1)] = param
+		result[i] = map[string]interface{}{streamArgumentKey: kind}
+	}
+	return result, streams
+}
+
+// Stream is a sequence of values or bytes that is sent from the other side in chunks.
+//
+// Streams of bytes are read via Read, and streams of values are received from Values.
+// Close should be called if the stream is not read until the end.
+type Stream struct {
+	kind    string
+	codec   Codec
+	key     streamKey
+	table   *streamTable
+	chunks  chan *message
+	done    chan struct{}
+	closed  bool // guarded by table.lock
+	onClose func()
+
+	reader     io.Reader
+	buffer     []byte
+	consumed   uint32
+	err        error
+	values     chan interface{}
+	valuesOnce sync.Once
+	closeOnce  sync.Once
+}
+
+// newLocalStream wraps the stream returned by the method of local object.
+func newLocalStream(value interface{}) *Stream {
+	s := &Stream{
+		kind: streamKindOf(value),
+		done: make(chan struct{}),
+	}
+	if s.kind == streamBytes {
+		s.reader = value.(io.Reader)
+	} else {
+		s.values = make(chan interface{})
+		s.valuesOnce.Do(func() {})
+		go func() {
+			defer close(s.values)
+			cases := []reflect.SelectCase{
+				{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(value)},
+				{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(s.done)},
+			}
+			for {
+				chosen, value, ok := reflect.Select(cases)
+				if chosen == 1 || !ok {
+					return
+				}
+				select {
+				case s.values <- value.Interface():
+				case <-s.done:
+					return
+				}
+			}
+		}()
+	}
+	return s
+}
+
+// IsBytes returns true if the stream contains bytes. Otherwise it contains values.
+func (s *Stream) IsBytes() bool {
+	return s.kind == streamBytes
+}
+
+// Read reads bytes from the stream of bytes.
+func (s *Stream) Read(p []byte) (int, error) {
+	if s.kind != streamBytes {
+		return 0, errors.New("stream doesn't contain bytes")
+	}
+	if s.reader != nil {
+		return s.reader.Read(p)
+	}
+	for len(s.buffer) == 0 {
+		chunk, err := s.next()
+		if err != nil {
+			return 0, err
+		}
+		s.buffer = chunk
+	}
+	n := copy(p, s.buffer)
+	s.buffer = s.buffer[n:]
+	return n, nil
+}
+
+// Values returns the channel that receives values from the stream of values.
+// The channel is closed at the end of stream. Err returns the reason if the stream ends with error.
+func (s *Stream) Values() <-chan interface{} {
+	s.valuesOnce.Do(func() {
+		s.values = make(chan interface{})
+		go func() {
+			defer close(s.values)
+			if s.kind != streamValues {
+				s.err = errors.New("stream doesn't contain values")
+				return
+			}
+			for {
+				chunk, err := s.next()
+				if err != nil {
+					return
+				}
+				var value interface{}
+				err = s.codec.Decode(chunk, &value)
+				if err != nil {
+					s.err = err
+					s.Close()
+					return
+				}
+				select {
+				case s.values <- value:
+				case <-s.done:
+					return
+				}
+			}
+		}()
+	})
+	return s.values
+}
+
+// Err returns the error that the stream ends with. It returns nil if the stream ends successfully.
+func (s *Stream) Err() error {
+	if s.err == io.EOF {
+		return nil
+	}
+	return s.err
+}
+
+// Close stops receiving the stream. The sender is notified to stop sending.
+func (s *Stream) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		if s.reader != nil {
+			if closer, ok := s.reader.(io.Closer); ok {
+				closer.Close()
+			}
+			return
+		}
+		if s.table != nil && s.table.cancelReceiver(s.key) {
+			s.key.socket.Write(archiveStreamMessage(StreamCancel, s.key, nil))
+		}
+	})
+	return nil
+}
+
+func (s *Stream) next() ([]byte, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	var msg *message
+	var ok bool
+	select {
+	case msg, ok = <-s.chunks:
+	case <-s.done:
+		s.err = errStreamCanceled
+		return nil, s.err
+	}
+	if !ok {
+		s.err = errStreamDisconnected
+		return nil, s.err
+	}
+	if msg.Type == StreamEnd {
+		if len(msg.body) > 0 {
+			s.err = errors.New(string(msg.body))
+		} else {
+			s.err = io.EOF
+		}
+		return nil, s.err
+	}
+	s.consumed++
+	if s.consumed >= streamWindow/2 {
+		credits := make([]byte, 4)
+		binary.LittleEndian.PutUint32(credits, s.consumed)
+		s.key.socket.Write(archiveStreamMessage(StreamAck, s.key, credits))
+		s.consumed = 0
+	}
+	return msg.body, nil
+}
+
+// collect reads whole stream. It is used when the stream is received via Call.
+func (s *Stream) collect() (interface{}, error) {
+	defer s.Close()
+	if s.kind == streamBytes {
+		return ioutil.ReadAll(s)
+	}
+	var values []interface{}
+	for value := range s.Values() {
+		values = append(values, value)
+	}
+	return values, s.Err()
+}
+
+type streamSender struct {
+	lock    sync.Mutex
+	credits uint32
+	notify  chan struct{}
+	cancel  chan struct{}
+	once    sync.Once
+}
+
+func (s *streamSender) grant(credits uint32) {
+	s.lock.Lock()
+	s.credits += credits
+	s.lock.Unlock()
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// acquire waits until the receiver accepts one more chunk. It returns false if the stream is canceled.
+func (s *streamSender) acquire() bool {
+	for {
+		s.lock.Lock()
+		if s.credits > 0 {
+			s.credits--
+			s.lock.Unlock()
+			return true
+		}
+		s.lock.Unlock()
+		select {
+		case <-s.notify:
+		case <-s.cancel:
+			return false
+		}
+	}
+}
+
+func (s *streamSender) stop() {
+	s.once.Do(func() {
+		close(s.cancel)
+	})
+}
+
+// streamTable keeps the streams that are sent or received by Host or Plugin.
+type streamTable struct {
+	lock      sync.Mutex
+	receivers map[streamKey]*Stream
+	senders   map[streamKey]*streamSender
+}
+
+func newStreamTable() *streamTable {
+	return &streamTable{
+		receivers: make(map[streamKey]*Stream),
+		senders:   make(map[streamKey]*streamSender),
+	}
+}
+
+// addReceiver registers the stream before the other side starts sending it.
+func (t *streamTable) addReceiver(key streamKey, kind string, c Codec) *Stream {
+	s := &Stream{
+		kind:   kind,
+		codec:  c,
+		key:    key,
+		table:  t,
+		chunks: make(chan *message, streamWindow+1),
+		done:   make(chan struct{}),
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.receivers[key] = s
+	return s
+}
+
+// setOnClose registers the function that is called when the stream ends.
+// If the stream already ends, it is called immediately.
+func (t *streamTable) setOnClose(s *Stream, onClose func()) {
+	t.lock.Lock()
+	if _, ok := t.receivers[s.key]; ok {
+		s.onClose = onClose
+		onClose = nil
+	}
+	t.lock.Unlock()
+	if onClose != nil {
+		onClose()
+	}
+}
+
+// removeReceiver forgets the stream that is not started.
+func (t *streamTable) removeReceiver(key streamKey) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.receivers, key)
+}
+
+// cancelReceiver marks the stream to drop further chunks. It returns true if the stream is still alive.
+func (t *streamTable) cancelReceiver(key streamKey) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	s, ok := t.receivers[key]
+	if !ok || s.closed {
+		return false
+	}
+	s.closed = true
+	return true
+}
+
+// finishReceiver is called with lock when the stream ends.
+func (t *streamTable) finishReceiver(s *Stream) func() {
+	delete(t.receivers, s.key)
+	close(s.chunks)
+	return s.onClose
+}
+
+func (t *streamTable) dispatch(socket net.Conn, msg *message) {
+	if len(msg.body) < 4 {
+		return
+	}
+	key := streamKey{socket: socket, session: msg.ID, index: binary.LittleEndian.Uint32(msg.body)}
+	payload := msg.body[4:]
+	switch msg.Type {
+	case StreamChunk, StreamEnd:
+		var onClose func()
+		t.lock.Lock()
+		s, ok := t.receivers[key]
+		if ok {
+			if msg.Type == StreamEnd {
+				if !s.closed {
+					select {
+					case s.chunks <- &message{Type: StreamEnd, ID: msg.ID, body: payload}:
+					default:
+					}
+				}
+				onClose = t.finishReceiver(s)
+			} else if !s.closed {
+				select {
+				case s.chunks <- &message{Type: StreamChunk, ID: msg.ID, body: payload}:
+				default:
+					// the sender ignores flow control
+					s.closed = true
+					socket.Write(archiveStreamMessage(StreamCancel, key, nil))
+				}
+			}
+		}
+		t.lock.Unlock()
+		if !ok && msg.Type == StreamChunk {
+			// nobody reads it
+			socket.Write(archiveStreamMessage(StreamCancel, key, nil))
+		}
+		if onClose != nil {
+			onClose()
+		}
+	case StreamAck:
+		if len(payload) < 4 {
+			return
+		}
+		t.lock.Lock()
+		s, ok := t.senders[key]
+		t.lock.Unlock()
+		if ok {
+			s.grant(binary.LittleEndian.Uint32(payload))
+		}
+	case StreamCancel:
+		t.lock.Lock()
+		s, ok := t.senders[key]
+		t.lock.Unlock()
+		if ok {
+			s.stop()
+		}
+	}
+}
+
+// closeSocket stops all streams on the socket. It is called when the connection is closed.
+func (t *streamTable) closeSocket(socket net.Conn) {
+	var onCloses []func()
+	t.lock.Lock()
+	for key, s := range t.receivers {
+		if key.socket == socket {
+			onCloses = append(onCloses, t.finishReceiver(s))
+		}
+	}
+	for key, s := range t.senders {
+		if key.socket == socket {
+			s.stop()
+		}
+	}
+	t.lock.Unlock()
+	for _, onClose := range onCloses {
+		if onClose != nil {
+			onClose()
+		}
+	}
+}
+
+func (t *streamTable) addSender(key streamKey) *streamSender {
+	s := &streamSender{
+		credits: streamWindow,
+		notify:  make(chan struct{}, 1),
+		cancel:  make(chan struct{}),
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.senders[key] = s
+	return s
+}
+
+// send sends value as a stream. The stream always ends with StreamEnd even if it is canceled.
+func (t *streamTable) send(key streamKey, sender *streamSender, c Codec, value interface{}, maxFrameSize uint32) {
+	defer func() {
+		t.lock.Lock()
+		delete(t.senders, key)
+		t.lock.Unlock()
+	}()
+	var err error
+	if reader, ok := value.(io.Reader); ok {
+		err = t.sendBytes(key, sender, reader, maxFrameSize)
+		if closer, ok := reader.(io.Closer); ok {
+			closer.Close()
+		}
+	} else {
+		err = t.sendValues(key, sender, c, reflect.ValueOf(value), maxFrameSize)
+	}
+	var payload []byte
+	if err != nil {
+		payload = []byte(err.Error())
+	}
+	key.socket.Write(archiveStreamMessage(StreamEnd, key, payload))
+}
+
+// bytesChunkSize returns the size of chunks that fit in maxFrameSize with the stream index.
+// It is at least 1 even if maxFrameSize is too small.
+func bytesChunkSize(maxFrameSize uint32) int {
+	if maxFrameSize <= 4 {
+		return 1
+	}
+	if maxFrameSize-4 < uint32(streamChunkSize) {
+		return int(maxFrameSize - 4)
+	}
+	return streamChunkSize
+}
+
+func (t *streamTable) sendBytes(key streamKey, sender *streamSender, reader io.Reader, maxFrameSize uint32) error {
+	buffer := make([]byte, bytesChunkSize(maxFrameSize))
+	for {
+		n, err := reader.Read(buffer)
+		if n > 0 {
+			if !sender.acquire() {
+				return errStreamCanceled
+			}
+			_, writeErr := key.socket.Write(archiveStreamMessage(StreamChunk, key, buffer[:n]))
+			if writeErr != nil {
+				return writeErr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+func (t *streamTable) sendValues(key streamKey, sender *streamSender, c Codec, channel reflect.Value, maxFrameSize uint32) error {
+	cases := []reflect.SelectCase{
+		{Dir: reflect.SelectRecv, Chan: channel},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(sender.cancel)},
+	}
+	for {
+		chosen, value, ok := reflect.Select(cases)
+		if chosen == 1 {
+			return errStreamCanceled
+		}
+		if !ok {
+			return nil
+		}
+		data, err := c.Encode(value.Interface())
+		if err != nil {
+			return err
+		}
+		if bodySize := uint32(len(data) + 4); bodySize > maxFrameSize {
+			return &FrameSizeError{Size: bodySize, Limit: maxFrameSize}
+		}
+		if !sender.acquire() {
+			return errStreamCanceled
+		}
+		_, err = key.socket.Write(archiveStreamMessage(StreamChunk, key, data))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// sendArguments starts sending stream arguments of the call. It returns the function to stop them.
+func (t *streamTable) sendArguments(socket net.Conn, sessionID uint32, c Codec, streams map[uint32]interface{}, maxFrameSize uint32) func() {
+	if len(streams) == 0 {
+		return func() {}
+	}
+	var senders []*streamSender
+	for index, value := range streams {
+		key := streamKey{socket: socket, session: sessionID, index: index}
+		sender := t.addSender(key)
+		senders = append(senders, sender)
+		go t.send(key, sender, c, value, maxFrameSize)
+	}
+	return func() {
+		for _, sender := range senders {
+			sender.stop()
+		}
+	}
+}
+
+// receiveArguments replaces placeholders in params by the streams that receive the arguments.
+// It should be called before reading next message from socket.
+//
+// Stream of bytes is passed to method as *Stream (io.ReadCloser) and stream of values is passed
+// as <-chan interface{}.
+func (t *streamTable) receiveArguments(socket net.Conn, sessionID uint32, c Codec, params []interface{}) []*Stream {
+	var streams []*Stream
+	for i, param := range params {
+		kind := streamPlaceholderKind(param)
+		if kind == "" {
+			continue
+		}
+		s := t.addReceiver(streamKey{socket: socket, session: sessionID, index: uint32(i + 1)}, kind, c)
+		streams = append(streams, s)
+		if kind == streamBytes {
+			params[i] = s
+		} else {
+			params[i] = s.Values()
+		}
+	}
+	return streams
+}
@@ -0,0 +1,180 @@
+package tobubus
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+type streamService struct {
+	data []byte
+}
+
+func (s *streamService) Rows(count int64) <-chan int64 {
+	rows := make(chan int64)
+	go func() {
+		defer close(rows)
+		for i := int64(0); i < count; i++ {
+			rows <- i
+		}
+	}()
+	return rows
+}
+
+func (s *streamService) Image() io.Reader {
+	return bytes.NewReader(s.data)
+}
+
+func (s *streamService) Size(reader io.Reader) int64 {
+	data, _ := ioutil.ReadAll(reader)
+	return int64(len(data))
+}
+
+func (s *streamService) Sum(values <-chan interface{}) int64 {
+	var sum int64
+	for value := range values {
+		sum += value.(int64)
+	}
+	return sum
+}
+
+func startStreamTest(t *testing.T, pipeName string) (*Host, *Plugin, *streamService) {
+	service := &streamService{data: bytes.Repeat([]byte("0123456789abcdef"), streamChunkSize*streamWindow/8)}
+	host := NewHost(pipeName)
+	err := host.Listen()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	plugin, err := NewPlugin(pipeName, "github.com/shibukawa/tobubus/stream")
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	plugin.Publish("/stream", service)
+	err = plugin.Connect()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	return host, plugin, service
+}
+
+func TestCallStreamValues(t *testing.T) {
+	host, plugin, _ := startStreamTest(t, "tobubus.stream.values")
+	defer host.Close()
+	defer plugin.Close()
+	stream, err := host.CallStream("/stream", "Rows", int64(100))
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	var count int64
+	for value := range stream.Values() {
+		if value.(int64) != count {
+			t.Errorf("value should be %d, but %v", count, value)
+		}
+		count++
+	}
+	if count != 100 {
+		t.Errorf("stream should have 100 values, but %d", count)
+	}
+	if stream.Err() != nil {
+		t.Errorf("err should be nil, but %v", stream.Err())
+	}
+}
+
+func TestCallStreamBytes(t *testing.T) {
+	host, plugin, service := startStreamTest(t, "tobubus.stream.bytes")
+	defer host.Close()
+	defer plugin.Close()
+	stream, err := host.CallStream("/stream", "Image")
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	data, err := ioutil.ReadAll(stream)
+	if err != nil {
+		t.Errorf("err should be nil, but %v", err)
+	}
+	if !bytes.Equal(data, service.data) {
+		t.Errorf("stream should have %d bytes, but %d", len(service.data), len(data))
+	}
+}
+
+func TestCallStreamCloseEarly(t *testing.T) {
+	host, plugin, _ := startStreamTest(t, "tobubus.stream.close")
+	defer host.Close()
+	defer plugin.Close()
+	stream, err := host.CallStream("/stream", "Rows", int64(100000))
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	<-stream.Values()
+	stream.Close()
+	// the connection is still available
+	result, err := host.Call("/stream", "Rows", int64(3))
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	if values := result[0].([]interface{}); len(values) != 3 {
+		t.Errorf("Call should collect 3 values, but %v", values)
+	}
+}
+
+func TestCallWithStreamArguments(t *testing.T) {
+	host, plugin, service := startStreamTest(t, "tobubus.stream.args")
+	defer host.Close()
+	defer plugin.Close()
+	result, err := host.Call("/stream", "Size", bytes.NewReader(service.data))
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	if result[0] != int64(len(service.data)) {
+		t.Errorf("Size should return %d, but %v", len(service.data), result[0])
+	}
+	values := make(chan int64)
+	go func() {
+		for i := int64(1); i <= 100; i++ {
+			values <- i
+		}
+		close(values)
+	}()
+	result, err = host.Call("/stream", "Sum", values)
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	if result[0] != int64(5050) {
+		t.Errorf("Sum should return 5050, but %v", result[0])
+	}
+}
+
+func TestCallStreamLocal(t *testing.T) {
+	host := newHostForTest("pipe.test")
+	host.Publish("/stream", &streamService{})
+	stream, err := host.CallStream("/stream", "Rows", int64(3))
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	var count int
+	for range stream.Values() {
+		count++
+	}
+	if count != 3 {
+		t.Errorf("stream should have 3 values, but %d", count)
+	}
+	_, err = host.CallStream("/stream", "Size", bytes.NewReader(nil))
+	if err == nil {
+		t.Error("err should not be nil for the method that doesn't return stream")
+	}
+}
+
+func TestBytesChunkSize(t *testing.T) {
+	if size := bytesChunkSize(DefaultMaxFrameSize); size != streamChunkSize {
+		t.Errorf("chunk size should be %d, but %d", streamChunkSize, size)
+	}
+	if size := bytesChunkSize(10); size != 6 {
+		t.Errorf("chunk size should be 6, but %d", size)
+	}
+	for _, maxFrameSize := range []uint32{0, 3, 4} {
+		if size := bytesChunkSize(maxFrameSize); size != 1 {
+			t.Errorf("chunk size should be 1 for %d, but %d", maxFrameSize, size)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+// Package tobubustest provides helpers to test host and plugins in the same process.
+//
+//	bus := tobubustest.Start(t, tobubustest.Plugin{
+//		ID:      "github.com/shibukawa/editor",
+//		Objects: map[string]interface{}{"/editor": &Editor{}},
+//	})
+//	defer bus.Close()
+//	result, err := bus.Host.Call("/editor", "Open", "readme.txt")
+package tobubustest
+
+import (
+	"github.com/shibukawa/tobubus"
+	"testing"
+)
+
+// Address is the address the host listens on in the in-process transport.
+const Address = "tobubustest"
+
+// Plugin describes the plugin that is connected to the host.
+type Plugin struct {
+	ID      string
+	Objects map[string]interface{} // path -> object published before connecting
+}
+
+// Bus is a host and plugins connected via tobubus.InProcessTransport.
+type Bus struct {
+	Host      *tobubus.Host
+	Plugins   map[string]*tobubus.Plugin // plugin ID -> plugin
+	Transport *tobubus.InProcessTransport
+
+	t testing.TB
+}
+
+// Start starts the host and connects the plugins. It fails the test if any of them can't start.
+func Start(t testing.TB, plugins ...Plugin) *Bus {
+	transport := tobubus.NewInProcessTransport()
+	host := tobubus.NewHostWithTransport(Address, transport)
+	err := host.Listen()
+	if err != nil {
+		t.Fatalf("Can't start host: %v", err)
+	}
+	bus := &Bus{
+		Host:      host,
+		Plugins:   make(map[string]*tobubus.Plugin),
+		Transport: transport,
+		t:         t,
+	}
+	for _, plugin := range plugins {
+		bus.Connect(plugin)
+	}
+	return bus
+}
+
+// Connect connects one more plugin to the host.
+func (b *Bus) Connect(plugin Plugin) *tobubus.Plugin {
+	p, err := tobubus.NewPluginWithTransport(Address, plugin.ID, b.Transport)
+	if err != nil {
+		b.t.Fatalf("Can't create plugin '%s': %v", plugin.ID, err)
+	}
+	for path, obj := range plugin.Objects {
+		err = p.Publish(path, obj)
+		if err != nil {
+			b.t.Fatalf("Can't publish object at '%s' of plugin '%s': %v", path, plugin.ID, err)
+		}
+	}
+	err = p.Connect()
+	if err != nil {
+		b.t.Fatalf("Can't connect plugin '%s': %v", plugin.ID, err)
+	}
+	b.Plugins[plugin.ID] = p
+	return p
+}
+
+// Close disconnects all plugins and stops the host.
+func (b *Bus) Close() {
+	for id, plugin := range b.Plugins {
+		plugin.Close()
+		delete(b.Plugins, id)
+	}
+	b.Host.Close()
+}
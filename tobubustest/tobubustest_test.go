@@ -0,0 +1,33 @@
+package tobubustest
+
+import (
+	"testing"
+)
+
+type echo struct {
+	prefix string
+}
+
+func (e *echo) Echo(message string) string {
+	return e.prefix + message
+}
+
+func TestStart(t *testing.T) {
+	bus := Start(t,
+		Plugin{ID: "github.com/shibukawa/tobubus/1", Objects: map[string]interface{}{"/plugin1": &echo{prefix: "1:"}}},
+		Plugin{ID: "github.com/shibukawa/tobubus/2", Objects: map[string]interface{}{"/plugin2": &echo{prefix: "2:"}}},
+	)
+	defer bus.Close()
+	bus.Host.Publish("/host", &echo{prefix: "host:"})
+	result, err := bus.Host.Call("/plugin2", "Echo", "hello")
+	if err != nil || result[0] != "2:hello" {
+		t.Errorf("Echo should return '2:hello', but %v (%v)", result, err)
+	}
+	result, err = bus.Plugins["github.com/shibukawa/tobubus/1"].Call("/host", "Echo", "hello")
+	if err != nil || result[0] != "host:hello" {
+		t.Errorf("Echo should return 'host:hello', but %v (%v)", result, err)
+	}
+	if bus.Host.GetSocket("github.com/shibukawa/tobubus/1") == nil {
+		t.Error("plugin should be registered")
+	}
+}
@@ -0,0 +1,227 @@
+package tobubus
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metadata keys of W3C trace context.
+const (
+	TraceParentKey = "traceparent"
+	TraceStateKey  = "tracestate"
+)
+
+// SpanContext identifies the span in W3C trace context (https://www.w3.org/TR/trace-context/).
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Flags   byte   // 0x1 is sampled
+	State   string // tracestate header
+}
+
+// IsValid returns true if both trace ID and span ID are not zero.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// TraceParent returns the traceparent header like "00-<trace ID>-<span ID>-01".
+func (sc SpanContext) TraceParent() string {
+	return fmt.Sprintf("00-%s-%s-%02x", hex.EncodeToString(sc.TraceID[:]), hex.EncodeToString(sc.SpanID[:]), sc.Flags)
+}
+
+// ParseTraceParent parses traceparent and tracestate headers.
+func ParseTraceParent(traceParent, traceState string) (SpanContext, error) {
+	var sc SpanContext
+	fields := strings.Split(traceParent, "-")
+	if len(fields) < 4 || len(fields[0]) != 2 || fields[0] == "ff" || (fields[0] == "00" && len(fields) != 4) {
+		return sc, fmt.Errorf("invalid traceparent: '%s'", traceParent)
+	}
+	if len(fields[1]) != 32 || len(fields[2]) != 16 || len(fields[3]) != 2 {
+		return sc, fmt.Errorf("invalid traceparent: '%s'", traceParent)
+	}
+	var flags [1]byte
+	_, err1 := hex.Decode(sc.TraceID[:], []byte(fields[1]))
+	_, err2 := hex.Decode(sc.SpanID[:], []byte(fields[2]))
+	_, err3 := hex.Decode(flags[:], []byte(fields[3]))
+	if err1 != nil || err2 != nil || err3 != nil || !sc.IsValid() {
+		return SpanContext{}, fmt.Errorf("invalid traceparent: '%s'", traceParent)
+	}
+	sc.Flags = flags[0]
+	sc.State = traceState
+	return sc, nil
+}
+
+type spanContextKey struct{}
+
+// ContextWithSpanContext returns the context that carries sc. Calls made with the context continue the trace.
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+// SpanContextFromContext returns the span context set by ContextWithSpanContext. If it is not set,
+// it returns the span context of the published method call that ctx is passed to.
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	if sc, ok := ctx.Value(spanContextKey{}).(SpanContext); ok {
+		return sc
+	}
+	if info, ok := CallInfoFromContext(ctx); ok {
+		return info.Trace
+	}
+	return SpanContext{}
+}
+
+// SpanKind tells which side of the call the span is.
+type SpanKind int
+
+const (
+	SpanClient SpanKind = iota // around Host.Call and Plugin.Call
+	SpanServer                 // around the published method called by the other side
+)
+
+func (k SpanKind) String() string {
+	if k == SpanServer {
+		return "server"
+	}
+	return "client"
+}
+
+// Span is the span started by Tracer.
+type Span interface {
+	Context() SpanContext
+	// End finishes the span. err is nil if the call succeeded.
+	End(err error)
+}
+
+// Tracer starts spans around calls. Host and Plugin send the span context to the other side
+// in the metadata of CallMethod.
+type Tracer interface {
+	// Start starts the span of the call described by info. parent is invalid if the call starts a new trace.
+	Start(parent SpanContext, kind SpanKind, info *CallInfo) Span
+}
+
+// startSpan starts the span and sets its context to info.Trace.
+// Without tracer, the parent is passed through to keep the trace of the other side.
+func startSpan(tracer Tracer, parent SpanContext, kind SpanKind, info *CallInfo) Span {
+	if tracer == nil {
+		info.Trace = parent
+		return nil
+	}
+	span := tracer.Start(parent, kind, info)
+	info.Trace = span.Context()
+	return span
+}
+
+func endSpan(span Span, err error) {
+	if span != nil {
+		span.End(err)
+	}
+}
+
+// traceMetadata returns the metadata of CallMethod that carries sc.
+func traceMetadata(sc SpanContext) map[string]string {
+	if !sc.IsValid() {
+		return nil
+	}
+	metadata := map[string]string{TraceParentKey: sc.TraceParent()}
+	if sc.State != "" {
+		metadata[TraceStateKey] = sc.State
+	}
+	return metadata
+}
+
+// traceFromMetadata returns the span context in metadata of CallMethod. It is invalid if the caller doesn't trace.
+func traceFromMetadata(metadata map[string]string) SpanContext {
+	traceParent, ok := metadata[TraceParentKey]
+	if !ok {
+		return SpanContext{}
+	}
+	sc, err := ParseTraceParent(traceParent, metadata[TraceStateKey])
+	if err != nil {
+		return SpanContext{}
+	}
+	return sc
+}
+
+// NewSpanContext returns the context of new span. It is a child of parent if parent is valid.
+func NewSpanContext(parent SpanContext) SpanContext {
+	sc := parent
+	if !parent.IsValid() {
+		rand.Read(sc.TraceID[:])
+		sc.Flags = 0x1
+	}
+	rand.Read(sc.SpanID[:])
+	return sc
+}
+
+// RecordedSpan is the span recorded by InMemoryTracer.
+type RecordedSpan struct {
+	Name     string // "<path>#<method>"
+	Kind     SpanKind
+	Context  SpanContext
+	Parent   SpanContext
+	PluginID string
+	Start    time.Time
+	End      time.Time
+	Err      error
+}
+
+// InMemoryTracer is Tracer that keeps finished spans in memory. It is for tests.
+type InMemoryTracer struct {
+	lock  sync.Mutex
+	spans []RecordedSpan
+}
+
+// NewInMemoryTracer creates InMemoryTracer.
+func NewInMemoryTracer() *InMemoryTracer {
+	return &InMemoryTracer{}
+}
+
+func (t *InMemoryTracer) Start(parent SpanContext, kind SpanKind, info *CallInfo) Span {
+	return &inMemorySpan{
+		tracer: t,
+		span: RecordedSpan{
+			Name:     info.Path + "#" + info.Method,
+			Kind:     kind,
+			Context:  NewSpanContext(parent),
+			Parent:   parent,
+			PluginID: info.PluginID,
+			Start:    time.Now(),
+		},
+	}
+}
+
+// Spans returns the finished spans in the order they ended.
+func (t *InMemoryTracer) Spans() []RecordedSpan {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return append([]RecordedSpan(nil), t.spans...)
+}
+
+// Reset drops the finished spans.
+func (t *InMemoryTracer) Reset() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.spans = nil
+}
+
+type inMemorySpan struct {
+	tracer *InMemoryTracer
+	span   RecordedSpan
+}
+
+func (s *inMemorySpan) Context() SpanContext {
+	return s.span.Context
+}
+
+func (s *inMemorySpan) End(err error) {
+	s.span.End = time.Now()
+	s.span.Err = err
+	s.tracer.lock.Lock()
+	defer s.tracer.lock.Unlock()
+	s.tracer.spans = append(s.tracer.spans, s.span)
+}
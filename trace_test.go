@@ -0,0 +1,140 @@
+package tobubus
+
+import (
+	"context"
+	"testing"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	traceParent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, err := ParseTraceParent(traceParent, "vendor=value")
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	if sc.TraceParent() != traceParent || sc.State != "vendor=value" || sc.Flags != 1 {
+		t.Errorf("span context is wrong: %s %s", sc.TraceParent(), sc.State)
+	}
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+	} {
+		if _, err := ParseTraceParent(invalid, ""); err == nil {
+			t.Errorf("'%s' should be invalid", invalid)
+		}
+	}
+}
+
+type tracedStruct struct {
+	plugin *Plugin
+}
+
+func (ts *tracedStruct) Fetch(ctx context.Context, arg string) (string, error) {
+	result, err := ts.plugin.CallContext(ctx, "/host", "TestMethod", arg)
+	if err != nil {
+		return "", err
+	}
+	return result[0].(string), nil
+}
+
+func findSpan(spans []RecordedSpan, name string, kind SpanKind) *RecordedSpan {
+	for i := range spans {
+		if spans[i].Name == name && spans[i].Kind == kind {
+			return &spans[i]
+		}
+	}
+	return nil
+}
+
+func TestTracePropagation(t *testing.T) {
+	transport := NewInProcessTransport()
+	hostTracer := NewInMemoryTracer()
+	host := NewHostWithTransport("tobubus.trace", transport)
+	host.SetTracer(hostTracer)
+	host.Publish("/host", &testStruct{result: "ok"})
+	err := host.Listen()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	defer host.Close()
+	pluginTracer := NewInMemoryTracer()
+	plugin, err := NewPluginWithTransport("tobubus.trace", "github.com/shibukawa/tobubus/trace", transport)
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	plugin.SetTracer(pluginTracer)
+	plugin.Publish("/plugin", &tracedStruct{plugin: plugin})
+	err = plugin.Connect()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	defer plugin.Close()
+
+	result, err := host.Call("/plugin", "Fetch", "arg")
+	if err != nil || result[0] != "ok" {
+		t.Fatalf("result should be ok, but %v (%v)", result, err)
+	}
+	var hostSpans, pluginSpans []RecordedSpan
+	waitUntil(func() bool {
+		hostSpans, pluginSpans = hostTracer.Spans(), pluginTracer.Spans()
+		return len(hostSpans) == 2 && len(pluginSpans) == 2
+	})
+	root := findSpan(hostSpans, "/plugin#Fetch", SpanClient)
+	fetch := findSpan(pluginSpans, "/plugin#Fetch", SpanServer)
+	nested := findSpan(pluginSpans, "/host#TestMethod", SpanClient)
+	nestedServer := findSpan(hostSpans, "/host#TestMethod", SpanServer)
+	if root == nil || fetch == nil || nested == nil || nestedServer == nil {
+		t.Fatalf("spans are missing: %v %v", hostSpans, pluginSpans)
+	}
+	if root.Parent.IsValid() {
+		t.Errorf("Host.Call should start new trace, but parent is %s", root.Parent.TraceParent())
+	}
+	if fetch.Parent != root.Context {
+		t.Errorf("remote span should continue the span of Host.Call: %s, %s", fetch.Parent.TraceParent(), root.Context.TraceParent())
+	}
+	if nested.Parent != fetch.Context {
+		t.Errorf("nested call should continue the span of handler: %s, %s", nested.Parent.TraceParent(), fetch.Context.TraceParent())
+	}
+	if nestedServer.Parent != nested.Context || nestedServer.PluginID != "github.com/shibukawa/tobubus/trace" {
+		t.Errorf("host should continue the span of nested call: %s, %s", nestedServer.Parent.TraceParent(), nested.Context.TraceParent())
+	}
+	if nestedServer.Context.TraceID != root.Context.TraceID {
+		t.Error("all spans should have the same trace ID")
+	}
+}
+
+func TestTraceWithoutTracer(t *testing.T) {
+	transport := NewInProcessTransport()
+	host := NewHostWithTransport("tobubus.notrace", transport)
+	var received SpanContext
+	host.UseServerInterceptor(func(info *CallInfo, params []interface{}, next Invoker) ([]interface{}, error) {
+		received = info.Trace
+		return next(info, params)
+	})
+	host.Publish("/host", &testStruct{result: "ok"})
+	err := host.Listen()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	defer host.Close()
+	plugin, err := NewPluginWithTransport("tobubus.notrace", "github.com/shibukawa/tobubus/notrace", transport)
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	err = plugin.Connect()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	defer plugin.Close()
+	sc := NewSpanContext(SpanContext{})
+	_, err = plugin.CallContext(ContextWithSpanContext(context.Background(), sc), "/host", "TestMethod", "arg")
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	if received != sc {
+		t.Errorf("trace context should be passed through, but %s", received.TraceParent())
+	}
+}
@@ -0,0 +1,158 @@
+package tobubus
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/shibukawa/localsocket"
+	"net"
+	"sync"
+)
+
+// Transport creates the connections between host and plugins.
+//
+// Host listens on the address via Listen and plugins connect to it via Dial.
+type Transport interface {
+	Listen(address string) (net.Listener, error)
+	Dial(address string) (net.Conn, error)
+}
+
+// PluginIDVerifier is implemented by the transports that can authenticate the plugin ID by themselves
+// (e.g. by client certificates). Host rejects ConnectClient if VerifyPluginID returns error.
+type PluginIDVerifier interface {
+	VerifyPluginID(conn net.Conn, pluginID string) error
+}
+
+type localTransport struct{}
+
+// LocalTransport uses unix domain socket (${TMP}/<address>) or Windows named pipe (\\.\pipe\<address>).
+// It is the default transport.
+var LocalTransport Transport = localTransport{}
+
+func (localTransport) Listen(address string) (net.Listener, error) {
+	l := &localListener{
+		server:      localsocket.NewLocalServer(address),
+		address:     address,
+		connections: make(chan net.Conn),
+		closed:      make(chan struct{}),
+	}
+	l.server.SetOnConnectionCallback(func(socket net.Conn) {
+		select {
+		case l.connections <- socket:
+		case <-l.closed:
+			socket.Close()
+		}
+	})
+	err := l.server.Listen()
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (localTransport) Dial(address string) (net.Conn, error) {
+	return localsocket.NewLocalSocket(address)
+}
+
+// localListener adapts the callback style of localsocket.LocalServer to net.Listener.
+type localListener struct {
+	server      *localsocket.LocalServer
+	address     string
+	connections chan net.Conn
+	closed      chan struct{}
+	once        sync.Once
+}
+
+func (l *localListener) Accept() (net.Conn, error) {
+	select {
+	case socket := <-l.connections:
+		return socket, nil
+	case <-l.closed:
+		return nil, errors.New("listener is closed")
+	}
+}
+
+func (l *localListener) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.closed)
+		err = l.server.Close()
+	})
+	return err
+}
+
+func (l *localListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: l.address, Net: "unix"}
+}
+
+type tcpTransport struct{}
+
+// TCPTransport connects host and plugins via TCP. Address is "host:port".
+//
+// It doesn't authenticate plugins. Use it only in trusted networks, or use TLS transport.
+var TCPTransport Transport = tcpTransport{}
+
+func (tcpTransport) Listen(address string) (net.Listener, error) {
+	return net.Listen("tcp", address)
+}
+
+func (tcpTransport) Dial(address string) (net.Conn, error) {
+	return net.Dial("tcp", address)
+}
+
+// TLSTransport connects host and plugins via TLS over TCP.
+//
+// For mutual authentication, host's config should have ClientAuth: tls.RequireAndVerifyClientCert and ClientCAs,
+// and plugins' config should have Certificates. Then the plugin ID should be one of the common name, DNS names
+// and URIs of the client certificate.
+type TLSTransport struct {
+	config *tls.Config
+}
+
+// NewTLSTransport creates TLSTransport. Host and plugins use their own configs.
+func NewTLSTransport(config *tls.Config) *TLSTransport {
+	return &TLSTransport{config: config}
+}
+
+func (t *TLSTransport) Listen(address string) (net.Listener, error) {
+	return tls.Listen("tcp", address, t.config)
+}
+
+func (t *TLSTransport) Dial(address string) (net.Conn, error) {
+	return tls.Dial("tcp", address, t.config)
+}
+
+// VerifyPluginID checks that the client certificate is issued for the plugin ID.
+// It accepts all plugin IDs if host doesn't request client certificates.
+func (t *TLSTransport) VerifyPluginID(conn net.Conn, pluginID string) error {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return errors.New("connection is not TLS")
+	}
+	err := tlsConn.Handshake()
+	if err != nil {
+		return err
+	}
+	if t.config.ClientAuth < tls.VerifyClientCertIfGiven {
+		return nil
+	}
+	certificates := tlsConn.ConnectionState().PeerCertificates
+	if len(certificates) == 0 {
+		return fmt.Errorf("plugin '%s' doesn't have client certificate", pluginID)
+	}
+	cert := certificates[0]
+	if cert.Subject.CommonName == pluginID {
+		return nil
+	}
+	for _, name := range cert.DNSNames {
+		if name == pluginID {
+			return nil
+		}
+	}
+	for _, uri := range cert.URIs {
+		if uri.String() == pluginID {
+			return nil
+		}
+	}
+	return fmt.Errorf("client certificate is not issued for plugin '%s'", pluginID)
+}
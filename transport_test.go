@@ -0,0 +1,169 @@
+package tobubus
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func startTransportTest(t *testing.T, host *Host, plugin *Plugin) {
+	err := plugin.Publish("/plugin", &testStruct{result: "from plugin"})
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	err = plugin.Connect()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	result, err := host.Call("/plugin", "TestMethod", "arg")
+	if err != nil || result[0] != "from plugin" {
+		t.Errorf("TestMethod should return 'from plugin', but %v (%v)", result, err)
+	}
+	result, err = plugin.Call("/host", "TestMethod", "arg")
+	if err != nil || result[0] != "from host" {
+		t.Errorf("TestMethod should return 'from host', but %v (%v)", result, err)
+	}
+}
+
+func TestTCPTransport(t *testing.T) {
+	host := NewHostWithTransport("127.0.0.1:0", TCPTransport)
+	host.Publish("/host", &testStruct{result: "from host"})
+	err := host.Listen()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	defer host.Close()
+	plugin, err := NewPluginWithTransport(host.Addr().String(), "github.com/shibukawa/tobubus/tcp", TCPTransport)
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	defer plugin.Close()
+	startTransportTest(t, host, plugin)
+}
+
+type testCertificates struct {
+	pool   *x509.CertPool
+	server tls.Certificate
+	issue  func(commonName string) tls.Certificate
+}
+
+func newTestCertificates(t *testing.T) *testCertificates {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "tobubus test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	serial := int64(1)
+	issue := func(template *x509.Certificate) tls.Certificate {
+		serial++
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		template.SerialNumber = big.NewInt(serial)
+		template.NotBefore = time.Now().Add(-time.Hour)
+		template.NotAfter = time.Now().Add(time.Hour)
+		der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatalf("err should be nil, but %v", err)
+		}
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	}
+	return &testCertificates{
+		pool: pool,
+		server: issue(&x509.Certificate{
+			Subject:     pkix.Name{CommonName: "host"},
+			IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}),
+		issue: func(commonName string) tls.Certificate {
+			return issue(&x509.Certificate{
+				Subject:     pkix.Name{CommonName: commonName},
+				ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+			})
+		},
+	}
+}
+
+func startTLSHost(t *testing.T, certs *testCertificates) *Host {
+	host := NewHostWithTransport("127.0.0.1:0", NewTLSTransport(&tls.Config{
+		Certificates: []tls.Certificate{certs.server},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    certs.pool,
+	}))
+	host.Publish("/host", &testStruct{result: "from host"})
+	err := host.Listen()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	return host
+}
+
+func TestTLSTransport(t *testing.T) {
+	certs := newTestCertificates(t)
+	host := startTLSHost(t, certs)
+	defer host.Close()
+	plugin, err := NewPluginWithTransport(host.Addr().String(), "github.com/shibukawa/tobubus/tls", NewTLSTransport(&tls.Config{
+		Certificates: []tls.Certificate{certs.issue("github.com/shibukawa/tobubus/tls")},
+		RootCAs:      certs.pool,
+	}))
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	defer plugin.Close()
+	startTransportTest(t, host, plugin)
+}
+
+func TestTLSTransportRejectsOtherPluginID(t *testing.T) {
+	certs := newTestCertificates(t)
+	host := startTLSHost(t, certs)
+	defer host.Close()
+	plugin, err := NewPluginWithTransport(host.Addr().String(), "github.com/shibukawa/tobubus/tls", NewTLSTransport(&tls.Config{
+		Certificates: []tls.Certificate{certs.issue("github.com/shibukawa/tobubus/other")},
+		RootCAs:      certs.pool,
+	}))
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	err = plugin.Connect()
+	if err == nil {
+		t.Error("err should not be nil")
+	}
+}
+
+func TestInProcessTransport(t *testing.T) {
+	transport := NewInProcessTransport()
+	host := NewHostWithTransport("tobubus.inprocess", transport)
+	host.Publish("/host", &testStruct{result: "from host"})
+	err := host.Listen()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	defer host.Close()
+	_, err = NewPluginWithTransport("tobubus.missing", "github.com/shibukawa/tobubus/inprocess", transport)
+	if err == nil {
+		t.Error("err should not be nil for the address no host listens on")
+	}
+	plugin, err := NewPluginWithTransport("tobubus.inprocess", "github.com/shibukawa/tobubus/inprocess", transport)
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	defer plugin.Close()
+	startTransportTest(t, host, plugin)
+}
@@ -1,10 +1,10 @@
 package tobubus
 
 import (
-	"github.com/shibukawa/localsocket"
 	"github.com/shibukawa/mockconn"
 	"net"
 	"testing"
+	"time"
 )
 
 type testStruct struct {
@@ -17,6 +17,31 @@ func (ts *testStruct) TestMethod(arg string) string {
 	return ts.result
 }
 
+// channelStruct passes the arguments to the test goroutine. It is for the methods called in other goroutines.
+type channelStruct struct {
+	args   chan string
+	result string
+}
+
+func newChannelStruct(result string) *channelStruct {
+	return &channelStruct{args: make(chan string, 1), result: result}
+}
+
+func (cs *channelStruct) TestMethod(arg string) string {
+	cs.args <- arg
+	return cs.result
+}
+
+// receive returns the argument of TestMethod. It returns empty string if the method isn't called.
+func (cs *channelStruct) receive() string {
+	select {
+	case arg := <-cs.args:
+		return arg
+	case <-time.After(time.Second):
+		return ""
+	}
+}
+
 func (ts *testStruct) testMethod(arg string) string {
 	ts.args = []string{arg}
 	return ts.result
@@ -25,25 +50,32 @@ func (ts *testStruct) testMethod(arg string) string {
 func newPluginForTest(pipeName, id string, t *testing.T) (*Plugin, *mockconn.Conn) {
 	socket := mockconn.New(t)
 	return &Plugin{
-		pipeName:  pipeName,
-		id:        id,
-		socket:    socket,
-		objectMap: make(map[string]*Proxy),
-		sessions:  newSessionManager(incrementStrategy),
+		pipeName:     pipeName,
+		id:           id,
+		socket:       socket,
+		objectMap:    make(map[string]*Proxy),
+		sessions:     newSessionManager(incrementStrategy),
+		streams:      newStreamTable(),
+		leases:       newLeaseTable(),
+		maxFrameSize: DefaultMaxFrameSize,
+		codec:        CborCodec,
 	}, socket
 }
 
 func newHostForTest(pipeName string) *Host {
-	server := localsocket.NewLocalServer(pipeName)
 	host := &Host{
-		server:               server,
+		pipeName:             pipeName,
+		transport:            LocalTransport,
 		sessions:             newSessionManager(incrementStrategy),
+		streams:              newStreamTable(),
+		leases:               newLeaseTable(),
 		pluginReservedSpaces: make(map[string]net.Conn),
 		localObjectMap:       make(map[string]*Proxy),
 		sockets:              make(map[string]net.Conn),
+		codecs:               make(map[net.Conn]Codec),
+		credentials:          make(map[net.Conn]*Credentials),
+		maxFrameSize:         DefaultMaxFrameSize,
+		authenticator:        SameUserAuthenticator,
 	}
-	server.SetOnConnectionCallback(func(socket net.Conn) {
-		go host.listenAndServeTo(socket)
-	})
 	return host
 }
@@ -0,0 +1,235 @@
+package tobubus
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// tokenVerifier is implemented by connections that authenticate plugins by the token in ConnectClient.
+type tokenVerifier interface {
+	verifyToken(pluginID, token string) error
+}
+
+// WebSocketTransport connects host and plugins via WebSocket. It is for plugins in browsers and web views.
+//
+// Each binary message carries the frames that Write receives, so browser plugins can send and receive
+// the same frames as plugins on other transports. Plugins should send the token via ConnectClient
+// (Plugin.SetToken for Go plugins). Host denies the other requests until the token is verified.
+//
+// Host listens on "host:port" and plugins connect to "ws://host:port/".
+type WebSocketTransport struct {
+	lock    sync.RWMutex
+	origins map[string]bool
+	tokens  map[string]string // plugin ID -> token
+	dialer  *websocket.Dialer
+}
+
+// NewWebSocketTransport creates WebSocketTransport. Requests from browsers are accepted only if their origins
+// are in origins ("*" accepts all). Requests without Origin header (non-browser plugins) are always accepted.
+func NewWebSocketTransport(origins ...string) *WebSocketTransport {
+	t := &WebSocketTransport{
+		origins: make(map[string]bool),
+		tokens:  make(map[string]string),
+		dialer:  websocket.DefaultDialer,
+	}
+	for _, origin := range origins {
+		t.origins[origin] = true
+	}
+	return t
+}
+
+// SetToken registers the token of the plugin. Plugins without tokens are rejected.
+func (t *WebSocketTransport) SetToken(pluginID, token string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.tokens[pluginID] = token
+}
+
+func (t *WebSocketTransport) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || t.origins["*"] {
+		return true
+	}
+	return t.origins[origin]
+}
+
+func (t *WebSocketTransport) verifyToken(pluginID, token string) error {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	expected, ok := t.tokens[pluginID]
+	if !ok || token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+		return fmt.Errorf("invalid token for plugin '%s'", pluginID)
+	}
+	return nil
+}
+
+func (t *WebSocketTransport) upgrade(w http.ResponseWriter, r *http.Request) (net.Conn, error) {
+	upgrader := websocket.Upgrader{CheckOrigin: t.checkOrigin}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &webSocketConn{conn: conn, transport: t}, nil
+}
+
+// Handler returns http.Handler that connects plugins to host. It is used to serve plugins
+// on the existing HTTP server instead of Listen.
+func (t *WebSocketTransport) Handler(host *Host) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := t.upgrade(w, r)
+		if err != nil {
+			return
+		}
+		host.ServeConn(conn)
+	})
+}
+
+func (t *WebSocketTransport) Listen(address string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	l := &webSocketListener{
+		listener:    listener,
+		connections: make(chan net.Conn),
+		closed:      make(chan struct{}),
+	}
+	l.server = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := t.upgrade(w, r)
+		if err != nil {
+			return
+		}
+		select {
+		case l.connections <- conn:
+		case <-l.closed:
+			conn.Close()
+		}
+	})}
+	go l.server.Serve(listener)
+	return l, nil
+}
+
+func (t *WebSocketTransport) Dial(address string) (net.Conn, error) {
+	conn, _, err := t.dialer.Dial(address, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &webSocketConn{conn: conn}, nil
+}
+
+type webSocketListener struct {
+	listener    net.Listener
+	server      *http.Server
+	connections chan net.Conn
+	closed      chan struct{}
+	once        sync.Once
+}
+
+func (l *webSocketListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.connections:
+		return conn, nil
+	case <-l.closed:
+		return nil, errors.New("listener is closed")
+	}
+}
+
+func (l *webSocketListener) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.closed)
+		err = l.server.Close()
+	})
+	return err
+}
+
+func (l *webSocketListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// webSocketConn adapts WebSocket connection to net.Conn. Each Write is sent as one binary message.
+type webSocketConn struct {
+	conn      *websocket.Conn
+	transport *WebSocketTransport // nil on plugin side
+	reader    io.Reader
+	readLock  sync.Mutex
+	writeLock sync.Mutex
+}
+
+func (c *webSocketConn) verifyToken(pluginID, token string) error {
+	if c.transport == nil {
+		return errors.New("token is verified only by host")
+	}
+	return c.transport.verifyToken(pluginID, token)
+}
+
+func (c *webSocketConn) Read(data []byte) (int, error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+	for {
+		if c.reader == nil {
+			messageType, reader, err := c.conn.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			if messageType != websocket.BinaryMessage {
+				continue
+			}
+			c.reader = reader
+		}
+		n, err := c.reader.Read(data)
+		if err == io.EOF {
+			c.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *webSocketConn) Write(data []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	err := c.conn.WriteMessage(websocket.BinaryMessage, data)
+	if err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func (c *webSocketConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *webSocketConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *webSocketConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *webSocketConn) SetDeadline(t time.Time) error {
+	err := c.conn.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+	return c.conn.SetWriteDeadline(t)
+}
+
+func (c *webSocketConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *webSocketConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
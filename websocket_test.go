@@ -0,0 +1,88 @@
+package tobubus
+
+import (
+	"github.com/gorilla/websocket"
+	"net/http"
+	"testing"
+)
+
+func startWebSocketHost(t *testing.T) (*Host, *WebSocketTransport) {
+	transport := NewWebSocketTransport("http://localhost:8080")
+	transport.SetToken("github.com/shibukawa/tobubus/websocket", "secret")
+	host := NewHostWithTransport("127.0.0.1:0", transport)
+	host.Publish("/host", &testStruct{result: "from host"})
+	err := host.Listen()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	return host, transport
+}
+
+func TestWebSocketTransport(t *testing.T) {
+	host, _ := startWebSocketHost(t)
+	defer host.Close()
+	plugin, err := NewPluginWithTransport("ws://"+host.Addr().String()+"/", "github.com/shibukawa/tobubus/websocket", NewWebSocketTransport())
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	defer plugin.Close()
+	plugin.SetToken("secret")
+	startTransportTest(t, host, plugin)
+}
+
+func TestWebSocketTransportRejectsInvalidToken(t *testing.T) {
+	host, _ := startWebSocketHost(t)
+	defer host.Close()
+	plugin, err := NewPluginWithTransport("ws://"+host.Addr().String()+"/", "github.com/shibukawa/tobubus/websocket", NewWebSocketTransport())
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	plugin.SetToken("wrong")
+	err = plugin.Connect()
+	if err == nil {
+		t.Error("err should not be nil")
+	}
+}
+
+func TestWebSocketTransportChecksOrigin(t *testing.T) {
+	host, _ := startWebSocketHost(t)
+	defer host.Close()
+	url := "ws://" + host.Addr().String() + "/"
+	_, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": []string{"http://example.com"}})
+	if err == nil {
+		t.Error("request from unknown origin should be rejected")
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": []string{"http://localhost:8080"}})
+	if err != nil {
+		t.Fatalf("request from allowed origin should be accepted, but %v", err)
+	}
+	defer conn.Close()
+	// browser plugins send the same frames
+	conn.WriteMessage(websocket.BinaryMessage, archiveMessage(ConnectClient, 1, archiveConnectClientBody("github.com/shibukawa/tobubus/websocket", CborCodec, "secret")))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	if string(data) != string(archiveMessage(ResultOK, 1, nil)) {
+		t.Errorf("host should accept ConnectClient, but %v", data)
+	}
+}
+
+func TestWebSocketTransportDeniesCallBeforeConnect(t *testing.T) {
+	host, _ := startWebSocketHost(t)
+	defer host.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+host.Addr().String()+"/", nil)
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	defer conn.Close()
+	call, _ := archiveMethodCallMessage(CborCodec, CallMethod, 1, "/host", "TestMethod", []interface{}{"without token"})
+	conn.WriteMessage(websocket.BinaryMessage, call)
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("err should be nil, but %v", err)
+	}
+	if string(data) != string(archiveMessage(ResultAccessDenied, 1, nil)) {
+		t.Errorf("host should deny CallMethod before ConnectClient, but %v", data)
+	}
+}